@@ -11,9 +11,10 @@ package RDMAGO
 */
 import "C"
 import (
-	"bufio"
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"unsafe"
 )
 
@@ -24,7 +25,7 @@ type IBRes struct {
 	Cq        *C.struct_ibv_cq
 	Qp        *C.struct_ibv_qp
 	Srq       *C.struct_ibv_srq
-	PortAttr  *C.struct_ibv_port_attr
+	PortAttr  C.struct_ibv_port_attr
 	DevAttr   C.struct_ibv_device_attr
 	Gid       C.union_ibv_gid
 	NumQps    int
@@ -32,12 +33,99 @@ type IBRes struct {
 	IbBufSize C.size_t
 
 	DeviceIndex C.int
+	deviceName  string
+
+	// port and GID index of the QP, see SetAddress; gidType is the type of Gid
+	Port     int
+	GidIndex int
+	gidType  string
+
+	// transport of the QP, see SetQPType
+	qpType QPType
+
+	// address vector shaping, see address.go; av is the one the QP was connected with
+	addrOpts AddressOptions
+	av       IBVAHAttr
+
+	// send queue, see sendqueue.go
+	MaxInlineData  C.uint
+	MaxSendWR      C.uint
+	SignalInterval int
+	sendPosted     uint32
+	sendReclaimed  uint32
+	sendUnsignaled int
+	sigRing        []uint32
+	sigRingSize    uint32
+	sigHead        uint32
+	sigTail        uint32
+
+	// SRQ sizing, see srq.go
+	SRQMaxWR   C.uint
+	SRQDepth   int
+	SRQBuffers int
+	SRQLimit   int
+
+	// set by the EventMonitor, see event.go
+	failed      int32
+	failedEvent int32
+
+	// ownership of the handles above, see resource.go
+	resources ibResources
+
+	// set by SetCapture, records posts and completions; peerQpNum labels the records
+	capture   *Capture
+	peerQpNum uint32
+
+	// logger set by SetLogger, log adds the device and QP to it once they exist
+	baseLog Logger
+	log     Logger
 }
 
 type QPInfo struct {
 	QpNum C.uint
 	Lid   C.ushort
 	Gid   C.union_ibv_gid
+
+	// where the GID sits on the sender's device, GidType is empty when it did not say
+	Port     int
+	GidIndex int
+	GidType  string
+
+	// buffer of the sender that accepts RDMA writes, 0 when there is none
+	Addr uint64
+	Rkey uint32
+	Len  uint32
+}
+
+// QPType is the transport of the QP InitRCQP creates, see SetQPType.
+type QPType int
+
+const (
+	QP_TYPE_RC QPType = iota // reliable connected, the default
+	QP_TYPE_UD               // unreliable datagram, see UDEndpoint
+	QP_TYPE_UC               // unreliable connected, see UCEndpoint
+)
+
+func (t QPType) String() string {
+	switch t {
+	case QP_TYPE_RC:
+		return "RC"
+	case QP_TYPE_UD:
+		return "UD"
+	case QP_TYPE_UC:
+		return "UC"
+	}
+	return fmt.Sprintf("QPType(%d)", int(t))
+}
+
+func (t QPType) verbs() C.enum_ibv_qp_type {
+	switch t {
+	case QP_TYPE_UD:
+		return C.IBV_QPT_UD
+	case QP_TYPE_UC:
+		return C.IBV_QPT_UC
+	}
+	return C.IBV_QPT_RC
 }
 
 type IBVQPAttr struct {
@@ -59,9 +147,11 @@ type IBVQPAttr struct {
 	ahAttr          IBVAHAttr
 }
 type IBVAHAttr struct {
-	grhDgid      C.union_ibv_gid
-	grhHopLimit  C.uchar
-	grhSgidIndex C.uchar
+	grhDgid         C.union_ibv_gid
+	grhHopLimit     C.uchar
+	grhSgidIndex    C.uchar
+	grhTrafficClass C.uchar
+	grhFlowLabel    C.uint
 
 	dlid        C.ushort
 	SL          C.uchar
@@ -76,6 +166,12 @@ const (
 
 	TOT_NUM_OPS   = 1
 	IB_WR_ID_STOP = 0xE000000000000000
+
+	// empty CQ polls between two checks of the context in polling loops
+	CTX_CHECK_INTERVAL = 64
+
+	// chunks QPSendData stages and posts with one chained WR list
+	QP_SEND_WINDOW = 16
 )
 
 const (
@@ -84,142 +180,150 @@ const (
 )
 
 func InitIBRes() (*IBRes, error) {
-	ibRes := (*IBRes)(C.malloc(C.size_t(unsafe.Sizeof(IBRes{}))))
-	if ibRes == nil {
-		return nil, fmt.Errorf("Failed to allocate memory for IBRes")
-	}
+	return &IBRes{Port: IB_PORT, GidIndex: DEFAULT_GID_INDEX}, nil
+}
+
+// SetLogger routes the logs of ibRes, its SRQ pool and event monitor to l. Call it before
+// InitRCQP; without it the package logger at InitRCQP time is used.
+func (ibRes *IBRes) SetLogger(l Logger) {
+	ibRes.baseLog = l
+	ibRes.log = nil
+}
 
-	//clear memory
-	C.memset(unsafe.Pointer(ibRes), 0, C.size_t(unsafe.Sizeof(*ibRes)))
-	return ibRes, nil
+// SetQPType must be called before InitRCQP, the QP is RC unless it is called.
+func (ibRes *IBRes) SetQPType(t QPType) {
+	ibRes.qpType = t
 }
 
+func (ibRes *IBRes) logger() Logger {
+	if ibRes.log != nil {
+		return ibRes.log
+	}
+	if ibRes.baseLog != nil {
+		return ibRes.baseLog
+	}
+	return DefaultLogger()
+}
+
+// FreeIBRes releases whatever FreeRCQP has not, the IBRes itself is garbage collected.
 func (ibRes *IBRes) FreeIBRes() {
-	C.free(unsafe.Pointer(ibRes))
-	return
+	if err := ibRes.FreeRCQP(); err != nil {
+		ibRes.logger().Error("[FreeIBRes] release failed", err)
+	}
 }
 
-// InitRCQP: init RC
-func (ibRes *IBRes) InitRCQP(deviceName string, MRSize int) (*QPInfo, error) {
+// InitRCQP: init RC. When a step fails, everything created before it is released.
+func (ibRes *IBRes) InitRCQP(deviceName string, MRSize int) (qpInfo *QPInfo, err error) {
+	defer func() {
+		if err != nil {
+			if freeErr := ibRes.FreeRCQP(); freeErr != nil {
+				ibRes.logger().Error("[InitRCQP] rollback failed", freeErr)
+			}
+		}
+	}()
+
 	// get device context
 	deviceAttr, err := GetIbvDeviceContext(ibRes, deviceName)
 	if err != nil {
-		return nil, errors.New("[InitRCQP] get IBV device context failed")
+		return nil, fmt.Errorf("[InitRCQP] get IBV device context failed: %w", err)
 	}
 	ibRes.Ctx = deviceAttr.Ctx
 
 	// alloc PD
 	err = IbvAllocPD(ibRes)
 	if err != nil {
-		return nil, errors.New("[InitRCQP] alloc PD failed")
+		return nil, fmt.Errorf("[InitRCQP] alloc PD failed: %w", err)
 	}
 
 	// query port
-	err = IbvQueryPort(ibRes, 1)
+	err = IbvQueryPort(ibRes, ibRes.Port)
 	if err != nil {
-		return nil, errors.New("[InitRCQP] query port failed")
+		return nil, fmt.Errorf("[InitRCQP] query port failed: %w", err)
 	}
 
 	// query gid
 	err = IbvQueryGid(ibRes)
 	if err != nil {
-		return nil, errors.New("[InitRCQP] query gid failed")
+		return nil, fmt.Errorf("[InitRCQP] query gid failed: %w", err)
 	}
 
 	// alloc MR
 	err = IbvRegMR(ibRes, MRSize)
 	if err != nil {
-		return nil, errors.New("[InitRCQP] regist MR failed")
+		return nil, fmt.Errorf("[InitRCQP] regist MR failed: %w", err)
 	}
 
 	// query device attr
 	err = IbvQueryDevice(ibRes)
 	if err != nil {
-		return nil, errors.New("[InitRCQP] query device failed")
+		return nil, fmt.Errorf("[InitRCQP] query device failed: %w", err)
 	}
 
 	// create CQ
 	err = IbvCreateCQ(ibRes)
 	if err != nil {
-		return nil, errors.New("[InitRCQP] create CQ failed")
+		return nil, fmt.Errorf("[InitRCQP] create CQ failed: %w", err)
 	}
 
 	// create SRQ
 	err = IbvCreateSRQ(ibRes)
 	if err != nil {
-		return nil, errors.New("[InitRCQP] create SRQ failed")
+		return nil, fmt.Errorf("[InitRCQP] create SRQ failed: %w", err)
 	}
 
 	// create QP
 	err = IbvCreateQP(ibRes)
 	if err != nil {
-		return nil, errors.New("[InitRCQP] create QP failed")
+		return nil, fmt.Errorf("[InitRCQP] create QP failed: %w", err)
+	}
+
+	ibRes.log = ibRes.logger().With("device", deviceName, "port", ibRes.Port, "qp_num", uint32(ibRes.Qp.qp_num))
+	if ibRes.qpType != QP_TYPE_RC {
+		ibRes.log = ibRes.log.With("qp_type", ibRes.qpType.String())
 	}
 
 	//get QP info
-	qpInfo, err := GetQPInfo(ibRes)
+	qpInfo, err = GetQPInfo(ibRes)
 	if err != nil {
-		return nil, errors.New("[InitRCQP] get QP info failed")
+		return nil, fmt.Errorf("[InitRCQP] get QP info failed: %w", err)
 	}
 
 	return qpInfo, nil
 }
 
+// FreeRCQP releases the device with everything created on it and the buffer behind IbBuf.
+// Dependents go first, e.g. the QP before its CQ, SRQ and PD. Released resources are
+// skipped, so it is safe to call again, e.g. after a step failed.
 func (ibRes *IBRes) FreeRCQP() error {
-
-	err := IbvDestroyQP(ibRes)
-	if err != nil {
-		return errors.New("[DestroyRCQP] destroy QP failed")
-	}
-	LogDebug("QP destroyed")
-
-	err = IbvDestroySRQ(ibRes)
-	if err != nil {
-		return errors.New("[DestroyRCQP] destroy SRQ failed")
+	if err := ibRes.resources.device.Close(); err != nil {
+		return fmt.Errorf("[DestroyRCQP] %w", err)
 	}
-	LogDebug("SRQ destroyed")
-
-	err = IbvDestroyCQ(ibRes)
-	if err != nil {
-		return errors.New("[DestroyRCQP] destroy CQ failed")
-	}
-	LogDebug("CQ destroyed")
-
-	err = IbvDeregMR(ibRes)
-	if err != nil {
-		return errors.New("[DestroyRCQP] dereg MR failed")
-	}
-	LogDebug("MR deregistered")
-
-	err = IbvDeallocPD(ibRes)
-	if err != nil {
-		return errors.New(fmt.Sprintf("[DestroyRCQP] dealloc PD failed %v", err))
-	}
-	LogDebug("PD deallocated")
-
-	err = IbvCloseDevice(ibRes)
-	if err != nil {
-		return errors.New("[DestroyRCQP] close device failed")
+	if err := ibRes.resources.buf.Close(); err != nil {
+		return fmt.Errorf("[DestroyRCQP] %w", err)
 	}
-	LogDebug("Device closed")
-
+	ibRes.logger().Debug("IB resources released")
 	return nil
 }
 
 func ConmunicateQPInfo(socketConfig *Config, info *QPInfo) (*QPInfo, error) {
+	return ConmunicateQPInfoContext(context.Background(), socketConfig, info)
+}
+
+// ConmunicateQPInfoContext is ConmunicateQPInfo with cancellation of the accept, dial and exchange.
+func ConmunicateQPInfoContext(ctx context.Context, socketConfig *Config, info *QPInfo) (*QPInfo, error) {
 	var QPInfo *QPInfo
 	var err error
 
 	switch socketConfig.Mode {
 	case "server":
-		err, QPInfo = StartServer(socketConfig.Port, *info)
+		err, QPInfo = StartServerContext(ctx, socketConfig.Port, *info)
 		if err != nil {
-			return nil, errors.New("[ConmunicateQPInfo] start server failed with error: " + err.Error())
+			return nil, fmt.Errorf("[ConmunicateQPInfo] start server failed with error: %w", err)
 		}
 	case "client":
-		err, QPInfo = StartClient(socketConfig.Address, *info)
+		err, QPInfo = StartClientContext(ctx, socketConfig.Address, *info)
 		if err != nil {
-			return nil, errors.New("[ConmunicateQPInfo] start client failed" + err.Error())
+			return nil, fmt.Errorf("[ConmunicateQPInfo] start client failed: %w", err)
 		}
 	default:
 		return nil, errors.New("[ConmunicateQPInfo] invalid mode")
@@ -229,24 +333,67 @@ func ConmunicateQPInfo(socketConfig *Config, info *QPInfo) (*QPInfo, error) {
 }
 
 func (ibRes *IBRes) ModifyQPRTS(qpInfo *QPInfo) error {
-	err := IbvModifyQPInit(ibRes.Qp)
+	// RoCE v1 and v2 GIDs cannot reach each other
+	if qpInfo.GidType != "" && ibRes.gidType != "" && qpInfo.GidType != ibRes.gidType {
+		return errors.New(fmt.Sprintf("[ModifyQPRTS] peer GID %v is %v, local GID index %v is %v",
+			qpInfo.GidIndex, qpInfo.GidType, ibRes.GidIndex, ibRes.gidType))
+	}
+
+	err := IbvModifyQPInitPort(ibRes.Qp, ibRes.Port)
+	if err != nil {
+		return fmt.Errorf("[ModifyQPRTS] modify QP to Init failed: %w", err)
+	}
+
+	ah, err := ibRes.addressVector(qpInfo)
 	if err != nil {
-		return errors.New("[ModifyQPRTS] modify QP to Init failed")
+		return fmt.Errorf("[ModifyQPRTS] %w", err)
 	}
+	ibRes.logger().Debug("[ModifyQPRTS] address vector", "dlid", uint16(ah.dlid), "global", ah.isGlobal == 1,
+		"sl", uint8(ah.SL), "traffic_class", uint8(ah.grhTrafficClass), "flow_label", uint32(ah.grhFlowLabel))
 
-	err = IbvModifyQPRTRDefault(ibRes.Qp, qpInfo.QpNum, qpInfo.Lid, qpInfo.Gid)
+	err = IbvModifyQPRTRAddress(ibRes.Qp, qpInfo.QpNum, ah)
 	if err != nil {
-		return errors.New("[ModifyQPRTS] modify QP to RTR failed")
+		return fmt.Errorf("[ModifyQPRTS] modify QP to RTR failed: %w", err)
 	}
 
 	err = IbvModifyQPRTSDefault(ibRes.Qp)
 	if err != nil {
-		return errors.New("[ModifyQPRTS] modify QP to RTS failed")
+		return fmt.Errorf("[ModifyQPRTS] modify QP to RTS failed: %w", err)
 	}
 
+	ibRes.peerQpNum = uint32(qpInfo.QpNum)
+	ibRes.av = ah
 	return nil
 }
 
+// SetCapture records the sends and receives posted through ibRes to c, nil stops it.
+// Completions are recorded by the Endpoint, UDEndpoint and UCEndpoint pollers, other
+// pollers call CaptureCompletion or CompletionRing.SetCapture.
+func (ibRes *IBRes) SetCapture(c *Capture) {
+	ibRes.capture = c
+}
+
+// CaptureCompletion records wc to the capture of ibRes, payload is the received data.
+func (ibRes *IBRes) CaptureCompletion(wc *C.struct_ibv_wc, payload []byte) {
+	if ibRes.capture == nil {
+		return
+	}
+	rec := captureRecord{
+		typ:       CAPTURE_COMPLETION,
+		opcode:    uint8(wc.opcode),
+		status:    uint8(wc.status),
+		qpNum:     uint32(wc.qp_num),
+		peerQpNum: ibRes.peerQpNum,
+		length:    uint32(wc.byte_len),
+		wrID:      uint64(wc.wr_id),
+	}
+	if wc.wc_flags&C.IBV_WC_WITH_IMM != 0 {
+		rec.imm = uint32(C.ibv_get_imm_data(wc))
+		rec.flags |= CAPTURE_FLAG_IMM
+	}
+	ibRes.capture.record(rec, payload)
+}
+
 func (ibRes *IBRes) SetIbBuf(buf string) {
 	C.strcpy(ibRes.IbBuf, C.CString(buf))
 }
@@ -260,68 +407,76 @@ func (ibRes *IBRes) GetIbBuf() string {
 }
 
 func (ibRes *IBRes) ListenServer(peerNum, cuurentMsgNum int) error {
-	LogDebug("ListenServer start")
+	return ibRes.ListenServerContext(context.Background(), peerNum, cuurentMsgNum)
+}
+
+// ListenServerContext is ListenServer that gives up when ctx is done, see waitCompletions.
+func (ibRes *IBRes) ListenServerContext(ctx context.Context, peerNum, cuurentMsgNum int) error {
+	log := ibRes.logger()
+	log.Debug("ListenServer start")
 
 	var err error
-	/* pre-post recvs */
-	for i := 0; i < peerNum; i++ {
-		for j := 0; j < 2; j++ {
-			wrID := uintptr(unsafe.Pointer(ibRes.IbBuf))
-			err = IbvPostSRQRecvRes(ibRes, uint64(wrID))
-			if err != nil {
-				return errors.New("post SRQ recv failed")
-			}
-			LogDebug(fmt.Sprintf("--- [SERVER] SRQ recv posted wrID = %v", wrID))
-		}
+	/* pre-post recvs, refilled by the managed SRQ as messages arrive */
+	srq, err := ibRes.managedSRQ(int(ibRes.IbBufSize))
+	if err != nil {
+		return fmt.Errorf("post SRQ recv failed: %w", err)
+	}
+	if log.DebugEnabled() {
+		log.Debug("--- [SERVER] SRQ recvs posted", "outstanding", srq.Stats().Outstanding)
 	}
-	LogDebug("pre-post recvs done")
 
 	for i := 0; i < peerNum; i++ {
 		wrID := uintptr(unsafe.Pointer(ibRes.IbBuf))
-		err = IbvPostSendRes(ibRes, MSG_CLIENT_START, uint64(wrID))
+		err = ibRes.PostInline(nil, MSG_CLIENT_START, uint64(wrID), false)
 		if err != nil {
-			return errors.New("post start send failed")
+			return fmt.Errorf("post start send failed: %w", err)
 		}
 	}
-	LogDebug("post start send done")
+	log.Debug("post start send done")
 
 	wc, err := CreateWC(10)
 	if err != nil {
-		return errors.New("create WC failed")
+		return fmt.Errorf("create WC failed: %w", err)
 	}
 	defer DestroyWC(wc)
 
-	LogDebug("start to poll CQ")
+	log.Debug("start to poll CQ")
 	var stop bool
 	for stop != true {
 
 		var num, opsCount int
-		for num < 1 {
-			num, err = IbvPollCQ(ibRes.Cq, 10, wc)
-			if err != nil {
-				return errors.New("poll CQ failed")
-			}
+		num, err = ibRes.waitCompletions(ctx, srq, wc, 10)
+		if err != nil {
+			return err
 		}
 
 		for i := 0; i < num; i++ {
 			offset := uintptr(i * int(unsafe.Sizeof(C.struct_ibv_wc{})))
 			newPtr := unsafe.Pointer(uintptr(unsafe.Pointer(wc)) + offset)
 			wcPtr := (*C.struct_ibv_wc)(newPtr)
-			LogDebug(fmt.Sprintf("wcStatus:%v wcOPcode: %v \n", wcPtr.status, wcPtr.opcode))
+			if log.DebugEnabled() {
+				log.Debug("wc", "status", WCStatus(wcPtr.status), "opcode", uint32(wcPtr.opcode), "wr_id", uint64(wcPtr.wr_id))
+			}
 
 			if wcPtr.status != C.IBV_WC_SUCCESS {
 				if wcPtr.opcode == C.IBV_WC_RECV {
-					return errors.New("server recv failed")
+					return fmt.Errorf("server recv failed: %w", newWCError(wcPtr))
 				} else if wcPtr.opcode == C.IBV_WC_SEND {
-					return errors.New("server send failed")
+					return fmt.Errorf("server send failed: %w", newWCError(wcPtr))
 				} else {
-					return errors.New("server unknown wc failed")
+					return fmt.Errorf("server unknown wc failed: %w", newWCError(wcPtr))
 				}
 			} else {
-				if wcPtr.opcode == C.IBV_WC_RECV {
+				if wcPtr.opcode == C.IBV_WC_SEND {
+					ibRes.OnSendCompletion()
+				} else if wcPtr.opcode == C.IBV_WC_RECV {
 					opsCount++
-					msgPtr := unsafe.Pointer(uintptr(wcPtr.wr_id))
-					LogInfo(fmt.Sprintf("WC RECV msg:%v\n", C.GoString((*C.char)(msgPtr))))
+					buf, err := srq.OnRecv(uint64(wcPtr.wr_id), int(wcPtr.byte_len))
+					if err != nil {
+						return fmt.Errorf("refill SRQ failed: %w", err)
+					}
+					log.Info("WC RECV", "msg", BufString(buf.Data))
+					srq.Release(buf)
 					if opsCount == TOT_NUM_OPS {
 						stop = true
 						break
@@ -330,49 +485,50 @@ func (ibRes *IBRes) ListenServer(peerNum, cuurentMsgNum int) error {
 			}
 		}
 	}
-	LogDebug("stop pull CQ")
+	log.Debug("stop pull CQ")
 
-	LogDebug("start to send stop")
+	log.Debug("start to send stop")
 	for i := 0; i < peerNum; i++ {
 		err = IbvPostSendRes(ibRes, MSG_CLIENT_STOP, IB_WR_ID_STOP)
 		if err != nil {
-			return errors.New("post stop send failed ")
+			return fmt.Errorf("post stop send failed: %w", err)
 		}
-		LogDebug(fmt.Sprintf("[SEND] IB_WR_ID_STOP ,immData = %v \n", MSG_CLIENT_STOP))
+		log.Debug("[SEND] IB_WR_ID_STOP", "imm_data", MSG_CLIENT_STOP)
 	}
-	LogDebug("stop send done")
+	log.Debug("stop send done")
 
-	LogDebug("start to poll CQ")
+	log.Debug("start to poll CQ")
 	stop = false
 	for stop != true {
 		var num, numAckedPeers int
-		for num < 1 {
-			num, err = IbvPollCQ(ibRes.Cq, 10, wc)
-			if err != nil {
-				return errors.New("poll CQ failed")
-			}
+		num, err = ibRes.waitCompletions(ctx, srq, wc, 10)
+		if err != nil {
+			return err
 		}
 
 		for i := 0; i < num; i++ {
 			offset := uintptr(i * int(unsafe.Sizeof(C.struct_ibv_wc{})))
 			newPtr := unsafe.Pointer(uintptr(unsafe.Pointer(wc)) + offset)
 			wcPtr := (*C.struct_ibv_wc)(newPtr)
-			LogDebug(fmt.Sprintf("wcStatus:%v wcOPcode: %v \n", wcPtr.status, wcPtr.opcode))
+			if log.DebugEnabled() {
+				log.Debug("wc", "status", WCStatus(wcPtr.status), "opcode", uint32(wcPtr.opcode), "wr_id", uint64(wcPtr.wr_id))
+			}
 
 			if wcPtr.status != C.IBV_WC_SUCCESS {
 				if wcPtr.opcode == C.IBV_WC_RECV {
-					return errors.New("server recv failed")
+					return fmt.Errorf("server recv failed: %w", newWCError(wcPtr))
 				} else if wcPtr.opcode == C.IBV_WC_SEND {
-					return errors.New("server send failed")
+					return fmt.Errorf("server send failed: %w", newWCError(wcPtr))
 				} else {
-					return errors.New("server unknown wc failed")
+					return fmt.Errorf("server unknown wc failed: %w", newWCError(wcPtr))
 				}
 			} else {
 				if wcPtr.opcode == C.IBV_WC_SEND {
+					ibRes.OnSendCompletion()
 					if wcPtr.wr_id == IB_WR_ID_STOP {
 						numAckedPeers++
 						if numAckedPeers == peerNum {
-							LogDebug("stop")
+							log.Debug("stop")
 							stop = true
 							break
 						}
@@ -385,55 +541,56 @@ func (ibRes *IBRes) ListenServer(peerNum, cuurentMsgNum int) error {
 }
 
 func (ibRes *IBRes) StartClient(peerNum, cuurentMsgNum int, fileName string) error {
-	LogDebug("start connection")
+	return ibRes.StartClientContext(context.Background(), peerNum, cuurentMsgNum, fileName)
+}
+
+// StartClientContext is StartClient that gives up when ctx is done, see waitCompletions.
+func (ibRes *IBRes) StartClientContext(ctx context.Context, peerNum, cuurentMsgNum int, fileName string) error {
+	log := ibRes.logger()
+	log.Debug("start connection")
 	var err error
-	/* pre-post recvs */
-	for i := 0; i < peerNum; i++ {
-		for j := 0; j < 2; j++ {
-			wrID := uintptr(unsafe.Pointer(ibRes.IbBuf))
-			err = IbvPostSRQRecvRes(ibRes, uint64(wrID))
-			if err != nil {
-				return errors.New("post SRQ recv failed")
-			}
-			LogDebug(fmt.Sprintf("--- [CLIENT] SRQ recv posted wrID = %v", wrID))
-			//ibRes.IbBuf = (*C.char)(unsafe.Pointer(uintptr(unsafe.Pointer(ibRes.IbBuf)) + unsafe.Sizeof(C.struct_ibv_wc{})))
-		}
+	/* pre-post recvs, refilled by the managed SRQ as messages arrive */
+	srq, err := ibRes.managedSRQ(int(ibRes.IbBufSize))
+	if err != nil {
+		return fmt.Errorf("post SRQ recv failed: %w", err)
+	}
+	if log.DebugEnabled() {
+		log.Debug("--- [CLIENT] SRQ recvs posted", "outstanding", srq.Stats().Outstanding)
 	}
-	LogDebug("pre-post recvs done")
 
 	wc, err := CreateWC(10)
 	if err != nil {
-		return errors.New("create WC failed")
+		return fmt.Errorf("create WC failed: %w", err)
 	}
 
-	LogDebug("start polling CQ")
+	log.Debug("start polling CQ")
 	var startSend bool
 	for startSend != true {
 		var num int
-		for num < 1 {
-			num, err = IbvPollCQ(ibRes.Cq, 10, wc)
-			if err != nil {
-				return errors.New("poll CQ failed")
-			}
+		num, err = ibRes.waitCompletions(ctx, srq, wc, 10)
+		if err != nil {
+			return err
+		}
+		if log.DebugEnabled() {
+			log.Debug("Poll CQ", "num", num)
 		}
-		LogDebug(fmt.Sprintf("  Poll CQ num: %v ", num))
 
 		var currentReady int
 		for i := 0; i < num; i++ {
 			offset := uintptr(i * int(unsafe.Sizeof(C.struct_ibv_wc{})))
 			newPtr := unsafe.Pointer(uintptr(unsafe.Pointer(wc)) + offset)
 			wcPtr := (*C.struct_ibv_wc)(newPtr)
-			LogDebug(fmt.Sprintf("wcStatus:%v wcOPcode: %v \n", wcPtr.status, wcPtr.opcode))
+			if log.DebugEnabled() {
+				log.Debug("wc", "status", WCStatus(wcPtr.status), "opcode", uint32(wcPtr.opcode), "wr_id", uint64(wcPtr.wr_id))
+			}
 
 			if wcPtr.status == C.IBV_WC_SUCCESS && wcPtr.opcode == C.IBV_WC_RECV {
 
-				//wrID := uintptr(unsafe.Pointer(ibRes.IbBuf))
-				//err = IbvPostSRQRecvRes(ibRes, uint64(wrID))
-				//if err != nil {
-				//	return errors.New("post SRQ recv failed")
-				//}
-				//LogDebug(fmt.Sprintf("--- [CLIENT] SRQ recv posted wrID = %v", wrID))
-				//ibRes.IbBuf = (*C.char)(unsafe.Pointer(uintptr(unsafe.Pointer(ibRes.IbBuf)) + unsafe.Sizeof(C.struct_ibv_wc{})))
+				buf, err := srq.OnRecv(uint64(wcPtr.wr_id), int(wcPtr.byte_len))
+				if err != nil {
+					return fmt.Errorf("refill SRQ failed: %w", err)
+				}
+				srq.Release(buf)
 
 				immData, err := C.ibv_get_imm_data(wcPtr)
 				if err != nil {
@@ -445,16 +602,16 @@ func (ibRes *IBRes) StartClient(peerNum, cuurentMsgNum int, fileName string) err
 					//ready to send
 					if currentReady == peerNum {
 						startSend = true
-						LogDebug("startSend ture")
+						log.Debug("startSend ture")
 						break
 					}
 				}
 			}
 		}
 	}
-	LogDebug("ready to send")
+	log.Debug("ready to send")
 
-	err = QPSendData(peerNum, ibRes, wc, fileName, int64(ibRes.IbBufSize))
+	err = QPSendDataContext(ctx, peerNum, ibRes, wc, fileName, int64(ibRes.IbBufSize))
 	if err != nil {
 		return err
 	}
@@ -463,6 +620,19 @@ func (ibRes *IBRes) StartClient(peerNum, cuurentMsgNum int, fileName string) err
 }
 
 func QPSendData(peerNum int, ibRes *IBRes, wc *C.struct_ibv_wc, fileName string, chunkSize int64) error {
+	return QPSendDataContext(context.Background(), peerNum, ibRes, wc, fileName, chunkSize)
+}
+
+// QPSendDataContext is QPSendData that gives up when ctx is done, see waitCompletions.
+// The chunks are staged in a registered buffer of up to QP_SEND_WINDOW chunks and each
+// window is posted as one chained WR list whose last WR is signaled. Receives go to the
+// SRQ pool of ibRes, which ListenServer and StartClient create.
+func QPSendDataContext(ctx context.Context, peerNum int, ibRes *IBRes, wc *C.struct_ibv_wc, fileName string, chunkSize int64) error {
+	log := ibRes.logger()
+	srq, err := ibRes.managedSRQ(int(ibRes.IbBufSize))
+	if err != nil {
+		return fmt.Errorf("[QPSendData] %w", err)
+	}
 
 	chunkCount, fileSize, file, err := GetFileMeta(fileName, chunkSize)
 	if err != nil {
@@ -470,91 +640,200 @@ func QPSendData(peerNum int, ibRes *IBRes, wc *C.struct_ibv_wc, fileName string,
 	}
 	defer file.Close()
 
-	for i := 0; i < peerNum; i++ {
-		reader := bufio.NewReader(file)
-		for j := 0; j < chunkCount; j++ {
-
-			curChunkSize := chunkSize
-			if j == chunkCount-1 {
-				curChunkSize = fileSize - int64(j)*chunkSize
-			}
-
-			chunk := make([]byte, curChunkSize)
-			wrID := uintptr(unsafe.Pointer(ibRes.IbBuf))
+	window := QP_SEND_WINDOW
+	if window > chunkCount {
+		window = chunkCount
+	}
+	if window > int(ibRes.MaxSendWR) {
+		window = int(ibRes.MaxSendWR)
+	}
+	if window < 1 {
+		window = 1
+	}
+	stagingSize := C.size_t(window) * C.size_t(chunkSize)
+	staging := C.malloc(stagingSize)
+	if staging == nil {
+		return errors.New("allocate send staging failed")
+	}
+	defer C.free(staging)
+	mr := C.ibv_reg_mr(ibRes.Pd, staging, stagingSize, C.IBV_ACCESS_LOCAL_WRITE)
+	if mr == nil {
+		return errors.New("register send staging failed")
+	}
+	defer C.ibv_dereg_mr(mr)
+	batch, err := NewSendBatch(window)
+	if err != nil {
+		return fmt.Errorf("create send batch failed: %w", err)
+	}
+	defer batch.Free()
 
-			_, err := reader.Read(chunk)
+	var numAckedPeers int
+	// poll handles completions until done reported one of them as the awaited one
+	poll := func(done func(wcPtr *C.struct_ibv_wc) bool) error {
+		for {
+			num, err := ibRes.waitCompletions(ctx, srq, wc, 10)
 			if err != nil {
 				return err
 			}
-			ibRes.SetIbBufWithBytes(chunk)
-
-			err = IbvPostSendRes(ibRes, i, uint64(wrID))
-			if err != nil {
-				return errors.New("post stop send failed")
+			if log.DebugEnabled() {
+				log.Debug("Poll CQ", "num", num)
 			}
-			LogDebug(fmt.Sprintf("--- [CLIENT] IbvPostSendRes wrID = %v", wrID))
 
-			newPtr := unsafe.Pointer(uintptr(unsafe.Pointer(wc)) + unsafe.Sizeof(C.struct_ibv_wc{}))
-			ibRes.IbBuf = (*C.char)(newPtr)
-		}
-	}
-	LogDebug("post send done")
+			var finished bool
+			for i := 0; i < num; i++ {
+				wcPtr := wcAt(wc, i)
+				if log.DebugEnabled() {
+					log.Debug("wc", "status", WCStatus(wcPtr.status), "opcode", uint32(wcPtr.opcode), "wr_id", uint64(wcPtr.wr_id))
+				}
 
-	LogDebug("start to poll CQ")
-	var numAckedPeers int
-	var stop bool
-	for stop != true {
-		var num int
-		for num < 1 {
-			num, err = IbvPollCQ(ibRes.Cq, 10, wc)
-			if err != nil {
-				return errors.New("poll CQ failed")
+				if wcPtr.status != C.IBV_WC_SUCCESS {
+					// opcode is undefined on a failed completion, the wr_id tells receives from sends
+					if srq.owns(uint64(wcPtr.wr_id)) {
+						return fmt.Errorf("client recv failed: %w", newWCError(wcPtr))
+					}
+					return fmt.Errorf("client send failed: %w", newWCError(wcPtr))
+				}
+				switch wcPtr.opcode {
+				case C.IBV_WC_RECV:
+					immData := C.ibv_get_imm_data(wcPtr)
+					if immData == MSG_CLIENT_STOP {
+						numAckedPeers++
+					}
+					buf, err := srq.OnRecv(uint64(wcPtr.wr_id), int(wcPtr.byte_len))
+					if err != nil {
+						return fmt.Errorf("refill SRQ failed: %w", err)
+					}
+					log.Info("WC RECV", "msg", BufString(buf.Data), "wr_id", uint64(wcPtr.wr_id), "imm_data", uint32(immData))
+					srq.Release(buf)
+				case C.IBV_WC_SEND:
+					ibRes.OnSendCompletion()
+					log.Info("WC SEND", "wr_id", uint64(wcPtr.wr_id))
+				}
+				if done(wcPtr) {
+					finished = true
+				}
+			}
+			if finished {
+				return nil
 			}
 		}
-		LogDebug(fmt.Sprintf("  Poll CQ num: %v ", num))
+	}
 
-		for i := 0; i < num; i++ {
-			offset := uintptr(i * int(unsafe.Sizeof(C.struct_ibv_wc{})))
-			newPtr := unsafe.Pointer(uintptr(unsafe.Pointer(wc)) + offset)
-			wcPtr := (*C.struct_ibv_wc)(newPtr)
-			LogDebug(fmt.Sprintf("wcStatus:%v wcOPcode: %v \n", wcPtr.status, wcPtr.opcode))
+	for i := 0; i < peerNum; i++ {
+		if _, err = file.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		for first := 0; first < chunkCount; first += window {
+			last := first + window - 1
+			if last >= chunkCount {
+				last = chunkCount - 1
+			}
 
-			if wcPtr.status != C.IBV_WC_SUCCESS {
-				if wcPtr.opcode == C.IBV_WC_RECV {
-					LogDebug(fmt.Sprintf("wcPtr.wr_id = %v,content: %v", wcPtr.wr_id, C.GoString((*C.char)(unsafe.Pointer(uintptr(wcPtr.wr_id))))))
-					return errors.New("server recv failed")
-				} else if wcPtr.opcode == C.IBV_WC_SEND {
-					LogDebug(fmt.Sprintf("wcPtr.wr_id = %v,content: %v", wcPtr.wr_id, C.GoString((*C.char)(unsafe.Pointer(uintptr(wcPtr.wr_id))))))
-					return errors.New("server send failed")
-				} else {
-					LogDebug(fmt.Sprintf("wcPtr.wr_id = %v,content: %v", wcPtr.wr_id, C.GoString((*C.char)(unsafe.Pointer(uintptr(wcPtr.wr_id))))))
-					return errors.New("server unknown wc failed")
+			batch.Reset()
+			var lastWrID uint64
+			for j := first; j <= last; j++ {
+				curChunkSize := chunkSize
+				if j == chunkCount-1 {
+					curChunkSize = fileSize - int64(j)*chunkSize
+				}
+				buf := unsafe.Add(staging, int64(j-first)*chunkSize)
+				if _, err = io.ReadFull(file, unsafe.Slice((*byte)(buf), curChunkSize)); err != nil {
+					return err
 				}
-			} else {
-				if wcPtr.opcode == C.IBV_WC_RECV {
 
-					immData, err := C.ibv_get_imm_data(wcPtr)
-					if err != nil {
-						return errors.New("get imm data failed")
-					}
+				// only the last chunk of the window needs a completion, it covers the ones before it
+				var flags C.uint
+				if j == last {
+					flags = C.IBV_SEND_SIGNALED
+				}
+				lastWrID = uint64(uintptr(buf))
+				err = batch.AddSend((*C.char)(buf), C.uint(curChunkSize), mr.lkey, C.ulong(lastWrID), C.uint(i), flags)
+				if err != nil {
+					return fmt.Errorf("add send failed: %w", err)
+				}
+			}
 
-					if immData == MSG_CLIENT_STOP {
-						numAckedPeers++
-					}
-					msgPtr := unsafe.Pointer(uintptr(wcPtr.wr_id))
-					LogDebug(fmt.Sprintf("[RECV] wcPtr.wr_id = %v ,immData = %v \n", wcPtr.wr_id, immData))
-					LogInfo(fmt.Sprintf("WC RECV msg:%v ,immData:%v\n", C.GoString((*C.char)(msgPtr)), immData))
-					if numAckedPeers == peerNum {
-						LogDebug("stop")
-						stop = true
-						break
+			posted, err := ibRes.PostSendBatch(batch)
+			if err != nil {
+				if posted > 0 {
+					// the posted chunks still read the staging buffer
+					if abortErr := ibRes.AbortQP(srq, wc, 10); abortErr != nil {
+						log.Error("abort QP failed", abortErr)
 					}
-				} else if wcPtr.opcode == C.IBV_WC_SEND {
-					msgPtr := unsafe.Pointer(uintptr(wcPtr.wr_id))
-					LogInfo(fmt.Sprintf("WC SEND msg:%v\n", C.GoString((*C.char)(msgPtr))))
 				}
+				return fmt.Errorf("post send failed at chunk %v of %v: %w", first+posted, chunkCount, err)
+			}
+			if log.DebugEnabled() {
+				log.Debug("--- [CLIENT] PostSendBatch", "chunks", posted, "wr_id", lastWrID)
 			}
+
+			// the staging buffer is reused once the window completed
+			err = poll(func(wcPtr *C.struct_ibv_wc) bool {
+				return wcPtr.opcode == C.IBV_WC_SEND && uint64(wcPtr.wr_id) == lastWrID
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	log.Debug("post send done")
+
+	log.Debug("start to poll CQ")
+	if numAckedPeers < peerNum {
+		return poll(func(*C.struct_ibv_wc) bool {
+			return numAckedPeers == peerNum
+		})
+	}
+	return nil
+}
+
+// waitCompletions polls the CQ into wc until at least one completion arrived. It fails
+// when the QP was marked failed or ctx is done; on cancellation the QP is aborted so the
+// WRs still posted cannot touch their buffers after the caller returns.
+func (ibRes *IBRes) waitCompletions(ctx context.Context, srq *ManagedSRQ, wc *C.struct_ibv_wc, max int) (int, error) {
+	for spins := 0; ; spins++ {
+		if err := ibRes.Failed(); err != nil {
+			return 0, err
 		}
+		if spins%CTX_CHECK_INTERVAL == 0 && ctx.Err() != nil {
+			if err := ibRes.AbortQP(srq, wc, max); err != nil {
+				ibRes.logger().Error("[waitCompletions] abort QP failed", err)
+			}
+			return 0, ctx.Err()
+		}
+		num, err := IbvPollCQ(ibRes.Cq, C.int(max), wc)
+		if err != nil {
+			return 0, fmt.Errorf("poll CQ failed: %w", err)
+		}
+		if num > 0 {
+			return num, nil
+		}
+	}
+}
+
+// AbortQP moves the QP to the error state so the hardware flushes the outstanding send
+// WRs and drains the CQ. Receives that completed before the flush go back to srq, which
+// may be nil; those still posted stay on the SRQ, which the QP only shares. The send
+// queue accounting is reset; the QP needs ModifyQPRTS before reuse. wc must hold num entries.
+func (ibRes *IBRes) AbortQP(srq *ManagedSRQ, wc *C.struct_ibv_wc, num int) error {
+	if err := IbvModifyQPState(ibRes.Qp, C.IBV_QPS_ERR); err != nil {
+		return fmt.Errorf("[AbortQP] %w", err)
+	}
+	err := drainCQ(ibRes.Cq, wc, num, func(wc *C.struct_ibv_wc) {
+		// opcode is undefined on a failed completion, the wr_id tells receives from sends
+		wrID := uint64(wc.wr_id)
+		if !srq.owns(wrID) {
+			return
+		}
+		if wc.status != C.IBV_WC_SUCCESS {
+			srq.OnFlush(wrID)
+		} else if buf, _ := srq.OnRecv(wrID, int(wc.byte_len)); buf != nil {
+			srq.Release(buf)
+		}
+	})
+	ibRes.ResetSendSlots()
+	if err != nil {
+		return fmt.Errorf("[AbortQP] %w", err)
 	}
 	return nil
 }
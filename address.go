@@ -0,0 +1,210 @@
+package RDMAGO
+
+/*
+#cgo CFLAGS: -I/usr/include/infiniband
+#cgo LDFLAGS: -libverbs -L. -lwrapper
+
+#include "wrapper.h"
+
+#include <stdlib.h>
+#include <infiniband/verbs.h>
+*/
+import "C"
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"unsafe"
+)
+
+const (
+	// GRH hop limit when AddressOptions leaves it 0, enough to cross IB routers and IP hops
+	DEFAULT_HOP_LIMIT = 64
+
+	// unicast LIDs, 0 is reserved and the rest are multicast or permissive
+	IB_MIN_UNICAST_LID = 0x0001
+	IB_MAX_UNICAST_LID = 0xBFFF
+
+	IB_MAX_SL         = 15
+	IB_MAX_FLOW_LABEL = 0xFFFFF
+	IP_MAX_DSCP       = 63
+)
+
+// AddressOptions shapes the address vector of the connected QP. SrcPathBits and RouterLID
+// are used on InfiniBand; the GRH fields when the peer is reached through a GRH, which is
+// always on RoCE and on InfiniBand when GlobalRoute is set or the peer is on another subnet.
+type AddressOptions struct {
+	SL          uint8  // service level, 0 to 15; on RoCE devices map it to the priority
+	SrcPathBits uint8  // low LID bits selecting one of the port's 2^LMC paths
+	RouterLID   uint16 // LID of the IB router towards a peer on another subnet
+
+	HopLimit     uint8  // DEFAULT_HOP_LIMIT when 0
+	TrafficClass uint8  // GRH traffic class, on RoCE v2 the IP DSCP and ECN bits
+	DSCP         uint8  // sets the upper 6 bits of TrafficClass when not 0
+	FlowLabel    uint32 // 20 bits, 0 lets the device choose
+	// derive the flow label from both QP numbers when FlowLabel is 0, so connections
+	// between the same hosts spread over ECMP paths; on RoCE v2 the device derives the
+	// UDP source port from it
+	AutoFlowLabel bool
+	GlobalRoute   bool // use a GRH on InfiniBand even within the subnet
+}
+
+// PathQoS is the QoS a connected QP sends with.
+type PathQoS struct {
+	SL           uint8  `json:"sl"`
+	TrafficClass uint8  `json:"traffic_class"`
+	FlowLabel    uint32 `json:"flow_label"`
+}
+
+// pathQoS returns the QoS of the address vector set by ModifyQPRTS.
+func (ibRes *IBRes) pathQoS() PathQoS {
+	return PathQoS{
+		SL:           uint8(ibRes.av.SL),
+		TrafficClass: uint8(ibRes.av.grhTrafficClass),
+		FlowLabel:    uint32(ibRes.av.grhFlowLabel),
+	}
+}
+
+// trafficClass returns the GRH traffic class with the DSCP applied.
+func (opts *AddressOptions) trafficClass() uint8 {
+	if opts.DSCP == 0 {
+		return opts.TrafficClass
+	}
+	return opts.DSCP<<2 | opts.TrafficClass&0x3
+}
+
+// flowLabelFromQPNs folds the product of the QP numbers into 20 bits as the kernel does
+// for connections it sets up, both sides get the same label.
+func flowLabelFromQPNs(local, remote uint32) uint32 {
+	fl := uint64(local) * uint64(remote)
+	fl ^= fl >> 20
+	fl ^= fl >> 40
+	return uint32(fl & IB_MAX_FLOW_LABEL)
+}
+
+// SetAddressOptions must be called before ModifyQPRTS.
+func (ibRes *IBRes) SetAddressOptions(opts AddressOptions) error {
+	if opts.SL > IB_MAX_SL {
+		return errors.New(fmt.Sprintf("[SetAddressOptions] SL %v is above %v", opts.SL, IB_MAX_SL))
+	}
+	if opts.DSCP > IP_MAX_DSCP {
+		return errors.New(fmt.Sprintf("[SetAddressOptions] DSCP %v is above %v", opts.DSCP, IP_MAX_DSCP))
+	}
+	if opts.DSCP != 0 && opts.TrafficClass>>2 != 0 && opts.TrafficClass>>2 != opts.DSCP {
+		return errors.New(fmt.Sprintf("[SetAddressOptions] DSCP %v contradicts traffic class %#x", opts.DSCP, opts.TrafficClass))
+	}
+	if opts.FlowLabel > IB_MAX_FLOW_LABEL {
+		return errors.New(fmt.Sprintf("[SetAddressOptions] flow label %#x does not fit 20 bits", opts.FlowLabel))
+	}
+	ibRes.addrOpts = opts
+	return nil
+}
+
+// addressOptions returns the address options of the config.
+func (cfg *Config) addressOptions() AddressOptions {
+	return AddressOptions{
+		SL:            cfg.SL,
+		SrcPathBits:   cfg.SrcPathBits,
+		RouterLID:     cfg.RouterLID,
+		HopLimit:      cfg.HopLimit,
+		TrafficClass:  cfg.TrafficClass,
+		DSCP:          cfg.DSCP,
+		FlowLabel:     cfg.FlowLabel,
+		AutoFlowLabel: cfg.AutoFlowLabel,
+		GlobalRoute:   cfg.GlobalRoute,
+	}
+}
+
+// addressVector builds the address vector reaching the peer from the local port: LID
+// routed on an InfiniBand subnet, through a GRH on RoCE and between IB subnets. It fails
+// when the peer's LID or GID cannot be used from the port.
+func (ibRes *IBRes) addressVector(peer *QPInfo) (IBVAHAttr, error) {
+	opts := ibRes.addrOpts
+	port := &ibRes.PortAttr
+	localGid := gidBytes(&ibRes.Gid)
+	peerGid := gidBytes(&peer.Gid)
+
+	ah := IBVAHAttr{
+		portNum:      C.uchar(ibRes.Port),
+		grhSgidIndex: C.uchar(ibRes.GidIndex),
+		SL:           C.uchar(opts.SL),
+	}
+	global := false
+	if port.link_layer == C.IBV_LINK_LAYER_ETHERNET {
+		// RoCE has no LIDs, the GID is the only address
+		if net.IP(peerGid).IsUnspecified() {
+			return ah, errors.New("[addressVector] peer sent no GID for a RoCE port")
+		}
+		if (net.IP(localGid).To4() == nil) != (net.IP(peerGid).To4() == nil) {
+			return ah, errors.New(fmt.Sprintf("[addressVector] peer GID %v and local GID %v are of different IP families",
+				net.IP(peerGid), net.IP(localGid)))
+		}
+		global = true
+	} else {
+		if port.lid < IB_MIN_UNICAST_LID || port.lid > IB_MAX_UNICAST_LID {
+			return ah, errors.New(fmt.Sprintf("[addressVector] local port %v has no unicast LID (%#x), is the subnet manager running?",
+				ibRes.Port, uint16(port.lid)))
+		}
+		if opts.SrcPathBits >= 1<<uint(port.lmc) {
+			return ah, errors.New(fmt.Sprintf("[addressVector] source path bits %v need an LMC above %v",
+				opts.SrcPathBits, uint8(port.lmc)))
+		}
+		// the subnet prefix is the upper half of the GID
+		routed := !net.IP(peerGid).IsUnspecified() && !bytes.Equal(peerGid[:8], localGid[:8])
+		global = opts.GlobalRoute || routed
+		if global && net.IP(peerGid).IsUnspecified() {
+			return ah, errors.New("[addressVector] global route needs the peer GID")
+		}
+		// a router forwards by GID, packets are sent to its LID on the local subnet
+		dlid := uint16(peer.Lid)
+		if routed {
+			if opts.RouterLID == 0 {
+				return ah, errors.New(fmt.Sprintf("[addressVector] peer GID %v is on another subnet and no router LID is set",
+					net.IP(peerGid)))
+			}
+			dlid = opts.RouterLID
+		}
+		if dlid < IB_MIN_UNICAST_LID || dlid > IB_MAX_UNICAST_LID {
+			return ah, errors.New(fmt.Sprintf("[addressVector] destination LID %#x is not a unicast LID", dlid))
+		}
+		ah.dlid = C.ushort(dlid)
+		ah.srcPathBits = C.uchar(opts.SrcPathBits)
+	}
+
+	if global {
+		hopLimit := opts.HopLimit
+		if hopLimit == 0 {
+			hopLimit = DEFAULT_HOP_LIMIT
+		}
+		ah.isGlobal = 1
+		ah.grhDgid = peer.Gid
+		ah.grhHopLimit = C.uchar(hopLimit)
+		ah.grhTrafficClass = C.uchar(opts.trafficClass())
+		ah.grhFlowLabel = C.uint(opts.FlowLabel)
+		if opts.FlowLabel == 0 && opts.AutoFlowLabel {
+			ah.grhFlowLabel = C.uint(flowLabelFromQPNs(uint32(ibRes.Qp.qp_num), uint32(peer.QpNum)))
+		}
+	}
+	return ah, nil
+}
+
+// fill copies the address vector into a verbs ah_attr, for ibv_modify_qp and ibv_create_ah.
+func (a *IBVAHAttr) fill(attr *C.struct_ibv_ah_attr) {
+	attr.is_global = a.isGlobal
+
+	attr.grh.hop_limit = a.grhHopLimit
+	attr.grh.dgid = a.grhDgid
+	attr.grh.sgid_index = a.grhSgidIndex
+	attr.grh.traffic_class = a.grhTrafficClass
+	attr.grh.flow_label = a.grhFlowLabel
+
+	attr.dlid = a.dlid
+	attr.sl = a.SL
+	attr.src_path_bits = a.srcPathBits
+	attr.port_num = a.portNum
+}
+
+func gidBytes(gid *C.union_ibv_gid) []byte {
+	return C.GoBytes(unsafe.Pointer(gid), C.int(unsafe.Sizeof(*gid)))
+}
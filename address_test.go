@@ -0,0 +1,27 @@
+package RDMAGO
+
+import "testing"
+
+func TestFlowLabelFromQPNs(t *testing.T) {
+	tests := []struct {
+		local, remote uint32
+		want          uint32
+	}{
+		{1, 1, 0x1},
+		{0x12345, 0x678, 0xc262d},
+		{0xffffff, 0xffffff, 0xfff1e},
+		{0, 0x1234, 0},
+	}
+	for _, tt := range tests {
+		got := flowLabelFromQPNs(tt.local, tt.remote)
+		if got != tt.want {
+			t.Errorf("flowLabelFromQPNs(%#x, %#x) = %#x, want %#x", tt.local, tt.remote, got, tt.want)
+		}
+		if back := flowLabelFromQPNs(tt.remote, tt.local); back != got {
+			t.Errorf("flowLabelFromQPNs(%#x, %#x) = %#x, the other side gets %#x", tt.local, tt.remote, got, back)
+		}
+		if got > IB_MAX_FLOW_LABEL {
+			t.Errorf("flowLabelFromQPNs(%#x, %#x) = %#x does not fit 20 bits", tt.local, tt.remote, got)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package RDMAGO
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var endpointsMu sync.Mutex
+var liveEndpoints = map[*Endpoint]struct{}{}
+
+func registerEndpoint(ep *Endpoint) {
+	endpointsMu.Lock()
+	defer endpointsMu.Unlock()
+	liveEndpoints[ep] = struct{}{}
+}
+
+// unregisterEndpoint waits for admin requests reading ep, after it ep may be released.
+func unregisterEndpoint(ep *Endpoint) {
+	endpointsMu.Lock()
+	defer endpointsMu.Unlock()
+	delete(liveEndpoints, ep)
+}
+
+// EndpointInfo describes an open Endpoint for introspection.
+type EndpointInfo struct {
+	Mode             string        `json:"mode"`
+	QoSClass         string        `json:"qos_class,omitempty"`
+	QoS              PathQoS       `json:"qos"`
+	Device           string        `json:"device"`
+	Port             int           `json:"port"`
+	State            string        `json:"state"`
+	LastError        string        `json:"last_error,omitempty"`
+	Peer             string        `json:"peer,omitempty"`
+	QpNum            uint32        `json:"qp_num"`
+	PeerQpNum        uint32        `json:"peer_qp_num"`
+	OutstandingSends int           `json:"outstanding_sends"`
+	Inbox            int           `json:"inbox"`
+	Credits          CreditStats   `json:"credits"`
+	SRQ              SRQStats      `json:"srq"`
+	Session          *SessionStats `json:"session,omitempty"`
+}
+
+func (ep *Endpoint) Info() EndpointInfo {
+	ep.mu.Lock()
+	info := EndpointInfo{
+		Mode:     ep.cfg.Mode,
+		QoSClass: ep.cfg.qosClass,
+		QoS:      ep.qos,
+		Device:   ep.res.deviceName,
+		Port:     ep.res.Port,
+		State:    ep.state.String(),
+		Peer:     ep.peerAddr,
+		Inbox:    len(ep.inbox),
+	}
+	if ep.lastErr != nil {
+		info.LastError = ep.lastErr.Error()
+	}
+	if ep.peer != nil {
+		info.PeerQpNum = uint32(ep.peer.QpNum)
+	}
+	session := ep.session
+	ep.mu.Unlock()
+
+	if ep.res.Qp != nil {
+		info.QpNum = uint32(ep.res.Qp.qp_num)
+	}
+	ep.postMu.Lock()
+	info.OutstandingSends = int(ep.res.MaxSendWR) - ep.res.SendSlotsAvailable()
+	ep.postMu.Unlock()
+	info.Credits = ep.CreditStats()
+	info.SRQ = ep.srq.Stats()
+	if session != nil {
+		stats := session.Stats()
+		info.Session = &stats
+	}
+	return info
+}
+
+// OpenEndpoints returns the Endpoints that are open.
+func OpenEndpoints() []EndpointInfo {
+	endpointsMu.Lock()
+	defer endpointsMu.Unlock()
+	infos := make([]EndpointInfo, 0, len(liveEndpoints))
+	for ep := range liveEndpoints {
+		infos = append(infos, ep.Info())
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].QpNum < infos[j].QpNum })
+	return infos
+}
+
+// AdminHandler serves the state of the package as JSON:
+//
+//	GET       /devices      RDMA devices of the host with ports and GID tables, see Devices
+//	GET       /resources    open devices, PDs, MRs, CQs, SRQs, QPs and buffers, see OpenResources
+//	GET       /endpoints    open Endpoints and their sessions, see OpenEndpoints
+//	GET       /leaks        resources created while tracking and still open
+//	GET, PUT  /log_level    level of the package logger, e.g. PUT "debug"
+//	GET, PUT  /tracking     resource tracking, PUT "true" or "false"
+//
+// Mount it under a prefix of an existing mux, e.g.
+// mux.Handle("/debug/rdma/", http.StripPrefix("/debug/rdma", AdminHandler())).
+func AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/devices", func(w http.ResponseWriter, r *http.Request) {
+		if !adminMethod(w, r, http.MethodGet) {
+			return
+		}
+		devices, err := Devices()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, devices)
+	})
+	mux.HandleFunc("/resources", func(w http.ResponseWriter, r *http.Request) {
+		if adminMethod(w, r, http.MethodGet) {
+			writeJSON(w, OpenResources())
+		}
+	})
+	mux.HandleFunc("/endpoints", func(w http.ResponseWriter, r *http.Request) {
+		if adminMethod(w, r, http.MethodGet) {
+			writeJSON(w, OpenEndpoints())
+		}
+	})
+	mux.HandleFunc("/leaks", func(w http.ResponseWriter, r *http.Request) {
+		if adminMethod(w, r, http.MethodGet) {
+			writeJSON(w, LeakedResources())
+		}
+	})
+	mux.HandleFunc("/log_level", func(w http.ResponseWriter, r *http.Request) {
+		if !adminMethod(w, r, http.MethodGet, http.MethodPut) {
+			return
+		}
+		if r.Method == http.MethodPut {
+			value, ok := readValue(w, r)
+			if !ok {
+				return
+			}
+			if err := SetLogLevel(value); err != nil {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
+			DefaultLogger().Info("[AdminHandler] log level changed", "level", value)
+		}
+		writeJSON(w, LogLevel())
+	})
+	mux.HandleFunc("/tracking", func(w http.ResponseWriter, r *http.Request) {
+		if !adminMethod(w, r, http.MethodGet, http.MethodPut) {
+			return
+		}
+		if r.Method == http.MethodPut {
+			value, ok := readValue(w, r)
+			if !ok {
+				return
+			}
+			switch value {
+			case "true":
+				TrackResources(true)
+			case "false":
+				TrackResources(false)
+			default:
+				http.Error(w, "tracking must be true or false", http.StatusBadRequest)
+				return
+			}
+		}
+		resourceMu.Lock()
+		enabled := leakTracking
+		resourceMu.Unlock()
+		writeJSON(w, enabled)
+	})
+	return mux
+}
+
+func adminMethod(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, method := range methods {
+		if r.Method == method {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	return false
+}
+
+// readValue reads the body of a PUT, a bare or JSON quoted value.
+func readValue(w http.ResponseWriter, r *http.Request) (string, bool) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1024))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return "", false
+	}
+	value := strings.TrimSpace(string(body))
+	var quoted string
+	if json.Unmarshal([]byte(value), &quoted) == nil {
+		value = quoted
+	}
+	return value, true
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,302 @@
+package RDMAGO
+
+/*
+#cgo CFLAGS: -I/usr/include/infiniband
+#cgo LDFLAGS: -libverbs -L. -lwrapper
+
+#include "wrapper.h"
+
+#include <stdlib.h>
+#include <infiniband/verbs.h>
+*/
+import "C"
+import (
+	"errors"
+	"fmt"
+	"unsafe"
+)
+
+// SendBatch is a chain of send WRs kept in preallocated C memory. Fill it with AddSend,
+// post it with IbvPostSendBatch or IBRes.PostSendBatch (one cgo call and one doorbell for
+// the whole chain) and Reset it for reuse.
+type SendBatch struct {
+	wrs      *C.struct_ibv_send_wr
+	sges     *C.struct_ibv_sge
+	signaled []bool
+	// buffers and immediate data of the WRs, kept for the capture
+	bufs []*C.char
+	imm  []uint32
+	size int
+	num  int
+}
+
+// RecvBatch is the receive side counterpart of SendBatch, posted to an SRQ.
+type RecvBatch struct {
+	wrs  *C.struct_ibv_recv_wr
+	sges *C.struct_ibv_sge
+	size int
+	num  int
+}
+
+func NewSendBatch(size int) (*SendBatch, error) {
+	if size < 1 {
+		return nil, errors.New(fmt.Sprintf("[NewSendBatch] invalid size %v", size))
+	}
+	wrs := (*C.struct_ibv_send_wr)(C.calloc(C.size_t(size), C.sizeof_struct_ibv_send_wr))
+	if wrs == nil {
+		return nil, errors.New("[NewSendBatch] failed to allocate memory")
+	}
+	sges := (*C.struct_ibv_sge)(C.calloc(C.size_t(size), C.sizeof_struct_ibv_sge))
+	if sges == nil {
+		C.free(unsafe.Pointer(wrs))
+		return nil, errors.New("[NewSendBatch] failed to allocate memory")
+	}
+	return &SendBatch{wrs: wrs, sges: sges, signaled: make([]bool, size), bufs: make([]*C.char, size),
+		imm: make([]uint32, size), size: size}, nil
+}
+
+func (b *SendBatch) wrSlice() []C.struct_ibv_send_wr {
+	return unsafe.Slice(b.wrs, b.size)
+}
+
+func (b *SendBatch) sgeSlice() []C.struct_ibv_sge {
+	return unsafe.Slice(b.sges, b.size)
+}
+
+// Len returns the number of WRs in the batch.
+func (b *SendBatch) Len() int {
+	return b.num
+}
+
+// Reset empties the batch, the C memory is kept for the next round.
+func (b *SendBatch) Reset() {
+	b.num = 0
+}
+
+// Free releases the C memory, the batch must not be used afterwards.
+func (b *SendBatch) Free() {
+	if b.wrs != nil {
+		C.free(unsafe.Pointer(b.wrs))
+		b.wrs = nil
+	}
+	if b.sges != nil {
+		C.free(unsafe.Pointer(b.sges))
+		b.sges = nil
+	}
+	b.size = 0
+	b.num = 0
+}
+
+// AddSend appends a SEND_WITH_IMM of length bytes at buf, which must lie in the MR of lkey.
+// The WR is linked behind the previous one.
+func (b *SendBatch) AddSend(buf *C.char, length C.uint, lkey C.uint, wrID C.ulong, immData C.uint, sendFlags C.uint) error {
+	if b.num == b.size {
+		return errors.New(fmt.Sprintf("[SendBatch] batch full (%v WRs)", b.size))
+	}
+	wrs := b.wrSlice()
+	sges := b.sgeSlice()
+
+	sges[b.num] = C.struct_ibv_sge{
+		addr:   C.uint64_t(uintptr(unsafe.Pointer(buf))),
+		length: length,
+		lkey:   lkey,
+	}
+
+	wr := &wrs[b.num]
+	C.memset(unsafe.Pointer(wr), 0, C.sizeof_struct_ibv_send_wr)
+	wr.wr_id = C.uint64_t(wrID)
+	wr.sg_list = &sges[b.num]
+	wr.num_sge = 1
+	wr.opcode = C.IBV_WR_SEND_WITH_IMM
+	wr.send_flags = sendFlags
+	C.ibv_set_imm_data(wr, immData)
+	if b.num > 0 {
+		wrs[b.num-1].next = wr
+	}
+
+	b.signaled[b.num] = sendFlags&C.IBV_SEND_SIGNALED != 0
+	b.bufs[b.num] = buf
+	b.imm[b.num] = uint32(immData)
+	b.num++
+	return nil
+}
+
+// AddSendRes appends a send of IbBuf[offset:offset+length]. signaled only expresses
+// the wish for a completion, PostSendBatch applies the selective signaling rules.
+func (b *SendBatch) AddSendRes(ibRes *IBRes, offset, length int, immData uint32, wrID uint64, signaled bool) error {
+	if offset < 0 || length < 0 || offset+length > int(ibRes.IbBufSize) {
+		return errors.New(fmt.Sprintf("[SendBatch] range %v+%v outside of MR", offset, length))
+	}
+	var flags C.uint
+	if signaled {
+		flags = C.IBV_SEND_SIGNALED
+	}
+	buf := (*C.char)(unsafe.Add(unsafe.Pointer(ibRes.IbBuf), offset))
+	return b.AddSend(buf, C.uint(length), ibRes.Mr.lkey, C.ulong(wrID), C.uint(immData), flags)
+}
+
+// IbvPostSendBatch posts the whole chain with a single ibv_post_send.
+// It returns the number of WRs accepted; on failure WRs from that index on were not posted.
+func IbvPostSendBatch(qp *C.struct_ibv_qp, b *SendBatch) (int, error) {
+	if b.num == 0 {
+		return 0, nil
+	}
+	b.wrSlice()[b.num-1].next = nil
+
+	var badIndex C.int
+	res, cerr := C.ibv_post_send_list_wrapper(qp, b.wrs, &badIndex)
+	if res != 0 {
+		posted := int(badIndex)
+		if posted < 0 {
+			posted = 0
+		}
+		err := postSendError(qp, uint64(b.wrSlice()[posted].wr_id), int(res), cerr)
+		return posted, fmt.Errorf("[IbvPostSendBatch] WR %v of %v: %w", badIndex, b.num, err)
+	}
+	return b.num, nil
+}
+
+// PostSendBatch posts the batch on ibRes.Qp and keeps the send queue accounting of
+// sendqueue.go up to date, including for a partially posted chain.
+func (ibRes *IBRes) PostSendBatch(b *SendBatch) (int, error) {
+	if b.num == 0 {
+		return 0, nil
+	}
+	saved := ibRes.saveSendSlots()
+
+	wrs := b.wrSlice()
+	flags := make([]C.uint, b.num)
+	for i := 0; i < b.num; i++ {
+		length := int(wrs[i].sg_list.length)
+		f, err := ibRes.nextSendFlags(length, b.signaled[i])
+		if err != nil {
+			ibRes.restoreSendSlots(saved)
+			return 0, err
+		}
+		// inline is decided by nextSendFlags, the sge still points into the MR so lkey stays valid
+		wrs[i].send_flags = f
+		flags[i] = f
+		ibRes.commitSend(f)
+	}
+
+	posted, err := IbvPostSendBatch(ibRes.Qp, b)
+	if err != nil {
+		ibRes.restoreSendSlots(saved)
+		for i := 0; i < posted; i++ {
+			ibRes.commitSend(flags[i])
+		}
+	}
+	if ibRes.capture != nil {
+		sges := b.sgeSlice()
+		for i := 0; i < posted; i++ {
+			data := unsafe.Slice((*byte)(unsafe.Pointer(b.bufs[i])), int(sges[i].length))
+			ibRes.captureSend(C.IBV_WR_SEND_WITH_IMM, data, b.imm[i], uint64(wrs[i].wr_id), flags[i])
+		}
+	}
+	return posted, err
+}
+
+func NewRecvBatch(size int) (*RecvBatch, error) {
+	if size < 1 {
+		return nil, errors.New(fmt.Sprintf("[NewRecvBatch] invalid size %v", size))
+	}
+	wrs := (*C.struct_ibv_recv_wr)(C.calloc(C.size_t(size), C.sizeof_struct_ibv_recv_wr))
+	if wrs == nil {
+		return nil, errors.New("[NewRecvBatch] failed to allocate memory")
+	}
+	sges := (*C.struct_ibv_sge)(C.calloc(C.size_t(size), C.sizeof_struct_ibv_sge))
+	if sges == nil {
+		C.free(unsafe.Pointer(wrs))
+		return nil, errors.New("[NewRecvBatch] failed to allocate memory")
+	}
+	return &RecvBatch{wrs: wrs, sges: sges, size: size}, nil
+}
+
+func (b *RecvBatch) wrSlice() []C.struct_ibv_recv_wr {
+	return unsafe.Slice(b.wrs, b.size)
+}
+
+func (b *RecvBatch) sgeSlice() []C.struct_ibv_sge {
+	return unsafe.Slice(b.sges, b.size)
+}
+
+// Len returns the number of WRs in the batch.
+func (b *RecvBatch) Len() int {
+	return b.num
+}
+
+// Reset empties the batch, the C memory is kept for the next round.
+func (b *RecvBatch) Reset() {
+	b.num = 0
+}
+
+// Free releases the C memory, the batch must not be used afterwards.
+func (b *RecvBatch) Free() {
+	if b.wrs != nil {
+		C.free(unsafe.Pointer(b.wrs))
+		b.wrs = nil
+	}
+	if b.sges != nil {
+		C.free(unsafe.Pointer(b.sges))
+		b.sges = nil
+	}
+	b.size = 0
+	b.num = 0
+}
+
+// AddRecv appends a receive of up to length bytes into buf, which must lie in the MR of lkey.
+func (b *RecvBatch) AddRecv(buf *C.char, length C.uint, lkey C.uint, wrID C.ulong) error {
+	if b.num == b.size {
+		return errors.New(fmt.Sprintf("[RecvBatch] batch full (%v WRs)", b.size))
+	}
+	wrs := b.wrSlice()
+	sges := b.sgeSlice()
+
+	sges[b.num] = C.struct_ibv_sge{
+		addr:   C.uint64_t(uintptr(unsafe.Pointer(buf))),
+		length: length,
+		lkey:   lkey,
+	}
+
+	wr := &wrs[b.num]
+	wr.wr_id = C.uint64_t(wrID)
+	wr.next = nil
+	wr.sg_list = &sges[b.num]
+	wr.num_sge = 1
+	if b.num > 0 {
+		wrs[b.num-1].next = wr
+	}
+
+	b.num++
+	return nil
+}
+
+// AddRecvRes appends a receive into IbBuf[offset:offset+length].
+func (b *RecvBatch) AddRecvRes(ibRes *IBRes, offset, length int, wrID uint64) error {
+	if offset < 0 || length < 0 || offset+length > int(ibRes.IbBufSize) {
+		return errors.New(fmt.Sprintf("[RecvBatch] range %v+%v outside of MR", offset, length))
+	}
+	buf := (*C.char)(unsafe.Add(unsafe.Pointer(ibRes.IbBuf), offset))
+	return b.AddRecv(buf, C.uint(length), ibRes.Mr.lkey, C.ulong(wrID))
+}
+
+// IbvPostSRQRecvBatch posts the whole chain with a single ibv_post_srq_recv.
+// It returns the number of WRs accepted; on failure WRs from that index on were not posted.
+func IbvPostSRQRecvBatch(srq *C.struct_ibv_srq, b *RecvBatch) (int, error) {
+	if b.num == 0 {
+		return 0, nil
+	}
+	b.wrSlice()[b.num-1].next = nil
+
+	var badIndex C.int
+	res, cerr := C.ibv_post_srq_recv_list_wrapper(srq, b.wrs, &badIndex)
+	if res != 0 {
+		posted := int(badIndex)
+		if posted < 0 {
+			posted = 0
+		}
+		err := newVerbsError("ibv_post_srq_recv", fmt.Sprintf("wr_id %#x", uint64(b.wrSlice()[posted].wr_id)), nil, int(res), cerr)
+		return posted, fmt.Errorf("[IbvPostSRQRecvBatch] WR %v of %v: %w", badIndex, b.num, err)
+	}
+	return b.num, nil
+}
@@ -0,0 +1,225 @@
+package RDMAGO
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// A capture is a pcapng file with one interface of link type LINKTYPE_USER0 (147). Every
+// packet is one synthesized record, all fields little endian:
+//
+//	offset  size  field
+//	0       1     version, CAPTURE_VERSION
+//	1       1     record type, CAPTURE_POST_SEND ... CAPTURE_HANDSHAKE_RX
+//	2       1     opcode, ibv_wr_opcode for posts, ibv_wc_opcode for completions
+//	3       1     status, ibv_wc_status of completions
+//	4       4     local QP number
+//	8       4     peer QP number, 0 while unknown
+//	12      4     immediate data
+//	16      4     length of the operation, the payload below may be shorter
+//	20      4     flags, CAPTURE_FLAG_*
+//	24      8     wr_id
+//	32      ...   first bytes of the payload, handshake lines in full
+//
+// Timestamps have nanosecond resolution. example/rdmago.lua dissects the records in
+// Wireshark.
+const (
+	CAPTURE_LINKTYPE    = 147 // LINKTYPE_USER0
+	CAPTURE_VERSION     = 1
+	CAPTURE_HEADER_SIZE = 32
+	// payload bytes kept per record unless set otherwise
+	DEFAULT_CAPTURE_SNAPLEN = 128
+
+	CAPTURE_POST_SEND    = 1
+	CAPTURE_POST_RECV    = 2
+	CAPTURE_COMPLETION   = 3
+	CAPTURE_HANDSHAKE_TX = 4
+	CAPTURE_HANDSHAKE_RX = 5
+
+	CAPTURE_FLAG_SIGNALED = 1 << 0
+	CAPTURE_FLAG_INLINE   = 1 << 1
+	CAPTURE_FLAG_IMM      = 1 << 2
+)
+
+const (
+	pcapngSectionHeader     = 0x0A0D0D0A
+	pcapngInterfaceDesc     = 0x00000001
+	pcapngEnhancedPacket    = 0x00000006
+	pcapngByteOrderMagic    = 0x1A2B3C4D
+	pcapngOptionEnd         = 0
+	pcapngOptionTsResol     = 9
+	pcapngTsResolNanosecond = 9
+)
+
+// Capture records operations of one or more IBRes to a pcapng stream. It is safe for
+// concurrent use; a nil *Capture records nothing.
+type Capture struct {
+	mu      sync.Mutex
+	w       *bufio.Writer
+	closer  io.Closer
+	snaplen int
+	err     error
+}
+
+type captureRecord struct {
+	typ       uint8
+	opcode    uint8
+	status    uint8
+	qpNum     uint32
+	peerQpNum uint32
+	imm       uint32
+	length    uint32
+	flags     uint32
+	wrID      uint64
+}
+
+// NewCapture writes the pcapng headers to w. snaplen bounds the payload bytes kept per
+// operation, DEFAULT_CAPTURE_SNAPLEN when 0.
+func NewCapture(w io.Writer, snaplen int) (*Capture, error) {
+	if snaplen < 0 {
+		return nil, errors.New(fmt.Sprintf("[NewCapture] invalid snaplen %v", snaplen))
+	}
+	if snaplen == 0 {
+		snaplen = DEFAULT_CAPTURE_SNAPLEN
+	}
+	c := &Capture{w: bufio.NewWriter(w), snaplen: snaplen}
+	if closer, ok := w.(io.Closer); ok {
+		c.closer = closer
+	}
+
+	shb := make([]byte, 28)
+	binary.LittleEndian.PutUint32(shb[0:], pcapngSectionHeader)
+	binary.LittleEndian.PutUint32(shb[4:], uint32(len(shb)))
+	binary.LittleEndian.PutUint32(shb[8:], pcapngByteOrderMagic)
+	binary.LittleEndian.PutUint16(shb[12:], 1) // version 1.0
+	binary.LittleEndian.PutUint64(shb[16:], ^uint64(0))
+	binary.LittleEndian.PutUint32(shb[24:], uint32(len(shb)))
+
+	idb := make([]byte, 32)
+	binary.LittleEndian.PutUint32(idb[0:], pcapngInterfaceDesc)
+	binary.LittleEndian.PutUint32(idb[4:], uint32(len(idb)))
+	binary.LittleEndian.PutUint16(idb[8:], CAPTURE_LINKTYPE)
+	// SnapLen 0, no limit: handshake records are kept in full, only payloads are cut
+	binary.LittleEndian.PutUint32(idb[12:], 0)
+	binary.LittleEndian.PutUint16(idb[16:], pcapngOptionTsResol)
+	binary.LittleEndian.PutUint16(idb[18:], 1)
+	idb[20] = pcapngTsResolNanosecond
+	binary.LittleEndian.PutUint16(idb[24:], pcapngOptionEnd)
+	binary.LittleEndian.PutUint32(idb[28:], uint32(len(idb)))
+
+	c.w.Write(shb)
+	c.w.Write(idb)
+	if err := c.w.Flush(); err != nil {
+		return nil, fmt.Errorf("[NewCapture] %w", err)
+	}
+	return c, nil
+}
+
+// CreateCapture records to a new file at path.
+func CreateCapture(path string, snaplen int) (*Capture, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("[CreateCapture] %w", err)
+	}
+	c, err := NewCapture(f, snaplen)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// record writes one record, payload is cut to the snaplen. The first write error stops
+// the capture and is returned by Close.
+func (c *Capture) record(rec captureRecord, payload []byte) {
+	if c == nil {
+		return
+	}
+	now := time.Now().UnixNano()
+	limit := c.snaplen
+	if rec.typ == CAPTURE_HANDSHAKE_TX || rec.typ == CAPTURE_HANDSHAKE_RX {
+		limit = len(payload)
+	}
+	if len(payload) > limit {
+		payload = payload[:limit]
+	}
+
+	data := make([]byte, CAPTURE_HEADER_SIZE, CAPTURE_HEADER_SIZE+len(payload))
+	data[0] = CAPTURE_VERSION
+	data[1] = rec.typ
+	data[2] = rec.opcode
+	data[3] = rec.status
+	binary.LittleEndian.PutUint32(data[4:], rec.qpNum)
+	binary.LittleEndian.PutUint32(data[8:], rec.peerQpNum)
+	binary.LittleEndian.PutUint32(data[12:], rec.imm)
+	binary.LittleEndian.PutUint32(data[16:], rec.length)
+	binary.LittleEndian.PutUint32(data[20:], rec.flags)
+	binary.LittleEndian.PutUint64(data[24:], rec.wrID)
+	data = append(data, payload...)
+
+	padded := (len(data) + 3) &^ 3
+	blockLen := 28 + padded + 4
+	block := make([]byte, blockLen)
+	binary.LittleEndian.PutUint32(block[0:], pcapngEnhancedPacket)
+	binary.LittleEndian.PutUint32(block[4:], uint32(blockLen))
+	binary.LittleEndian.PutUint32(block[8:], 0) // interface
+	binary.LittleEndian.PutUint32(block[12:], uint32(uint64(now)>>32))
+	binary.LittleEndian.PutUint32(block[16:], uint32(now))
+	binary.LittleEndian.PutUint32(block[20:], uint32(len(data)))
+	binary.LittleEndian.PutUint32(block[24:], uint32(CAPTURE_HEADER_SIZE)+rec.length)
+	copy(block[28:], data)
+	binary.LittleEndian.PutUint32(block[blockLen-4:], uint32(blockLen))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil || c.w == nil {
+		return
+	}
+	if _, err := c.w.Write(block); err != nil {
+		c.err = err
+	}
+}
+
+// Flush writes buffered records through to the underlying writer.
+func (c *Capture) Flush() error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return fmt.Errorf("[Capture] %w", c.err)
+	}
+	if c.w == nil {
+		return nil
+	}
+	if err := c.w.Flush(); err != nil {
+		c.err = err
+		return fmt.Errorf("[Capture] %w", err)
+	}
+	return nil
+}
+
+// Close flushes the capture and closes the underlying writer when it is an io.Closer.
+func (c *Capture) Close() error {
+	if c == nil {
+		return nil
+	}
+	err := c.Flush()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.w = nil
+	if c.closer != nil {
+		if closeErr := c.closer.Close(); err == nil && closeErr != nil {
+			err = fmt.Errorf("[Capture] %w", closeErr)
+		}
+		c.closer = nil
+	}
+	return err
+}
@@ -0,0 +1,119 @@
+package RDMAGO
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestCaptureBlocks(t *testing.T) {
+	const snaplen = 16
+	var out bytes.Buffer
+	c, err := NewCapture(&out, snaplen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := out.Bytes()
+	if len(b) != 28+32 {
+		t.Fatalf("headers are %v bytes, want %v", len(b), 28+32)
+	}
+	if typ := binary.LittleEndian.Uint32(b); typ != pcapngSectionHeader {
+		t.Errorf("first block type %#x, want %#x", typ, pcapngSectionHeader)
+	}
+	if magic := binary.LittleEndian.Uint32(b[8:]); magic != pcapngByteOrderMagic {
+		t.Errorf("byte order magic %#x, want %#x", magic, pcapngByteOrderMagic)
+	}
+	idb := b[28:]
+	if typ := binary.LittleEndian.Uint32(idb); typ != pcapngInterfaceDesc {
+		t.Errorf("second block type %#x, want %#x", typ, pcapngInterfaceDesc)
+	}
+	if linkType := binary.LittleEndian.Uint16(idb[8:]); linkType != CAPTURE_LINKTYPE {
+		t.Errorf("link type %v, want %v", linkType, CAPTURE_LINKTYPE)
+	}
+	// handshake records exceed the snaplen, the interface must not advertise one
+	if max := binary.LittleEndian.Uint32(idb[12:]); max != 0 {
+		t.Errorf("interface snaplen %v, want 0", max)
+	}
+
+	tests := []struct {
+		name         string
+		typ          uint8
+		payload      int
+		wantCaptured int
+		wantBlockLen int
+	}{
+		{"padded", CAPTURE_POST_SEND, 3, CAPTURE_HEADER_SIZE + 3, 28 + 36 + 4},
+		{"aligned", CAPTURE_POST_SEND, 8, CAPTURE_HEADER_SIZE + 8, 28 + 40 + 4},
+		{"cut to the snaplen", CAPTURE_POST_SEND, 20, CAPTURE_HEADER_SIZE + snaplen, 28 + 48 + 4},
+		{"handshake in full", CAPTURE_HANDSHAKE_TX, 20, CAPTURE_HEADER_SIZE + 20, 28 + 52 + 4},
+	}
+	for _, tt := range tests {
+		out.Reset()
+		payload := bytes.Repeat([]byte{0xab}, tt.payload)
+		rec := captureRecord{typ: tt.typ, qpNum: 7, peerQpNum: 9, imm: 0x1234, length: uint32(tt.payload), wrID: 42}
+		c.record(rec, payload)
+		if err := c.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		block := out.Bytes()
+		if len(block) != tt.wantBlockLen {
+			t.Errorf("%v: block of %v bytes, want %v", tt.name, len(block), tt.wantBlockLen)
+			continue
+		}
+		if typ := binary.LittleEndian.Uint32(block); typ != pcapngEnhancedPacket {
+			t.Errorf("%v: block type %#x, want %#x", tt.name, typ, pcapngEnhancedPacket)
+		}
+		head := binary.LittleEndian.Uint32(block[4:])
+		tail := binary.LittleEndian.Uint32(block[len(block)-4:])
+		if head != uint32(tt.wantBlockLen) || tail != head {
+			t.Errorf("%v: block lengths %v and %v, want %v", tt.name, head, tail, tt.wantBlockLen)
+		}
+		if captured := binary.LittleEndian.Uint32(block[20:]); captured != uint32(tt.wantCaptured) {
+			t.Errorf("%v: captured length %v, want %v", tt.name, captured, tt.wantCaptured)
+		}
+		if orig := binary.LittleEndian.Uint32(block[24:]); orig != uint32(CAPTURE_HEADER_SIZE+tt.payload) {
+			t.Errorf("%v: original length %v, want %v", tt.name, orig, CAPTURE_HEADER_SIZE+tt.payload)
+		}
+
+		data := block[28:]
+		if data[0] != CAPTURE_VERSION || data[1] != tt.typ {
+			t.Errorf("%v: record version %v type %v, want %v %v", tt.name, data[0], data[1], CAPTURE_VERSION, tt.typ)
+		}
+		if qpNum := binary.LittleEndian.Uint32(data[4:]); qpNum != 7 {
+			t.Errorf("%v: qp_num %v, want 7", tt.name, qpNum)
+		}
+		if wrID := binary.LittleEndian.Uint64(data[24:]); wrID != 42 {
+			t.Errorf("%v: wr_id %v, want 42", tt.name, wrID)
+		}
+		for i := tt.wantCaptured; i < tt.wantBlockLen-28-4; i++ {
+			if data[i] != 0 {
+				t.Errorf("%v: padding byte %v is %#x", tt.name, i, data[i])
+				break
+			}
+		}
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCaptureWCRecord(t *testing.T) {
+	tests := []struct {
+		name      string
+		wcFlags   uint32
+		wantImm   uint32
+		wantFlags uint32
+	}{
+		{"with imm", 1 << 1, 0x1234, CAPTURE_FLAG_IMM}, // IBV_WC_WITH_IMM
+		{"without imm", 0, 0, 0},
+	}
+	for _, tt := range tests {
+		rec := WCRecord{WrID: 42, Status: 5, Opcode: 128, ByteLen: 64, ImmData: 0x1234, QPNum: 7, WCFlags: tt.wcFlags}
+		got := rec.captureRecord()
+		want := captureRecord{typ: CAPTURE_COMPLETION, opcode: 128, status: 5, qpNum: 7, imm: tt.wantImm,
+			length: 64, flags: tt.wantFlags, wrID: 42}
+		if got != want {
+			t.Errorf("%v: %+v, want %+v", tt.name, got, want)
+		}
+	}
+}
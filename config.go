@@ -3,6 +3,8 @@ package RDMAGO
 import (
 	"encoding/json"
 	"os"
+
+	"go.opentelemetry.io/otel/trace"
 )
 
 type Config struct {
@@ -13,6 +15,75 @@ type Config struct {
 	MrSize     int    `json:"mr_size"`
 	DeviceName string `json:"device_name"`
 	FileName   string `json:"file_name"`
+
+	// device, port and GID selection, see DeviceSelector; empty device_name picks any device
+	Netdev      string `json:"netdev"`
+	LocalIP     string `json:"local_ip"`
+	IbPort      int    `json:"ib_port"`
+	GidIndex    *int   `json:"gid_index,omitempty"`
+	RoceVersion int    `json:"roce_version"`
+	GidFamily   string `json:"gid_family"`
+	PortWaitMs  int    `json:"port_wait_ms"`
+
+	// address vector and QoS of the connection, see AddressOptions
+	SL            uint8  `json:"sl"`
+	SrcPathBits   uint8  `json:"src_path_bits"`
+	RouterLID     uint16 `json:"router_lid"`
+	HopLimit      uint8  `json:"hop_limit"`
+	TrafficClass  uint8  `json:"traffic_class"`
+	DSCP          uint8  `json:"dscp"`
+	FlowLabel     uint32 `json:"flow_label"`
+	AutoFlowLabel bool   `json:"auto_flow_label"`
+	GlobalRoute   bool   `json:"global_route"`
+
+	// UDEndpoint: qkey of the QP, DEFAULT_QKEY when 0, and the address handles it keeps
+	Qkey        uint32 `json:"qkey"`
+	AHCacheSize int    `json:"ah_cache_size"`
+	// UCEndpoint: slots of mr_size bytes in the ring RDMA writes land in, equal on both sides
+	UCSlots int `json:"uc_slots"`
+
+	// one connection per class with its own QP and QoS, see NewQoSEndpoint
+	QoSClasses []QoSClass `json:"qos_classes,omitempty"`
+	// class of an Endpoint created by NewQoSEndpoint
+	qosClass string
+
+	MaxInlineData  int `json:"max_inline_data"`
+	SignalInterval int `json:"signal_interval"`
+
+	SRQMaxWR   int `json:"srq_max_wr"`
+	SRQDepth   int `json:"srq_depth"`
+	SRQBuffers int `json:"srq_buffers"`
+	SRQLimit   int `json:"srq_limit"`
+
+	ReconnectRetries      int `json:"reconnect_retries"`
+	ReconnectBackoffMs    int `json:"reconnect_backoff_ms"`
+	ReconnectMaxBackoffMs int `json:"reconnect_max_backoff_ms"`
+
+	SessionWindow int `json:"session_window"`
+
+	HeartbeatIntervalMs int `json:"heartbeat_interval_ms"`
+	HeartbeatMisses     int `json:"heartbeat_misses"`
+
+	CloseTimeoutMs int `json:"close_timeout_ms"`
+
+	// record where IB resources are created and report the ones left open, see TrackResources
+	TrackResources bool `json:"track_resources"`
+
+	// fraction of messages traced when the caller's context carries no sampled span, 0 traces
+	// only those
+	TraceSampleRate float64 `json:"trace_sample_rate"`
+
+	// pcapng file recording every post, completion and handshake, see Capture
+	CaptureFile    string `json:"capture_file"`
+	CaptureSnaplen int    `json:"capture_snaplen"`
+
+	// Logger receives the logs of endpoints created from the config, DefaultLogger when nil
+	Logger Logger `json:"-"`
+	// Metrics receives the metrics of endpoints created from the config, DefaultMetrics when nil
+	Metrics *MetricsRegistry `json:"-"`
+	// TracerProvider creates the spans of endpoints created from the config, the global
+	// OpenTelemetry provider when nil
+	TracerProvider trace.TracerProvider `json:"-"`
 }
 
 // LoadConfig 加载配置文件
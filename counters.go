@@ -0,0 +1,377 @@
+package RDMAGO
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// SYSFS_INFINIBAND holds a directory per device, its ports under ports/<n>.
+var SYSFS_INFINIBAND = "/sys/class/infiniband"
+
+// PortCounters is a snapshot of the counters the kernel keeps for a port: the standard
+// IB port counters under counters/ and the driver specific ones under hw_counters/, e.g.
+// retry_exceeded_err or rcvd_seq_err of rxe.
+type PortCounters struct {
+	Device     string
+	Port       int
+	Time       time.Time
+	Counters   map[string]uint64
+	HwCounters map[string]uint64
+}
+
+// ReadPortCounters reads the counters of port of device from sysfs. Either directory may
+// be missing, the driver decides what it exposes; only when both are it is an error.
+func ReadPortCounters(device string, port int) (*PortCounters, error) {
+	dir := filepath.Join(SYSFS_INFINIBAND, device, "ports", strconv.Itoa(port))
+	c := &PortCounters{Device: device, Port: port, Time: time.Now()}
+	var err1, err2 error
+	c.Counters, err1 = readCounterDir(filepath.Join(dir, "counters"))
+	c.HwCounters, err2 = readCounterDir(filepath.Join(dir, "hw_counters"))
+	if err1 != nil && err2 != nil {
+		return nil, fmt.Errorf("[ReadPortCounters] %v port %v: %w", device, port, err1)
+	}
+	return c, nil
+}
+
+func readCounterDir(dir string) (map[string]uint64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	counters := make(map[string]uint64, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			// some counters are write-only or need privileges, e.g. lifespan
+			continue
+		}
+		v, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+		if err != nil {
+			continue
+		}
+		counters[entry.Name()] = v
+	}
+	return counters, nil
+}
+
+// PortCounters reads the counters of the port the QP of ibRes uses.
+func (ibRes *IBRes) PortCounters() (*PortCounters, error) {
+	if ibRes.deviceName == "" {
+		return nil, errors.New("[PortCounters] no device opened")
+	}
+	return ReadPortCounters(ibRes.deviceName, ibRes.Port)
+}
+
+// PortCounterDelta is the change between two snapshots of the same port.
+type PortCounterDelta struct {
+	Elapsed    time.Duration
+	Counters   map[string]uint64
+	HwCounters map[string]uint64
+}
+
+// Sub returns what the counters advanced since prev. A counter that went backwards was
+// reset, by the driver or by wrapping, and contributes its current value.
+func (c *PortCounters) Sub(prev *PortCounters) PortCounterDelta {
+	return PortCounterDelta{
+		Elapsed:    c.Time.Sub(prev.Time),
+		Counters:   subCounters(c.Counters, prev.Counters),
+		HwCounters: subCounters(c.HwCounters, prev.HwCounters),
+	}
+}
+
+func subCounters(cur, prev map[string]uint64) map[string]uint64 {
+	delta := make(map[string]uint64, len(cur))
+	for name, v := range cur {
+		if old, ok := prev[name]; ok && v >= old {
+			v -= old
+		}
+		delta[name] = v
+	}
+	return delta
+}
+
+// collectPortCounters copies the counters of a port into r, it runs on every scrape.
+func collectPortCounters(r *MetricsRegistry, device string, port int) error {
+	c, err := ReadPortCounters(device, port)
+	if err != nil {
+		return err
+	}
+	portLabel := strconv.Itoa(port)
+	counters := r.family("rdma_port_counter", "Port counters of the device, from sysfs counters/.",
+		metricCounter, nil, "device", "port", "counter")
+	for name, v := range c.Counters {
+		counters.with(device, portLabel, name).counter.set(v)
+	}
+	hwCounters := r.family("rdma_port_hw_counter", "Driver counters of the port, from sysfs hw_counters/.",
+		metricCounter, nil, "device", "port", "counter")
+	for name, v := range c.HwCounters {
+		hwCounters.with(device, portLabel, name).counter.set(v)
+	}
+	return nil
+}
+
+// RDMA netlink, see include/uapi/rdma/rdma_netlink.h. Messages are in host byte order,
+// little endian on the hosts we run on.
+const (
+	NETLINK_RDMA  = 20
+	RDMA_NL_NLDEV = 5
+
+	RDMA_NLDEV_CMD_GET        = 1
+	RDMA_NLDEV_CMD_RES_QP_GET = 10
+
+	RDMA_NLDEV_ATTR_DEV_INDEX     = 1
+	RDMA_NLDEV_ATTR_DEV_NAME      = 2
+	RDMA_NLDEV_ATTR_PORT_INDEX    = 3
+	RDMA_NLDEV_ATTR_RES_QP        = 19
+	RDMA_NLDEV_ATTR_RES_QP_ENTRY  = 20
+	RDMA_NLDEV_ATTR_RES_LQPN      = 21
+	RDMA_NLDEV_ATTR_RES_RQPN      = 22
+	RDMA_NLDEV_ATTR_RES_RQ_PSN    = 23
+	RDMA_NLDEV_ATTR_RES_SQ_PSN    = 24
+	RDMA_NLDEV_ATTR_RES_PATH_MIG  = 25
+	RDMA_NLDEV_ATTR_RES_TYPE      = 26
+	RDMA_NLDEV_ATTR_RES_STATE     = 27
+	RDMA_NLDEV_ATTR_RES_PID       = 28
+	RDMA_NLDEV_ATTR_RES_KERN_NAME = 29
+
+	nlaTypeMask = 0x3FFF // without NLA_F_NESTED and NLA_F_NET_BYTEORDER
+)
+
+// QPResource is what the kernel reports about a QP through RDMA netlink, for every QP of
+// the device, including those of other processes.
+type QPResource struct {
+	Device     string
+	Port       int // 0 before the QP was bound to a port
+	QpNum      uint32
+	PeerQpNum  uint32 // connected QPs only
+	RQPsn      uint32
+	SQPsn      uint32
+	Type       string
+	State      string
+	PID        uint32 // 0 for kernel QPs, see KernelName
+	KernelName string
+}
+
+var qpTypeNames = map[uint8]string{0: "SMI", 1: "GSI", 2: "RC", 3: "UC", 4: "UD", 5: "RAW_IPV6",
+	6: "RAW_ETHERTYPE", 8: "RAW_PACKET", 9: "XRC_INI", 10: "XRC_TGT", 0xFF: "DRIVER"}
+
+var qpStateNames = [...]string{"RESET", "INIT", "RTR", "RTS", "SQD", "SQE", "ERR"}
+
+// QPResources lists the QPs of device through RDMA netlink.
+func QPResources(device string) ([]QPResource, error) {
+	index, err := nldevIndex(device)
+	if err != nil {
+		return nil, fmt.Errorf("[QPResources] %w", err)
+	}
+	attr := nlAttr(RDMA_NLDEV_ATTR_DEV_INDEX, binary.LittleEndian.AppendUint32(nil, index))
+	msgs, err := nldevDump(RDMA_NLDEV_CMD_RES_QP_GET, attr)
+	if err != nil {
+		return nil, fmt.Errorf("[QPResources] %v: %w", device, err)
+	}
+
+	var qps []QPResource
+	for _, msg := range msgs {
+		for _, table := range parseAttrs(msg) {
+			if table.typ != RDMA_NLDEV_ATTR_RES_QP {
+				continue
+			}
+			for _, entry := range parseAttrs(table.data) {
+				if entry.typ == RDMA_NLDEV_ATTR_RES_QP_ENTRY {
+					qps = append(qps, parseQPEntry(device, entry.data))
+				}
+			}
+		}
+	}
+	return qps, nil
+}
+
+// QPResource returns what the kernel reports about the QP of ibRes.
+func (ibRes *IBRes) QPResource() (*QPResource, error) {
+	if ibRes.Qp == nil {
+		return nil, errors.New("[QPResource] no QP created")
+	}
+	qps, err := QPResources(ibRes.deviceName)
+	if err != nil {
+		return nil, err
+	}
+	for i := range qps {
+		if qps[i].QpNum == uint32(ibRes.Qp.qp_num) {
+			return &qps[i], nil
+		}
+	}
+	return nil, errors.New(fmt.Sprintf("[QPResource] QP %v not reported by the kernel", ibRes.Qp.qp_num))
+}
+
+func parseQPEntry(device string, data []byte) QPResource {
+	qp := QPResource{Device: device}
+	for _, a := range parseAttrs(data) {
+		switch a.typ {
+		case RDMA_NLDEV_ATTR_PORT_INDEX:
+			qp.Port = int(a.uint32())
+		case RDMA_NLDEV_ATTR_RES_LQPN:
+			qp.QpNum = a.uint32()
+		case RDMA_NLDEV_ATTR_RES_RQPN:
+			qp.PeerQpNum = a.uint32()
+		case RDMA_NLDEV_ATTR_RES_RQ_PSN:
+			qp.RQPsn = a.uint32()
+		case RDMA_NLDEV_ATTR_RES_SQ_PSN:
+			qp.SQPsn = a.uint32()
+		case RDMA_NLDEV_ATTR_RES_TYPE:
+			if name, ok := qpTypeNames[a.uint8()]; ok {
+				qp.Type = name
+			} else {
+				qp.Type = strconv.Itoa(int(a.uint8()))
+			}
+		case RDMA_NLDEV_ATTR_RES_STATE:
+			if s := int(a.uint8()); s < len(qpStateNames) {
+				qp.State = qpStateNames[s]
+			} else {
+				qp.State = strconv.Itoa(s)
+			}
+		case RDMA_NLDEV_ATTR_RES_PID:
+			qp.PID = a.uint32()
+		case RDMA_NLDEV_ATTR_RES_KERN_NAME:
+			qp.KernelName = a.string()
+		}
+	}
+	return qp
+}
+
+// nldevIndex returns the kernel index of device, which RDMA netlink requests take.
+func nldevIndex(device string) (uint32, error) {
+	msgs, err := nldevDump(RDMA_NLDEV_CMD_GET, nil)
+	if err != nil {
+		return 0, err
+	}
+	for _, msg := range msgs {
+		var index uint32
+		var name string
+		for _, a := range parseAttrs(msg) {
+			switch a.typ {
+			case RDMA_NLDEV_ATTR_DEV_INDEX:
+				index = a.uint32()
+			case RDMA_NLDEV_ATTR_DEV_NAME:
+				name = a.string()
+			}
+		}
+		if name == device {
+			return index, nil
+		}
+	}
+	return 0, errors.New("device " + device + " not found by netlink")
+}
+
+// nldevDump sends a dump request of an nldev command and returns the attributes of
+// every reply.
+func nldevDump(cmd uint16, attrs []byte) ([][]byte, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, NETLINK_RDMA)
+	if err != nil {
+		return nil, fmt.Errorf("netlink socket: %w", err)
+	}
+	defer syscall.Close(fd)
+	if err = syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return nil, fmt.Errorf("netlink bind: %w", err)
+	}
+
+	const seq = 1
+	req := make([]byte, syscall.NLMSG_HDRLEN, syscall.NLMSG_HDRLEN+len(attrs))
+	req = append(req, attrs...)
+	binary.LittleEndian.PutUint32(req[0:], uint32(len(req)))
+	binary.LittleEndian.PutUint16(req[4:], RDMA_NL_NLDEV<<10|cmd)
+	binary.LittleEndian.PutUint16(req[6:], syscall.NLM_F_REQUEST|syscall.NLM_F_DUMP)
+	binary.LittleEndian.PutUint32(req[8:], seq)
+	if err = syscall.Sendto(fd, req, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return nil, fmt.Errorf("netlink send: %w", err)
+	}
+
+	var replies [][]byte
+	buf := make([]byte, 1<<16)
+	for {
+		n, _, err := syscall.Recvfrom(fd, buf, 0)
+		if err != nil {
+			return nil, fmt.Errorf("netlink receive: %w", err)
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return nil, fmt.Errorf("netlink receive: %w", err)
+		}
+		for _, m := range msgs {
+			if m.Header.Seq != seq {
+				continue
+			}
+			switch m.Header.Type {
+			case syscall.NLMSG_DONE:
+				return replies, nil
+			case syscall.NLMSG_ERROR:
+				if len(m.Data) >= 4 {
+					if errno := -int32(binary.LittleEndian.Uint32(m.Data)); errno != 0 {
+						return nil, fmt.Errorf("netlink: %w", syscall.Errno(errno))
+					}
+				}
+				return replies, nil
+			}
+			replies = append(replies, append([]byte(nil), m.Data...))
+		}
+	}
+}
+
+type nlattr struct {
+	typ  uint16
+	data []byte
+}
+
+func (a nlattr) uint8() uint8 {
+	if len(a.data) < 1 {
+		return 0
+	}
+	return a.data[0]
+}
+
+func (a nlattr) uint32() uint32 {
+	if len(a.data) < 4 {
+		return 0
+	}
+	return binary.LittleEndian.Uint32(a.data)
+}
+
+func (a nlattr) string() string {
+	return strings.TrimRight(string(a.data), "\x00")
+}
+
+func nlAttr(typ uint16, data []byte) []byte {
+	b := make([]byte, syscall.NLA_HDRLEN, nlaAlign(syscall.NLA_HDRLEN+len(data)))
+	binary.LittleEndian.PutUint16(b[0:], uint16(syscall.NLA_HDRLEN+len(data)))
+	binary.LittleEndian.PutUint16(b[2:], typ)
+	b = append(b, data...)
+	return b[:cap(b)]
+}
+
+func parseAttrs(b []byte) []nlattr {
+	var attrs []nlattr
+	for len(b) >= syscall.NLA_HDRLEN {
+		l := int(binary.LittleEndian.Uint16(b))
+		if l < syscall.NLA_HDRLEN || l > len(b) {
+			break
+		}
+		attrs = append(attrs, nlattr{typ: binary.LittleEndian.Uint16(b[2:]) & nlaTypeMask, data: b[syscall.NLA_HDRLEN:l]})
+		if nlaAlign(l) >= len(b) {
+			break
+		}
+		b = b[nlaAlign(l):]
+	}
+	return attrs
+}
+
+func nlaAlign(l int) int {
+	return (l + syscall.NLA_ALIGNTO - 1) &^ (syscall.NLA_ALIGNTO - 1)
+}
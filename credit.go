@@ -0,0 +1,263 @@
+package RDMAGO
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// every Endpoint frame starts with the cumulative credit grant of its sender and a
+	// flags byte, see ENDPOINT_FLAG_TRACE
+	ENDPOINT_HEADER_SIZE = 5
+	// credits data sends leave to control messages, so credit updates always get through
+	ENDPOINT_CREDIT_RESERVE = 2
+	// tail of IbBuf used for control frames when max_inline_data cannot hold them
+	ENDPOINT_CONTROL_SLOT = 8
+)
+
+// CreditStats describes the flow control of an Endpoint. Credits are receive buffers the
+// peer granted; a sender never has more messages outstanding than it holds credits.
+type CreditStats struct {
+	Stalls    uint64        // sends that had to wait for credits
+	StallTime time.Duration // time sends spent waiting for credits
+	Updates   uint64        // explicit credit updates sent because no data carried them
+	Available int           // credits the sender can use now
+	Granted   uint32        // receives granted to the peer since the connection came up
+}
+
+// MaxMessageSize is the largest payload Send accepts.
+func (ep *Endpoint) MaxMessageSize() int {
+	return int(ep.res.IbBufSize) - ENDPOINT_HEADER_SIZE - ENDPOINT_TRACE_SIZE - ENDPOINT_CONTROL_SLOT
+}
+
+// headerSize is the length of the frame header, which carries sc when it is valid.
+func headerSize(sc trace.SpanContext) int {
+	if sc.IsValid() {
+		return ENDPOINT_HEADER_SIZE + ENDPOINT_TRACE_SIZE
+	}
+	return ENDPOINT_HEADER_SIZE
+}
+
+// putHeader writes the frame header to b, which holds headerSize(sc) bytes.
+func putHeader(b []byte, grant uint32, sc trace.SpanContext) {
+	binary.LittleEndian.PutUint32(b, grant)
+	b[4] = 0
+	if sc.IsValid() {
+		b[4] = ENDPOINT_FLAG_TRACE
+		encodeTraceContext(b[ENDPOINT_HEADER_SIZE:], sc)
+	}
+}
+
+func (ep *Endpoint) CreditStats() CreditStats {
+	ep.postMu.Lock()
+	defer ep.postMu.Unlock()
+	stats := ep.creditStats
+	stats.Available = int(int32(ep.peerGrant - ep.sent))
+	stats.Granted = atomic.LoadUint32(&ep.localGrant)
+	return stats
+}
+
+// resetCredits starts the receive side accounting of a new connection and returns the
+// initial grant, the receives currently posted on the SRQ less the messages still
+// waiting for Recv.
+func (ep *Endpoint) resetCredits() uint32 {
+	stats := ep.srq.Stats()
+	ep.completedBase = stats.Completed
+	grant := clampGrant(int64(stats.Outstanding) - int64(ep.inboxLen()))
+	atomic.StoreUint32(&ep.localGrant, grant)
+	atomic.StoreUint32(&ep.advertised, grant)
+	return grant
+}
+
+// startCredits starts the send side accounting with the initial grant of the peer.
+func (ep *Endpoint) startCredits(peerGrant uint32) {
+	ep.postMu.Lock()
+	ep.peerGrant = peerGrant
+	ep.sent = 0
+	ep.postMu.Unlock()
+	ep.signalCredits()
+}
+
+func (ep *Endpoint) signalCredits() {
+	select {
+	case ep.creditSignal <- struct{}{}:
+	default:
+	}
+}
+
+// onPeerGrant takes the grant carried by a received frame, grants only grow.
+func (ep *Endpoint) onPeerGrant(grant uint32) {
+	ep.postMu.Lock()
+	advanced := int32(grant-ep.peerGrant) > 0
+	if advanced {
+		ep.peerGrant = grant
+	}
+	ep.postMu.Unlock()
+	if advanced {
+		ep.signalCredits()
+	}
+}
+
+// updateGrant recomputes the receives granted: everything consumed since the handshake
+// plus what is posted now, less the messages waiting for Recv. A receive is thus granted
+// again only once Recv took its message, which bounds the inbox by the SRQ depth.
+// Only the poller calls it, Recv asks for it through grantDirty.
+func (ep *Endpoint) updateGrant() {
+	stats := ep.srq.Stats()
+	grant := int64(stats.Completed-ep.completedBase) + int64(stats.Outstanding) - int64(ep.inboxLen())
+	atomic.StoreUint32(&ep.localGrant, clampGrant(grant))
+	ep.metrics.Load().srqOutstanding.Set(int64(stats.Outstanding))
+}
+
+func clampGrant(grant int64) uint32 {
+	if grant < 0 {
+		return 0
+	}
+	return uint32(grant)
+}
+
+// header returns the grant to piggyback on the next frame.
+func (ep *Endpoint) header() uint32 {
+	grant := atomic.LoadUint32(&ep.localGrant)
+	atomic.StoreUint32(&ep.advertised, grant)
+	return grant
+}
+
+// takeCredit consumes a credit, postMu must be held.
+func (ep *Endpoint) takeCredit(control bool) bool {
+	reserve := int32(ENDPOINT_CREDIT_RESERVE)
+	if control {
+		reserve = 0
+	}
+	if int32(ep.peerGrant-ep.sent) <= reserve {
+		return false
+	}
+	ep.sent++
+	return true
+}
+
+// acquireCredit waits until the endpoint is connected and a data credit is free.
+// It returns with postMu held.
+func (ep *Endpoint) acquireCredit(ctx context.Context) error {
+	var stalled time.Time
+	for {
+		if err := ep.waitConnected(ctx); err != nil {
+			if !stalled.IsZero() {
+				ep.endStall(time.Since(stalled))
+			}
+			return err
+		}
+		ep.postMu.Lock()
+		if ep.takeCredit(false) {
+			if !stalled.IsZero() {
+				stall := time.Since(stalled)
+				ep.creditStats.StallTime += stall
+				ep.metrics.Load().creditStalls.Observe(stall.Seconds())
+			}
+			return nil
+		}
+		if stalled.IsZero() {
+			stalled = time.Now()
+			ep.creditStats.Stalls++
+		}
+		ep.postMu.Unlock()
+
+		// ctx and stop are reported by waitConnected
+		ep.mu.Lock()
+		changed := ep.stateChanged
+		ep.mu.Unlock()
+		select {
+		case <-ep.creditSignal:
+		case <-changed:
+		case <-ctx.Done():
+		case <-ep.stop:
+		}
+	}
+}
+
+func (ep *Endpoint) endStall(stall time.Duration) {
+	ep.postMu.Lock()
+	ep.creditStats.StallTime += stall
+	ep.postMu.Unlock()
+	ep.metrics.Load().creditStalls.Observe(stall.Seconds())
+}
+
+// postDataLocked posts header and data with a credit already taken, postMu must be held.
+// The header carries sc when it is valid. Frames up to max_inline_data go inline, others
+// must already be in IbBuf after the header; those are signaled with wrID.
+func (ep *Endpoint) postDataLocked(data []byte, immData uint32, wrID uint64, sc trace.SpanContext) (bool, error) {
+	grant := ep.header()
+	hdrLen := headerSize(sc)
+	frameLen := hdrLen + len(data)
+
+	var err error
+	inline := frameLen <= int(ep.res.MaxInlineData)
+	if inline {
+		frame := make([]byte, frameLen)
+		putHeader(frame, grant, sc)
+		copy(frame[hdrLen:], data)
+		err = ep.res.PostInline(frame, immData, ep.newWrID()|endpointWrNoWait, false)
+	} else {
+		putHeader(unsafe.Slice((*byte)(unsafe.Pointer(ep.res.IbBuf)), hdrLen), grant, sc)
+		atomic.StoreUint64(&ep.sendWrID, wrID)
+		err = ep.res.PostSend(frameLen, immData, wrID, true)
+	}
+	if err != nil {
+		ep.sent--
+		if !inline {
+			atomic.StoreUint64(&ep.sendWrID, 0)
+		}
+		return inline, fmt.Errorf("[Endpoint] %w", err)
+	}
+	return inline, nil
+}
+
+// postControlLocked sends a control message, postMu must be held. Control messages may
+// use the reserved credits.
+func (ep *Endpoint) postControlLocked(imm uint32, wrID uint64, signaled bool) error {
+	if !ep.takeCredit(true) {
+		return errors.New("[Endpoint] no credit for control message")
+	}
+	grant := ep.header()
+
+	var err error
+	if ENDPOINT_HEADER_SIZE <= int(ep.res.MaxInlineData) {
+		var frame [ENDPOINT_HEADER_SIZE]byte
+		putHeader(frame[:], grant, trace.SpanContext{})
+		err = ep.res.PostInline(frame[:], imm, wrID, signaled)
+	} else {
+		offset := int(ep.res.IbBufSize) - ENDPOINT_CONTROL_SLOT
+		slot := unsafe.Slice((*byte)(unsafe.Add(unsafe.Pointer(ep.res.IbBuf), offset)), ENDPOINT_HEADER_SIZE)
+		putHeader(slot, grant, trace.SpanContext{})
+		err = ep.res.PostSendAt(offset, ENDPOINT_HEADER_SIZE, imm, wrID, signaled)
+	}
+	if err != nil {
+		ep.sent--
+		return fmt.Errorf("[Endpoint] %w", err)
+	}
+	return nil
+}
+
+// maybeSendCredits sends an explicit credit update when the grant grew by creditUpdate
+// since the peer last heard of it, i.e. no outgoing message carried it.
+func (ep *Endpoint) maybeSendCredits() {
+	if atomic.LoadUint32(&ep.localGrant)-atomic.LoadUint32(&ep.advertised) < ep.creditUpdate {
+		return
+	}
+	ep.postMu.Lock()
+	err := ep.postControlLocked(ENDPOINT_CREDIT_IMM, ep.newWrID()|endpointWrNoWait, false)
+	if err == nil {
+		ep.creditStats.Updates++
+	}
+	ep.postMu.Unlock()
+	if err != nil {
+		ep.log.Debug("[Endpoint] credit update not sent", "error", err)
+	}
+}
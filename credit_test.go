@@ -0,0 +1,77 @@
+package RDMAGO
+
+import "testing"
+
+func TestClampGrant(t *testing.T) {
+	tests := []struct {
+		grant int64
+		want  uint32
+	}{
+		{-5, 0},
+		{0, 0},
+		{7, 7},
+		{1<<32 - 1, 1<<32 - 1},
+	}
+	for _, tt := range tests {
+		if got := clampGrant(tt.grant); got != tt.want {
+			t.Errorf("clampGrant(%v) = %v, want %v", tt.grant, got, tt.want)
+		}
+	}
+}
+
+func TestTakeCredit(t *testing.T) {
+	tests := []struct {
+		name            string
+		peerGrant, sent uint32
+		control         bool
+		want            bool
+	}{
+		{"data with credits", 10, 0, false, true},
+		{"data into the reserve", 10, 8, false, false},
+		{"control into the reserve", 10, 8, true, true},
+		{"control without credits", 10, 10, true, false},
+		{"data across the wrap", 1, 1<<32 - 2, false, true},
+		{"data at the reserve across the wrap", 0, 1<<32 - 2, false, false},
+	}
+	for _, tt := range tests {
+		ep := &Endpoint{peerGrant: tt.peerGrant, sent: tt.sent}
+		got := ep.takeCredit(tt.control)
+		if got != tt.want {
+			t.Errorf("%v: takeCredit(%v) = %v, want %v", tt.name, tt.control, got, tt.want)
+		}
+		wantSent := tt.sent
+		if tt.want {
+			wantSent++
+		}
+		if ep.sent != wantSent {
+			t.Errorf("%v: sent = %v, want %v", tt.name, ep.sent, wantSent)
+		}
+	}
+}
+
+func TestOnPeerGrant(t *testing.T) {
+	tests := []struct {
+		name         string
+		peerGrant    uint32
+		grant        uint32
+		want         uint32
+		wantSignaled bool
+	}{
+		{"grows", 10, 12, 12, true},
+		{"unchanged", 10, 10, 10, false},
+		{"stale", 10, 8, 10, false},
+		{"grows across the wrap", 1<<32 - 4, 3, 3, true},
+		{"stale across the wrap", 3, 1<<32 - 4, 3, false},
+	}
+	for _, tt := range tests {
+		ep := &Endpoint{peerGrant: tt.peerGrant, creditSignal: make(chan struct{}, 1)}
+		ep.onPeerGrant(tt.grant)
+		if ep.peerGrant != tt.want {
+			t.Errorf("%v: peerGrant = %v, want %v", tt.name, ep.peerGrant, tt.want)
+		}
+		signaled := len(ep.creditSignal) == 1
+		if signaled != tt.wantSignaled {
+			t.Errorf("%v: signaled = %v, want %v", tt.name, signaled, tt.wantSignaled)
+		}
+	}
+}
@@ -0,0 +1,340 @@
+package RDMAGO
+
+/*
+#cgo CFLAGS: -I/usr/include/infiniband
+#cgo LDFLAGS: -libverbs -L. -lwrapper
+
+#include "wrapper.h"
+
+#include <stdlib.h>
+#include <infiniband/verbs.h>
+*/
+import "C"
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"unsafe"
+)
+
+type GIDType int
+
+const (
+	GID_TYPE_IB GIDType = iota
+	GID_TYPE_ROCE_V1
+	GID_TYPE_ROCE_V2
+)
+
+func (t GIDType) String() string {
+	switch t {
+	case GID_TYPE_IB:
+		return "IB"
+	case GID_TYPE_ROCE_V1:
+		return "RoCE v1"
+	case GID_TYPE_ROCE_V2:
+		return "RoCE v2"
+	}
+	return "GIDType(" + strconv.Itoa(int(t)) + ")"
+}
+
+func (t GIDType) MarshalText() ([]byte, error) {
+	return []byte(t.String()), nil
+}
+
+// GIDEntry is a populated entry of a port's GID table. RoCE GIDs are IP addresses: IP is
+// the IPv4 or IPv6 address the GID maps to and Netdev the interface carrying it.
+type GIDEntry struct {
+	Index  int     `json:"index"`
+	GID    net.IP  `json:"gid"`
+	Type   GIDType `json:"type"`
+	IP     net.IP  `json:"ip,omitempty"`
+	Netdev string  `json:"netdev,omitempty"`
+}
+
+type PortInfo struct {
+	Port      int    `json:"port"`
+	State     string `json:"state"`
+	LinkLayer string `json:"link_layer"` // "InfiniBand" or "Ethernet"
+	LID       uint16 `json:"lid"`
+	ActiveMTU int    `json:"active_mtu"` // bytes
+	MaxMTU    int    `json:"max_mtu"`
+	// lanes times signaling rate, e.g. 4X EDR
+	ActiveWidth int        `json:"active_width"`
+	ActiveSpeed string     `json:"active_speed"`
+	RateGbps    float64    `json:"rate_gbps"`
+	GIDs        []GIDEntry `json:"gids"`
+
+	state     C.enum_ibv_port_state
+	linkLayer C.uint8_t
+}
+
+// Active reports whether the port can carry traffic.
+func (p *PortInfo) Active() bool {
+	return p.state == C.IBV_PORT_ACTIVE
+}
+
+type DeviceInfo struct {
+	Name      string     `json:"name"`
+	GUID      string     `json:"guid"`
+	NodeType  string     `json:"node_type"`
+	Transport string     `json:"transport"`
+	Firmware  string     `json:"firmware"`
+	Netdevs   []string   `json:"netdevs,omitempty"`
+	NUMANode  int        `json:"numa_node"` // -1 when unknown
+	Ports     []PortInfo `json:"ports"`
+}
+
+// Devices describes every RDMA device of the host with its ports and GID tables.
+func Devices() ([]DeviceInfo, error) {
+	var numDevices C.int
+	devList, err := C.ibv_get_device_list(&numDevices)
+	if devList == nil {
+		return nil, newVerbsError("ibv_get_device_list", "", ErrNoDevice, 0, err)
+	}
+	defer C.ibv_free_device_list(devList)
+
+	devices := unsafe.Slice(devList, int(numDevices))
+	infos := make([]DeviceInfo, 0, len(devices))
+	for _, device := range devices {
+		if device == nil {
+			continue
+		}
+		info, err := describeDevice(device)
+		if err != nil {
+			return nil, fmt.Errorf("[Devices] %w", err)
+		}
+		infos = append(infos, *info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos, nil
+}
+
+// LookupDevice describes the device called name.
+func LookupDevice(name string) (*DeviceInfo, error) {
+	devices, err := Devices()
+	if err != nil {
+		return nil, err
+	}
+	for i := range devices {
+		if devices[i].Name == name {
+			return &devices[i], nil
+		}
+	}
+	return nil, &VerbsError{Op: "ibv_get_device_list", Resource: "device " + name, Kind: ErrNoDevice}
+}
+
+func describeDevice(device *C.struct_ibv_device) (*DeviceInfo, error) {
+	name := C.GoString(C.ibv_get_device_name(device))
+	info := &DeviceInfo{
+		Name:      name,
+		GUID:      formatGUID(uint64(C.ibv_get_device_guid(device))),
+		NodeType:  C.GoString(C.ibv_node_type_str(device.node_type)),
+		Transport: transportName(device.transport_type),
+		Netdevs:   deviceNetdevs(name),
+		NUMANode:  readSysfsInt(filepath.Join(SYSFS_INFINIBAND, name, "device", "numa_node"), -1),
+	}
+
+	context, err := C.ibv_open_device(device)
+	if context == nil {
+		return nil, newVerbsError("ibv_open_device", "device "+name, nil, 0, err)
+	}
+	defer C.ibv_close_device(context)
+
+	var attr C.struct_ibv_device_attr
+	if ret := C.ibv_query_device(context, &attr); ret != 0 {
+		return nil, newVerbsError("ibv_query_device", "device "+name, nil, int(ret), nil)
+	}
+	info.Firmware = C.GoString(&attr.fw_ver[0])
+
+	for port := 1; port <= int(attr.phys_port_cnt); port++ {
+		portInfo, err := describePort(context, name, port)
+		if err != nil {
+			return nil, err
+		}
+		info.Ports = append(info.Ports, *portInfo)
+	}
+	return info, nil
+}
+
+func describePort(context *C.struct_ibv_context, device string, port int) (*PortInfo, error) {
+	var attr C.struct_ibv_port_attr
+	if ret := C.ibv_query_port_wrapper(context, C.uint8_t(port), &attr); ret != 0 {
+		return nil, newVerbsError("ibv_query_port", fmt.Sprintf("device %v port %v", device, port), nil, int(ret), nil)
+	}
+	width := widthLanes(uint8(attr.active_width))
+	speed, gbps := speedName(uint8(attr.active_speed))
+	info := &PortInfo{
+		Port:        port,
+		State:       C.GoString(C.ibv_port_state_str(attr.state)),
+		LinkLayer:   linkLayerName(attr.link_layer),
+		LID:         uint16(attr.lid),
+		ActiveMTU:   mtuBytes(attr.active_mtu),
+		MaxMTU:      mtuBytes(attr.max_mtu),
+		ActiveWidth: width,
+		ActiveSpeed: speed,
+		RateGbps:    float64(width) * gbps,
+		state:       attr.state,
+		linkLayer:   attr.link_layer,
+	}
+
+	attrs := filepath.Join(SYSFS_INFINIBAND, device, "ports", strconv.Itoa(port), "gid_attrs")
+	for index := 0; index < int(attr.gid_tbl_len); index++ {
+		var gid C.union_ibv_gid
+		if ret := C.ibv_query_gid(context, C.uint8_t(port), C.int(index), &gid); ret != 0 {
+			// RoCE tables have holes the kernel refuses to report
+			continue
+		}
+		raw := C.GoBytes(unsafe.Pointer(&gid), 16)
+		if net.IP(raw).IsUnspecified() {
+			continue
+		}
+		entry := GIDEntry{Index: index, GID: net.IP(raw)}
+		entry.Type = gidType(device, port, index, info.linkLayer)
+		if entry.Type != GID_TYPE_IB {
+			entry.IP = entry.GID
+			if v4 := entry.GID.To4(); v4 != nil {
+				entry.IP = v4
+			}
+			if ndev, err := os.ReadFile(filepath.Join(attrs, "ndevs", strconv.Itoa(index))); err == nil {
+				entry.Netdev = strings.TrimSpace(string(ndev))
+			}
+		}
+		info.GIDs = append(info.GIDs, entry)
+	}
+	return info, nil
+}
+
+// gidType returns the type of a GID, the kernel reports it for Ethernet ports only.
+func gidType(device string, port, index int, linkLayer C.uint8_t) GIDType {
+	if linkLayer != C.IBV_LINK_LAYER_ETHERNET {
+		return GID_TYPE_IB
+	}
+	path := filepath.Join(SYSFS_INFINIBAND, device, "ports", strconv.Itoa(port), "gid_attrs", "types", strconv.Itoa(index))
+	if t, err := os.ReadFile(path); err == nil && strings.Contains(strings.ToLower(string(t)), "v2") {
+		return GID_TYPE_ROCE_V2
+	}
+	return GID_TYPE_ROCE_V1
+}
+
+// deviceNetdevs returns the network interfaces of an RDMA device: those of its PCI device
+// or, for software devices like rxe, the interface it was created on.
+func deviceNetdevs(device string) []string {
+	entries, err := os.ReadDir(filepath.Join(SYSFS_INFINIBAND, device, "device", "net"))
+	var netdevs []string
+	if err == nil {
+		for _, entry := range entries {
+			netdevs = append(netdevs, entry.Name())
+		}
+	}
+	if len(netdevs) == 0 {
+		if parent, err := os.ReadFile(filepath.Join(SYSFS_INFINIBAND, device, "parent")); err == nil {
+			netdevs = append(netdevs, strings.TrimSpace(string(parent)))
+		}
+	}
+	return netdevs
+}
+
+func readSysfsInt(path string, fallback int) int {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fallback
+	}
+	v, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return fallback
+	}
+	return v
+}
+
+// formatGUID formats a GUID in network byte order as ibv_devinfo does.
+func formatGUID(be uint64) string {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], be) // the value is stored big endian
+	return fmt.Sprintf("%04x:%04x:%04x:%04x", binary.BigEndian.Uint16(b[0:]), binary.BigEndian.Uint16(b[2:]),
+		binary.BigEndian.Uint16(b[4:]), binary.BigEndian.Uint16(b[6:]))
+}
+
+func transportName(t C.enum_ibv_transport_type) string {
+	switch t {
+	case C.IBV_TRANSPORT_IB:
+		return "InfiniBand"
+	case C.IBV_TRANSPORT_IWARP:
+		return "iWARP"
+	case C.IBV_TRANSPORT_USNIC:
+		return "usNIC"
+	case C.IBV_TRANSPORT_USNIC_UDP:
+		return "usNIC UDP"
+	}
+	return "unknown"
+}
+
+func linkLayerName(l C.uint8_t) string {
+	switch l {
+	case C.IBV_LINK_LAYER_INFINIBAND, C.IBV_LINK_LAYER_UNSPECIFIED:
+		return "InfiniBand"
+	case C.IBV_LINK_LAYER_ETHERNET:
+		return "Ethernet"
+	}
+	return "unknown"
+}
+
+func mtuBytes(mtu C.enum_ibv_mtu) int {
+	if mtu == 0 {
+		return 0
+	}
+	return 128 << uint(mtu) // IBV_MTU_256 is 1
+}
+
+// widthLanes decodes ibv_port_attr.active_width.
+func widthLanes(width uint8) int {
+	switch width {
+	case 1:
+		return 1
+	case 2:
+		return 4
+	case 4:
+		return 8
+	case 8:
+		return 12
+	case 16:
+		return 2
+	}
+	return 0
+}
+
+// speedName decodes ibv_port_attr.active_speed into its name and Gb/s per lane.
+func speedName(speed uint8) (string, float64) {
+	switch speed {
+	case 1:
+		return "SDR", 2.5
+	case 2:
+		return "DDR", 5
+	case 4:
+		return "QDR", 10
+	case 8:
+		return "FDR10", 10.3125
+	case 16:
+		return "FDR", 14.0625
+	case 32:
+		return "EDR", 25.78125
+	case 64:
+		return "HDR", 50
+	case 128:
+		return "NDR", 100
+	}
+	return "unknown", 0
+}
+
+// Device describes the device ibRes opened.
+func (ibRes *IBRes) Device() (*DeviceInfo, error) {
+	if ibRes.deviceName == "" {
+		return nil, errors.New("[Device] no device opened")
+	}
+	return LookupDevice(ibRes.deviceName)
+}
@@ -0,0 +1,1320 @@
+package RDMAGO
+
+/*
+#cgo CFLAGS: -I/usr/include/infiniband
+#cgo LDFLAGS: -libverbs -L. -lwrapper
+
+#include "wrapper.h"
+
+#include <stdlib.h>
+#include <string.h>
+#include <infiniband/verbs.h>
+*/
+import "C"
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type EndpointState int32
+
+const (
+	ENDPOINT_CONNECTING EndpointState = iota
+	ENDPOINT_CONNECTED
+	ENDPOINT_RECONNECTING
+	ENDPOINT_FAILED
+	ENDPOINT_CLOSING
+	ENDPOINT_CLOSED
+)
+
+func (s EndpointState) String() string {
+	switch s {
+	case ENDPOINT_CONNECTING:
+		return "connecting"
+	case ENDPOINT_CONNECTED:
+		return "connected"
+	case ENDPOINT_RECONNECTING:
+		return "reconnecting"
+	case ENDPOINT_FAILED:
+		return "failed"
+	case ENDPOINT_CLOSING:
+		return "closing"
+	case ENDPOINT_CLOSED:
+		return "closed"
+	}
+	return fmt.Sprintf("EndpointState(%d)", int32(s))
+}
+
+type EndpointEventType int
+
+const (
+	ENDPOINT_EVENT_DISCONNECTED EndpointEventType = iota
+	ENDPOINT_EVENT_RECONNECTED
+	ENDPOINT_EVENT_RECONNECT_FAILED
+	ENDPOINT_EVENT_PEER_UNREACHABLE
+	ENDPOINT_EVENT_PEER_CLOSED
+)
+
+func (t EndpointEventType) String() string {
+	switch t {
+	case ENDPOINT_EVENT_DISCONNECTED:
+		return "disconnected"
+	case ENDPOINT_EVENT_RECONNECTED:
+		return "reconnected"
+	case ENDPOINT_EVENT_RECONNECT_FAILED:
+		return "reconnect failed"
+	case ENDPOINT_EVENT_PEER_UNREACHABLE:
+		return "peer unreachable"
+	case ENDPOINT_EVENT_PEER_CLOSED:
+		return "peer closed"
+	}
+	return fmt.Sprintf("EndpointEventType(%d)", int(t))
+}
+
+// EndpointEvent reports connection changes. Err is the cause of a disconnect or the
+// last error of a failed reconnect, Attempt the reconnect attempt it refers to.
+type EndpointEvent struct {
+	Type    EndpointEventType
+	Attempt int
+	Err     error
+	Time    time.Time
+}
+
+const (
+	DEFAULT_RECONNECT_RETRIES        = 5
+	DEFAULT_RECONNECT_BACKOFF_MS     = 100
+	DEFAULT_RECONNECT_MAX_BACKOFF_MS = 5000
+
+	ENDPOINT_POLL_BATCH  = 16
+	ENDPOINT_IDLE_SPINS  = 1000
+	ENDPOINT_IDLE_SLEEP  = 50 * time.Microsecond
+	ENDPOINT_EVENT_QUEUE = 16
+
+	DEFAULT_HEARTBEAT_INTERVAL_MS = 1000
+	DEFAULT_HEARTBEAT_MISSES      = 3
+	DEFAULT_CLOSE_TIMEOUT_MS      = 5000
+
+	// messages with an immediate from ENDPOINT_CONTROL_IMM up are control messages of
+	// the endpoint and never reach Recv
+	ENDPOINT_CONTROL_IMM     = 0xFFFFFFF0
+	ENDPOINT_CREDIT_IMM      = 0xFFFFFFFC
+	ENDPOINT_GOODBYE_ACK_IMM = 0xFFFFFFFD
+	ENDPOINT_GOODBYE_IMM     = 0xFFFFFFFE
+	ENDPOINT_HEARTBEAT_IMM   = 0xFFFFFFFF
+	// poller iterations between two heartbeat checks
+	ENDPOINT_HEARTBEAT_CHECK = 256
+
+	// wr_id flag of sends nobody waits for
+	endpointWrNoWait = 1 << 63
+	// wr_id of the signaled reply to the peer's goodbye
+	endpointWrGoodbyeAck = endpointWrNoWait | 1<<62
+)
+
+// Message is a received message, copied out of the receive buffer.
+type Message struct {
+	Data    []byte
+	ImmData uint32
+	// Trace is the span that received the message when the sender traced it, see Context
+	Trace trace.SpanContext
+	// the receiving span, ended by Recv
+	span trace.Span
+}
+
+// Endpoint is one RC connection with its own device resources. A poller goroutine owns
+// the CQ: it hands received messages to Recv, completes Send and, when a completion
+// fails or the QP is reported broken, recycles the QP and reconnects through the
+// bootstrap TCP path with the retry policy of the Config.
+type Endpoint struct {
+	cfg     *Config
+	res     *IBRes
+	log     Logger
+	metrics atomic.Pointer[endpointMetrics] // labels follow the peer, set by establish
+	// removes the collector of the port counters from the registry
+	removeCollector func()
+	tracer          *endpointTracer
+	srq             *ManagedSRQ
+	monitor         *EventMonitor
+	wc              *C.struct_ibv_wc
+
+	listener net.Listener
+	// connections of a (re)connect the endpoint is waiting for, and reconnects of the
+	// current peer that arrived while the endpoint was connected
+	acceptCh    chan net.Conn
+	reconnectCh chan net.Conn
+	// id identifies the endpoint to its peer across reconnects, see screenReconnect
+	id uint64
+
+	// postMu guards posting and the send queue accounting of res
+	postMu   sync.Mutex
+	nextWrID uint64
+	// sendMu serializes Send, a signaled send owns res.IbBuf until it completes
+	sendMu   sync.Mutex
+	sendWrID uint64
+	sendDone chan error
+
+	mu           sync.Mutex
+	state        EndpointState
+	stateChanged chan struct{}
+	peer         *QPInfo
+	lastErr      error
+	inbox        []Message
+	inboxSignal  chan struct{}
+	handlers     []func(EndpointEvent)
+	events       chan EndpointEvent
+
+	// set by a Session, the sequence numbers exchanged during the handshake
+	localRecvSeq  func() uint64
+	onPeerRecvSeq func(uint64)
+	session       *Session
+	// bootstrap address and endpoint id of the current peer
+	peerAddr string
+	peerID   uint64
+	// QoS of the current connection
+	qos PathQoS
+
+	// heartbeat state, owned by the poller
+	heartbeatInterval time.Duration
+	heartbeatMisses   int
+	peerSeen          bool
+	lastRecv          time.Time
+	lastHeartbeat     time.Time
+
+	// credit flow control, see credit.go. peerGrant is the cumulative grant of the peer and
+	// sent the messages posted since the handshake, both guarded by postMu. localGrant is
+	// what our SRQ took and can take since the handshake less what waits for Recv,
+	// advertised the grant last sent.
+	peerGrant     uint32
+	sent          uint32
+	creditStats   CreditStats
+	creditSignal  chan struct{}
+	localGrant    uint32
+	advertised    uint32
+	completedBase uint64
+	creditUpdate  uint32
+	// set by Recv, the poller recomputes localGrant
+	grantDirty int32
+
+	// set by a cancelled SendContext, the poller aborts the QP and reconnects
+	aborting int32
+	abortErr error
+
+	// shutdown: closing stops recovery and heartbeats, goodbyeDone is closed when the
+	// peer acknowledged our goodbye, ackDone when our acknowledgment of its goodbye completed
+	closing     int32
+	peerClosed  bool
+	goodbyeDone chan struct{}
+	goodbyeOnce sync.Once
+	ackDone     chan struct{}
+	ackOnce     sync.Once
+
+	stop      chan struct{}
+	stopCtx   context.Context // cancelled by Close, bounds handshakes of reconnects
+	cancel    context.CancelFunc
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewEndpoint creates the device resources described by cfg and connects to the peer:
+// a "server" waits for the client on cfg.Port, a "client" dials cfg.Address.
+func NewEndpoint(cfg *Config) (*Endpoint, error) {
+	return NewEndpointContext(context.Background(), cfg)
+}
+
+// NewEndpointContext is NewEndpoint with ctx bounding the first connection.
+func NewEndpointContext(ctx context.Context, cfg *Config) (*Endpoint, error) {
+	if cfg.Mode != "server" && cfg.Mode != "client" {
+		return nil, errors.New("[NewEndpoint] invalid mode " + cfg.Mode)
+	}
+
+	res, err := InitIBRes()
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Logger != nil {
+		res.SetLogger(cfg.Logger)
+	}
+	if cfg.CaptureFile != "" {
+		capture, err := CreateCapture(cfg.CaptureFile, cfg.CaptureSnaplen)
+		if err != nil {
+			return nil, fmt.Errorf("[NewEndpoint] %w", err)
+		}
+		res.SetCapture(capture)
+	}
+	res.SetSendOptions(cfg.MaxInlineData, cfg.SignalInterval)
+	res.SetSRQOptions(SRQOptions{
+		MaxWR:   cfg.SRQMaxWR,
+		Depth:   cfg.SRQDepth,
+		Buffers: cfg.SRQBuffers,
+		Limit:   cfg.SRQLimit,
+	})
+	sel, err := SelectDevice(ctx, cfg.selector())
+	if err != nil {
+		res.capture.Close()
+		return nil, fmt.Errorf("[NewEndpoint] %w", err)
+	}
+	res.SetAddress(sel.Port, sel.GidIndex)
+	if err = res.SetAddressOptions(cfg.addressOptions()); err != nil {
+		res.capture.Close()
+		return nil, fmt.Errorf("[NewEndpoint] %w", err)
+	}
+	res.logger().Debug("[NewEndpoint] device selected", "device", sel.Device, "port", sel.Port,
+		"gid_index", sel.GidIndex, "gid_type", sel.GID.Type.String(), "ip", sel.GID.IP)
+	if _, err = res.InitRCQP(sel.Device, cfg.MrSize); err != nil {
+		res.FreeIBRes()
+		res.capture.Close()
+		return nil, fmt.Errorf("[NewEndpoint] %w", err)
+	}
+
+	ep := &Endpoint{
+		cfg:          cfg,
+		res:          res,
+		acceptCh:     make(chan net.Conn),
+		reconnectCh:  make(chan net.Conn),
+		id:           newEndpointID(),
+		sendDone:     make(chan error, 1),
+		state:        ENDPOINT_CONNECTING,
+		stateChanged: make(chan struct{}),
+		inboxSignal:  make(chan struct{}, 1),
+		events:       make(chan EndpointEvent, ENDPOINT_EVENT_QUEUE),
+		creditSignal: make(chan struct{}, 1),
+		goodbyeDone:  make(chan struct{}),
+		ackDone:      make(chan struct{}),
+		stop:         make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+	ep.log = res.logger().With("mode", cfg.Mode)
+	if cfg.qosClass != "" {
+		ep.log = ep.log.With("qos_class", cfg.qosClass)
+	}
+	ep.tracer = newEndpointTracer(cfg)
+	ep.stopCtx, ep.cancel = context.WithCancel(context.Background())
+	ep.heartbeatInterval, ep.heartbeatMisses = heartbeatPolicy(cfg)
+	if err = ep.open(); err != nil {
+		ep.stopBackground()
+		ep.release()
+		return nil, err
+	}
+
+	if err = ep.connect(ctx); err != nil {
+		ep.stopBackground()
+		ep.release()
+		return nil, err
+	}
+	ep.lastRecv = time.Now()
+	go ep.pollLoop()
+	registerEndpoint(ep)
+	return ep, nil
+}
+
+func (ep *Endpoint) open() error {
+	var err error
+	if ep.wc, err = CreateWC(ENDPOINT_POLL_BATCH); err != nil {
+		return fmt.Errorf("[NewEndpoint] %w", err)
+	}
+	if ep.srq, err = NewManagedSRQ(ep.res, ep.cfg.MrSize); err != nil {
+		return fmt.Errorf("[NewEndpoint] %w", err)
+	}
+	if ep.srq.depth <= ENDPOINT_CREDIT_RESERVE {
+		return errors.New(fmt.Sprintf("[NewEndpoint] srq_depth %v leaves no credits for data", ep.srq.depth))
+	}
+	ep.creditUpdate = uint32((ep.srq.depth - ENDPOINT_CREDIT_RESERVE) / 4)
+	if ep.creditUpdate < 1 {
+		ep.creditUpdate = 1
+	}
+	if ep.monitor, err = StartEventMonitor(ep.res); err != nil {
+		return fmt.Errorf("[NewEndpoint] %w", err)
+	}
+	registry := ep.metricsRegistry()
+	ep.removeCollector = registry.AddCollector(func() {
+		if err := collectPortCounters(registry, ep.res.deviceName, ep.res.Port); err != nil {
+			ep.log.Debug("[Endpoint] port counters not collected", "error", err)
+		}
+	})
+	if ep.cfg.Mode == "server" {
+		if ep.listener, err = net.Listen("tcp", ":"+ep.cfg.Port); err != nil {
+			return fmt.Errorf("[NewEndpoint] Error starting server: %w", err)
+		}
+		go ep.acceptLoop()
+	}
+	return nil
+}
+
+// stopBackground stops what open started: the goroutines watching stop and stopCtx and the
+// accept loop, which only returns once the listener is closed.
+func (ep *Endpoint) stopBackground() {
+	close(ep.stop)
+	ep.cancel()
+	if ep.listener != nil {
+		ep.listener.Close()
+	}
+}
+
+// connect establishes the first connection, the server waits for its client until ctx is done.
+func (ep *Endpoint) connect(ctx context.Context) error {
+	var conn net.Conn
+	var err error
+	if ep.cfg.Mode == "server" {
+		select {
+		case conn = <-ep.acceptCh:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	} else {
+		if conn, err = ep.dial(ctx); err != nil {
+			return err
+		}
+	}
+
+	if err = ep.establish(ctx, conn); err != nil {
+		return err
+	}
+	ep.setState(ENDPOINT_CONNECTED, nil)
+	return nil
+}
+
+// acceptLoop hands bootstrap connections to a connect or reconnect waiting for them. A
+// connection arriving while the endpoint is connected may be the client asking for a
+// reconnect after it lost the QP, it is screened before anything is torn down.
+func (ep *Endpoint) acceptLoop() {
+	for {
+		conn, err := ep.listener.Accept()
+		if err != nil {
+			select {
+			case <-ep.stop:
+				return
+			default:
+			}
+			ep.log.Error("[Endpoint] accept failed", err)
+			continue
+		}
+
+		ep.mu.Lock()
+		state, changed := ep.state, ep.stateChanged
+		ep.mu.Unlock()
+		switch state {
+		case ENDPOINT_CONNECTING, ENDPOINT_RECONNECTING:
+			select {
+			case ep.acceptCh <- conn:
+			case <-changed:
+				// connected through another connection or given up meanwhile
+				conn.Close()
+			case <-ep.stop:
+				conn.Close()
+				return
+			}
+		case ENDPOINT_CONNECTED:
+			go ep.screenReconnect(conn)
+		default:
+			conn.Close()
+		}
+	}
+}
+
+// screenReconnect passes conn to the poller only when its handshake comes from the
+// current peer, i.e. carries the QP number and endpoint id of the connection we have.
+// Anything else, such as a port scan, is closed without touching the QP.
+func (ep *Endpoint) screenReconnect(conn net.Conn) {
+	info, replay, err := peekQPInfo(conn, HANDSHAKE_TIMEOUT)
+	ep.mu.Lock()
+	peer, peerID := ep.peer, ep.peerID
+	ep.mu.Unlock()
+	if err == nil && (peer == nil || info.QpNum != uint32(peer.QpNum) || info.EndpointID == 0 || info.EndpointID != peerID) {
+		err = errors.New("not the current peer")
+	}
+	if err != nil {
+		ep.log.Info("[Endpoint] bootstrap connection rejected", "remote", conn.RemoteAddr().String(), "error", err)
+		conn.Close()
+		return
+	}
+
+	select {
+	case ep.reconnectCh <- replay:
+	case <-ep.stop:
+		conn.Close()
+	}
+}
+
+// newEndpointID returns a random non-zero id.
+func newEndpointID() uint64 {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return uint64(time.Now().UnixNano()) | 1
+	}
+	return binary.LittleEndian.Uint64(b[:]) | 1
+}
+
+func (ep *Endpoint) dial(ctx context.Context) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: HANDSHAKE_TIMEOUT}
+	conn, err := dialer.DialContext(ctx, "tcp", ep.cfg.Address)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, fmt.Errorf("[Endpoint] Error connecting to server: %w", err)
+	}
+	return conn, nil
+}
+
+// establish exchanges QP info over conn, brings the QP to RTS and waits for the peer's RTS.
+func (ep *Endpoint) establish(ctx context.Context, conn net.Conn) (err error) {
+	ctx, span := ep.tracer.tracer.Start(ctx, "rdma.connect",
+		trace.WithAttributes(ep.traceAttributes(attribute.String("rdma.peer", conn.RemoteAddr().String()))...))
+	defer func() { endSpan(span, err) }()
+
+	h := newHandshake(ctx, conn)
+	h.capture, h.qpNum = ep.res.capture, uint32(ep.res.Qp.qp_num)
+	defer h.close()
+
+	info, err := GetQPInfo(ep.res)
+	if err != nil {
+		return err
+	}
+	ep.mu.Lock()
+	localRecvSeq, onPeerRecvSeq := ep.localRecvSeq, ep.onPeerRecvSeq
+	ep.mu.Unlock()
+	var lastRecvSeq uint64
+	if localRecvSeq != nil {
+		lastRecvSeq = localRecvSeq()
+	}
+
+	local := handshakeState{LastRecvSeq: lastRecvSeq, Credits: ep.resetCredits(), EndpointID: ep.id}
+	_, hsSpan := ep.tracer.tracer.Start(ctx, "rdma.handshake")
+	peer, remote, err := h.exchange(*info, local)
+	if err != nil {
+		endSpan(hsSpan, err)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
+	}
+	hsSpan.SetAttributes(attribute.Int64("rdma.peer_qp_num", int64(peer.QpNum)))
+	if err = ep.res.ModifyQPRTS(peer); err != nil {
+		endSpan(hsSpan, err)
+		return err
+	}
+	err = h.syncReady()
+	endSpan(hsSpan, err)
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
+	}
+
+	ep.mu.Lock()
+	ep.peer = peer
+	ep.peerAddr = conn.RemoteAddr().String()
+	ep.peerID = remote.EndpointID
+	ep.qos = ep.res.pathQoS()
+	ep.mu.Unlock()
+	metrics := newEndpointMetrics(ep.metricsRegistry(), ep.res.deviceName, strconv.Itoa(ep.res.Port), peerHost(conn))
+	if old := ep.metrics.Swap(metrics); old != nil {
+		old.release()
+	}
+	ep.startCredits(remote.Credits)
+	if onPeerRecvSeq != nil {
+		onPeerRecvSeq(remote.LastRecvSeq)
+	}
+	ep.log.Debug("[Endpoint] connected", "peer", conn.RemoteAddr().String(), "peer_qp_num", uint32(peer.QpNum),
+		"qos_class", ep.cfg.qosClass)
+	return nil
+}
+
+func (ep *Endpoint) metricsRegistry() *MetricsRegistry {
+	if ep.cfg.Metrics != nil {
+		return ep.cfg.Metrics
+	}
+	return DefaultMetrics
+}
+
+// peerHost labels metrics by the peer's address without the port, which changes with
+// every connection a server accepts.
+func peerHost(conn net.Conn) string {
+	addr := conn.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// setSession attaches the hooks of s, or detaches them when s is nil.
+func (ep *Endpoint) setSession(s *Session) {
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+	ep.session = s
+	if s == nil {
+		ep.localRecvSeq, ep.onPeerRecvSeq = nil, nil
+		return
+	}
+	ep.localRecvSeq = s.lastRecvSeq
+	ep.onPeerRecvSeq = s.resume
+}
+
+func (ep *Endpoint) State() EndpointState {
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+	return ep.state
+}
+
+// Peer returns the QP info of the current peer.
+func (ep *Endpoint) Peer() QPInfo {
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+	if ep.peer == nil {
+		return QPInfo{}
+	}
+	return *ep.peer
+}
+
+// QoS returns the SL, traffic class and flow label of the current connection.
+func (ep *Endpoint) QoS() PathQoS {
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+	return ep.qos
+}
+
+func (ep *Endpoint) setState(state EndpointState, err error) {
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+	if ep.state == ENDPOINT_CLOSED {
+		return
+	}
+	ep.state = state
+	if err != nil {
+		ep.lastErr = err
+	}
+	close(ep.stateChanged)
+	ep.stateChanged = make(chan struct{})
+}
+
+// OnEvent adds a callback for connection events, it runs on the poller goroutine.
+func (ep *Endpoint) OnEvent(fn func(EndpointEvent)) {
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+	ep.handlers = append(ep.handlers, fn)
+}
+
+// Events returns the connection events, they are dropped when nobody drains the channel.
+func (ep *Endpoint) Events() <-chan EndpointEvent {
+	return ep.events
+}
+
+func (ep *Endpoint) emit(event EndpointEvent) {
+	event.Time = time.Now()
+	ep.mu.Lock()
+	handlers := append([]func(EndpointEvent){}, ep.handlers...)
+	ep.mu.Unlock()
+
+	select {
+	case ep.events <- event:
+	default:
+	}
+	for _, fn := range handlers {
+		fn(event)
+	}
+}
+
+// waitConnected blocks while the endpoint is connecting or reconnecting.
+func (ep *Endpoint) waitConnected(ctx context.Context) error {
+	for {
+		ep.mu.Lock()
+		state, changed, lastErr := ep.state, ep.stateChanged, ep.lastErr
+		ep.mu.Unlock()
+
+		switch state {
+		case ENDPOINT_CONNECTED:
+			return nil
+		case ENDPOINT_FAILED:
+			return fmt.Errorf("[Endpoint] connection failed: %w", lastErr)
+		case ENDPOINT_CLOSING:
+			return lastErr
+		case ENDPOINT_CLOSED:
+			return fmt.Errorf("[Endpoint] %w", ErrClosed)
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ep.stop:
+			return fmt.Errorf("[Endpoint] %w", ErrClosed)
+		}
+	}
+}
+
+func (ep *Endpoint) newWrID() uint64 {
+	ep.nextWrID++
+	return ep.nextWrID &^ endpointWrNoWait
+}
+
+// Send sends data with immData and returns once the peer acknowledged it. Payloads up to
+// max_inline_data go inline and return as soon as they are posted. While the endpoint
+// reconnects Send waits; a message cut off by a connection failure returns an error.
+func (ep *Endpoint) Send(data []byte, immData uint32) error {
+	return ep.SendContext(context.Background(), data, immData)
+}
+
+// SendContext is Send that gives up when ctx is done. A send already posted cannot be
+// taken back, so cancelling it aborts the QP: SendContext waits until the flush released
+// the send buffer, returns ctx.Err() and the endpoint reconnects in the background.
+func (ep *Endpoint) SendContext(ctx context.Context, data []byte, immData uint32) (err error) {
+	if len(data) > ep.MaxMessageSize() {
+		return errors.New(fmt.Sprintf("[Endpoint] message of %v bytes exceeds %v", len(data), ep.MaxMessageSize()))
+	}
+	if immData >= ENDPOINT_CONTROL_IMM {
+		return errors.New("[Endpoint] immediate data reserved for control messages")
+	}
+	ep.sendMu.Lock()
+	defer ep.sendMu.Unlock()
+
+	span := ep.startSend(ctx, len(data), immData)
+	defer func() { endSpan(span, err) }()
+	sc := spanContextOf(span)
+
+	if hdrLen := headerSize(sc); len(data) > 0 && hdrLen+len(data) > int(ep.res.MaxInlineData) {
+		C.memcpy(unsafe.Add(unsafe.Pointer(ep.res.IbBuf), hdrLen), unsafe.Pointer(&data[0]), C.size_t(len(data)))
+	}
+	// waits while the endpoint reconnects or the peer has no receive posted for us
+	if err := ep.acquireCredit(ctx); err != nil {
+		return err
+	}
+	metrics := ep.metrics.Load()
+	wrID := ep.newWrID()
+	postSpan := ep.startChild(span, "rdma.post_send", attribute.Int64("rdma.wr_id", int64(wrID)))
+	posted := time.Now()
+	inline, err := ep.postDataLocked(data, immData, wrID, sc)
+	ep.postMu.Unlock()
+	endSpan(postSpan, err)
+	if span != nil {
+		span.SetAttributes(attribute.Int64("rdma.wr_id", int64(wrID)), attribute.Bool("rdma.inline", inline))
+	}
+	if err == nil {
+		metrics.sendOps.Inc()
+		metrics.sendBytes.Add(uint64(len(data)))
+	}
+	if err != nil || inline {
+		return err
+	}
+	// from the post to the signaled completion the poller hands over
+	completionSpan := ep.startChild(span, "rdma.completion", attribute.Int64("rdma.wr_id", int64(wrID)))
+	defer func() { endSpan(completionSpan, err) }()
+
+	select {
+	case err = <-ep.sendDone:
+		if err == nil {
+			metrics.sendLatency.Observe(time.Since(posted).Seconds())
+		}
+		return err
+	case <-ep.stop:
+		return fmt.Errorf("[Endpoint] %w", ErrClosed)
+	case <-ctx.Done():
+	}
+
+	ep.abort(ctx.Err())
+	select {
+	case <-ep.sendDone:
+	case <-ep.stop:
+	}
+	return ctx.Err()
+}
+
+// abort asks the poller to move the QP to the error state and reconnect.
+func (ep *Endpoint) abort(err error) {
+	ep.mu.Lock()
+	ep.abortErr = err
+	ep.mu.Unlock()
+	atomic.StoreInt32(&ep.aborting, 1)
+}
+
+func (ep *Endpoint) takeAbort() error {
+	if atomic.LoadInt32(&ep.aborting) == 0 {
+		return nil
+	}
+	atomic.StoreInt32(&ep.aborting, 0)
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+	return fmt.Errorf("[Endpoint] send aborted: %w", ep.abortErr)
+}
+
+// Recv returns the next received message, waiting through reconnects.
+func (ep *Endpoint) Recv() (Message, error) {
+	return ep.RecvContext(context.Background())
+}
+
+// RecvContext is Recv that returns ctx.Err() when ctx is done before a message arrived.
+func (ep *Endpoint) RecvContext(ctx context.Context) (Message, error) {
+	for {
+		ep.mu.Lock()
+		if len(ep.inbox) > 0 {
+			msg := ep.inbox[0]
+			ep.inbox[0] = Message{}
+			ep.inbox = ep.inbox[1:]
+			ep.mu.Unlock()
+			// the poller grants the receive to the peer again
+			atomic.StoreInt32(&ep.grantDirty, 1)
+			if msg.span != nil {
+				msg.span.End()
+				msg.span = nil
+			}
+			return msg, nil
+		}
+		state, changed, lastErr := ep.state, ep.stateChanged, ep.lastErr
+		ep.mu.Unlock()
+
+		switch state {
+		case ENDPOINT_FAILED:
+			return Message{}, fmt.Errorf("[Endpoint] connection failed: %w", lastErr)
+		case ENDPOINT_CLOSING:
+			return Message{}, lastErr
+		case ENDPOINT_CLOSED:
+			return Message{}, fmt.Errorf("[Endpoint] %w", ErrClosed)
+		}
+		select {
+		case <-ep.inboxSignal:
+		case <-changed:
+		case <-ctx.Done():
+			return Message{}, ctx.Err()
+		case <-ep.stop:
+			return Message{}, fmt.Errorf("[Endpoint] %w", ErrClosed)
+		}
+	}
+}
+
+func (ep *Endpoint) inboxLen() int {
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+	return len(ep.inbox)
+}
+
+func (ep *Endpoint) deliver(msg Message) {
+	ep.mu.Lock()
+	ep.inbox = append(ep.inbox, msg)
+	ep.mu.Unlock()
+	select {
+	case ep.inboxSignal <- struct{}{}:
+	default:
+	}
+}
+
+func (ep *Endpoint) pollLoop() {
+	defer close(ep.done)
+	var idle, tick int
+	for {
+		select {
+		case <-ep.stop:
+			return
+		case conn := <-ep.reconnectCh:
+			if atomic.LoadInt32(&ep.closing) != 0 {
+				conn.Close()
+				continue
+			}
+			ep.recover(errors.New("peer requested reconnect"), conn)
+			continue
+		default:
+		}
+		if ep.State() == ENDPOINT_FAILED {
+			// nothing left to poll, wait for Close
+			<-ep.stop
+			return
+		}
+
+		if err := ep.res.Failed(); err != nil {
+			ep.recover(err, nil)
+			continue
+		}
+		if err := ep.takeAbort(); err != nil {
+			ep.recover(err, nil)
+			continue
+		}
+		if atomic.SwapInt32(&ep.grantDirty, 0) != 0 {
+			ep.updateGrant()
+			ep.maybeSendCredits()
+		}
+		tick++
+		if tick%ENDPOINT_HEARTBEAT_CHECK == 0 && ep.checkPeer(time.Now()) {
+			return
+		}
+
+		num, err := IbvPollCQ(ep.res.Cq, ENDPOINT_POLL_BATCH, ep.wc)
+		if err != nil {
+			ep.recover(err, nil)
+			continue
+		}
+		metrics := ep.metrics.Load()
+		metrics.polls.Inc()
+		if num == 0 {
+			metrics.emptyPolls.Inc()
+			idle++
+			if idle == ENDPOINT_IDLE_SPINS {
+				// nothing happening, a good time to get the capture onto disk
+				ep.res.capture.Flush()
+			}
+			if idle >= ENDPOINT_IDLE_SPINS {
+				time.Sleep(ENDPOINT_IDLE_SLEEP)
+			}
+			continue
+		}
+		idle = 0
+
+		var failure error
+		for i := 0; i < num; i++ {
+			if err = ep.handleCompletion(wcAt(ep.wc, i)); err != nil && failure == nil {
+				failure = err
+			}
+		}
+		if failure != nil {
+			ep.recover(failure, nil)
+			continue
+		}
+		ep.maybeSendCredits()
+	}
+}
+
+// handleCompletion processes one completion and returns an error when it failed.
+func (ep *Endpoint) handleCompletion(wc *C.struct_ibv_wc) error {
+	wrID := uint64(wc.wr_id)
+	if wc.status != C.IBV_WC_SUCCESS || wc.opcode != C.IBV_WC_RECV {
+		ep.res.CaptureCompletion(wc, nil)
+	}
+	if wc.status != C.IBV_WC_SUCCESS {
+		err := fmt.Errorf("[Endpoint] %w", newWCError(wc))
+		ep.metrics.Load().completionError(WCStatus(wc.status))
+		// opcode is undefined on a failed completion, the wr_id tells receives from sends
+		if ep.srq.owns(wrID) {
+			ep.srq.OnFlush(wrID)
+		} else if wrID == atomic.LoadUint64(&ep.sendWrID) {
+			ep.completeSend(err)
+		} else if wrID == endpointWrGoodbyeAck {
+			ep.ackOnce.Do(func() { close(ep.ackDone) })
+		}
+		return err
+	}
+
+	switch wc.opcode {
+	case C.IBV_WC_SEND:
+		ep.postMu.Lock()
+		ep.res.OnSendCompletion()
+		ep.postMu.Unlock()
+		if wrID == atomic.LoadUint64(&ep.sendWrID) {
+			ep.completeSend(nil)
+		} else if wrID == endpointWrGoodbyeAck {
+			ep.ackOnce.Do(func() { close(ep.ackDone) })
+		}
+	case C.IBV_WC_RECV:
+		completed := time.Now()
+		ep.peerSeen = true
+		buf, err := ep.srq.OnRecv(wrID, int(wc.byte_len))
+		if buf == nil {
+			ep.res.CaptureCompletion(wc, nil)
+			return err
+		}
+		ep.res.CaptureCompletion(wc, buf.Data)
+		if err != nil {
+			ep.log.Error("[Endpoint] refill SRQ failed", err, "wr_id", wrID)
+		}
+		if len(buf.Data) < ENDPOINT_HEADER_SIZE {
+			ep.srq.Release(buf)
+			ep.updateGrant()
+			ep.log.Error("[Endpoint] dropping message", nil, "wr_id", wrID, "bytes", len(buf.Data))
+			return nil
+		}
+		ep.onPeerGrant(binary.LittleEndian.Uint32(buf.Data))
+
+		hdrLen := ENDPOINT_HEADER_SIZE
+		var remote trace.SpanContext
+		if buf.Data[4]&ENDPOINT_FLAG_TRACE != 0 {
+			hdrLen += ENDPOINT_TRACE_SIZE
+			if len(buf.Data) < hdrLen {
+				ep.srq.Release(buf)
+				ep.updateGrant()
+				ep.log.Error("[Endpoint] dropping message with truncated trace context", nil, "wr_id", wrID,
+					"bytes", len(buf.Data))
+				return nil
+			}
+			remote = decodeTraceContext(buf.Data[ENDPOINT_HEADER_SIZE:])
+		}
+
+		imm := uint32(C.ibv_get_imm_data(wc))
+		msg := Message{ImmData: imm}
+		if imm < ENDPOINT_CONTROL_IMM {
+			msg.Data = append([]byte(nil), buf.Data[hdrLen:]...)
+			if remote.IsValid() {
+				msg.span = ep.startRecv(remote, completed, len(msg.Data), imm, wrID)
+				msg.Trace = msg.span.SpanContext()
+				if !msg.Trace.IsValid() {
+					msg.Trace = remote
+				}
+			}
+		}
+		ep.releaseRecv(msg.span, buf)
+		if imm >= ENDPOINT_CONTROL_IMM {
+			ep.updateGrant()
+			ep.handleControl(imm)
+			return nil
+		}
+		metrics := ep.metrics.Load()
+		metrics.recvOps.Inc()
+		metrics.recvBytes.Add(uint64(len(msg.Data)))
+		// the message enters the inbox before the grant is recomputed, so its receive is
+		// not granted again until Recv took it
+		ep.deliver(msg)
+		ep.updateGrant()
+	}
+	return nil
+}
+
+// handleControl processes a control message. Heartbeats and credit updates need nothing
+// beyond arriving, their grant was taken with the frame header.
+func (ep *Endpoint) handleControl(imm uint32) {
+	switch imm {
+	case ENDPOINT_GOODBYE_IMM:
+		atomic.StoreInt32(&ep.closing, 1)
+		ep.postMu.Lock()
+		err := ep.postControlLocked(ENDPOINT_GOODBYE_ACK_IMM, endpointWrGoodbyeAck, true)
+		ep.postMu.Unlock()
+		if err != nil {
+			ep.log.Error("[Endpoint] acknowledge goodbye failed", err)
+			ep.ackOnce.Do(func() { close(ep.ackDone) })
+		}
+
+		ep.mu.Lock()
+		ep.peerClosed = true
+		ep.mu.Unlock()
+		err = errors.New("[Endpoint] peer closed the connection")
+		ep.setState(ENDPOINT_CLOSING, err)
+		ep.emit(EndpointEvent{Type: ENDPOINT_EVENT_PEER_CLOSED, Err: err})
+	case ENDPOINT_GOODBYE_ACK_IMM:
+		ep.goodbyeOnce.Do(func() { close(ep.goodbyeDone) })
+	}
+}
+
+func (ep *Endpoint) completeSend(err error) {
+	atomic.StoreUint64(&ep.sendWrID, 0)
+	select {
+	case ep.sendDone <- err:
+	default:
+	}
+}
+
+// resetQP flushes every outstanding WR, drains the CQ and moves the QP back to RESET.
+func (ep *Endpoint) resetQP() {
+	if err := IbvModifyQPState(ep.res.Qp, C.IBV_QPS_ERR); err != nil {
+		ep.log.Error("[Endpoint] modify QP to ERR failed", err)
+	}
+
+	err := drainCQ(ep.res.Cq, ep.wc, ENDPOINT_POLL_BATCH, func(wc *C.struct_ibv_wc) {
+		ep.handleCompletion(wc)
+	})
+	if err != nil {
+		ep.log.Error("[Endpoint] drain CQ failed", err)
+	}
+	// a send still waiting was flushed without a completion we could match
+	if atomic.LoadUint64(&ep.sendWrID) != 0 {
+		ep.completeSend(errors.New("[Endpoint] send interrupted by connection failure"))
+	}
+
+	if err := IbvModifyQPState(ep.res.Qp, C.IBV_QPS_RESET); err != nil {
+		ep.log.Error("[Endpoint] modify QP to RESET failed", err)
+	}
+	ep.postMu.Lock()
+	ep.res.ResetSendSlots()
+	ep.postMu.Unlock()
+	ep.res.ClearFailed()
+}
+
+func heartbeatPolicy(cfg *Config) (time.Duration, int) {
+	interval := time.Duration(cfg.HeartbeatIntervalMs) * time.Millisecond
+	if cfg.HeartbeatIntervalMs == 0 {
+		interval = DEFAULT_HEARTBEAT_INTERVAL_MS * time.Millisecond
+	}
+	misses := cfg.HeartbeatMisses
+	if misses <= 0 {
+		misses = DEFAULT_HEARTBEAT_MISSES
+	}
+	return interval, misses
+}
+
+// checkPeer sends a heartbeat when one is due and reports whether the peer stayed silent
+// for heartbeat_misses intervals, in which case the endpoint is closed. Any received
+// message counts as a sign of life. A negative heartbeat_interval_ms disables both.
+func (ep *Endpoint) checkPeer(now time.Time) bool {
+	if ep.heartbeatInterval <= 0 || atomic.LoadInt32(&ep.closing) != 0 {
+		return false
+	}
+	if ep.peerSeen {
+		ep.peerSeen = false
+		ep.lastRecv = now
+	}
+
+	silence := now.Sub(ep.lastRecv)
+	if silence > time.Duration(ep.heartbeatMisses)*ep.heartbeatInterval {
+		err := fmt.Errorf("[Endpoint] no message from peer for %v: %w", silence.Truncate(time.Millisecond), ErrTimeout)
+		ep.log.Error("[Endpoint] peer unreachable", err)
+		ep.setState(ENDPOINT_FAILED, err)
+		ep.emit(EndpointEvent{Type: ENDPOINT_EVENT_PEER_UNREACHABLE, Err: err})
+		// Close waits for the poller, which is this goroutine
+		go ep.Close()
+		return true
+	}
+
+	if now.Sub(ep.lastHeartbeat) >= ep.heartbeatInterval {
+		ep.lastHeartbeat = now
+		ep.postMu.Lock()
+		err := ep.postControlLocked(ENDPOINT_HEARTBEAT_IMM, ep.newWrID()|endpointWrNoWait, false)
+		ep.postMu.Unlock()
+		if err != nil {
+			ep.log.Debug("[Endpoint] heartbeat not sent", "error", err)
+		}
+	}
+	return false
+}
+
+func (ep *Endpoint) retryPolicy() (int, time.Duration, time.Duration) {
+	retries := ep.cfg.ReconnectRetries
+	if retries == 0 {
+		retries = DEFAULT_RECONNECT_RETRIES
+	}
+	backoff := time.Duration(ep.cfg.ReconnectBackoffMs) * time.Millisecond
+	if backoff <= 0 {
+		backoff = DEFAULT_RECONNECT_BACKOFF_MS * time.Millisecond
+	}
+	maxBackoff := time.Duration(ep.cfg.ReconnectMaxBackoffMs) * time.Millisecond
+	if maxBackoff <= 0 {
+		maxBackoff = DEFAULT_RECONNECT_MAX_BACKOFF_MS * time.Millisecond
+	}
+	return retries, backoff, maxBackoff
+}
+
+// recover recycles the QP and runs the handshake again until it succeeds or the retries
+// are used up. conn is a bootstrap connection the peer already opened, or nil.
+// A negative reconnect_retries disables reconnecting.
+func (ep *Endpoint) recover(cause error, conn net.Conn) {
+	if atomic.LoadInt32(&ep.closing) != 0 {
+		// the connection is being shut down, release the waiters and wait for Close
+		ep.log.Debug("[Endpoint] connection lost while closing", "error", cause)
+		if conn != nil {
+			conn.Close()
+		}
+		ep.resetQP()
+		ep.goodbyeOnce.Do(func() { close(ep.goodbyeDone) })
+		ep.ackOnce.Do(func() { close(ep.ackDone) })
+		<-ep.stop
+		return
+	}
+	ep.log.Error("[Endpoint] connection lost", cause)
+	ep.setState(ENDPOINT_RECONNECTING, cause)
+	ep.emit(EndpointEvent{Type: ENDPOINT_EVENT_DISCONNECTED, Err: cause})
+	ep.resetQP()
+
+	retries, backoff, maxBackoff := ep.retryPolicy()
+	err := cause
+	for attempt := 1; attempt <= retries; attempt++ {
+		if conn == nil {
+			conn, err = ep.reconnectConn()
+		}
+		if conn != nil {
+			err = ep.establish(ep.stopCtx, conn)
+			conn = nil
+		}
+		if err == nil {
+			ep.lastRecv = time.Now()
+			ep.setState(ENDPOINT_CONNECTED, nil)
+			ep.emit(EndpointEvent{Type: ENDPOINT_EVENT_RECONNECTED, Attempt: attempt})
+			ep.log.Info("[Endpoint] reconnected", "attempts", attempt)
+			ep.metrics.Load().reconnects.Inc()
+			return
+		}
+		ep.metrics.Load().reconnectFailures.Inc()
+		ep.log.Debug("[Endpoint] reconnect attempt failed", "attempt", attempt, "error", err)
+		ep.resetQP()
+
+		select {
+		case <-ep.stop:
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+
+	ep.setState(ENDPOINT_FAILED, err)
+	ep.emit(EndpointEvent{Type: ENDPOINT_EVENT_RECONNECT_FAILED, Attempt: retries, Err: err})
+}
+
+// reconnectConn dials the server, or waits for the client to dial back.
+func (ep *Endpoint) reconnectConn() (net.Conn, error) {
+	if ep.cfg.Mode == "server" {
+		select {
+		case conn := <-ep.acceptCh:
+			return conn, nil
+		case conn := <-ep.reconnectCh:
+			return conn, nil
+		case <-time.After(HANDSHAKE_TIMEOUT):
+			return nil, fmt.Errorf("[Endpoint] client did not reconnect: %w", ErrTimeout)
+		case <-ep.stop:
+			return nil, fmt.Errorf("[Endpoint] %w", ErrClosed)
+		}
+	}
+	return ep.dial(ep.stopCtx)
+}
+
+// Close shuts the endpoint down within close_timeout_ms, see CloseContext.
+func (ep *Endpoint) Close() error {
+	timeout := time.Duration(ep.cfg.CloseTimeoutMs) * time.Millisecond
+	if timeout <= 0 {
+		timeout = DEFAULT_CLOSE_TIMEOUT_MS * time.Millisecond
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return ep.CloseContext(ctx)
+}
+
+// CloseContext shuts the connection down gracefully: new sends are refused, the send in
+// flight completes, a goodbye tells the peer that nothing follows and, once the peer
+// acknowledged it, QP, SRQ, CQ, MRs, PD and device are released in that order. When ctx
+// is done first or the connection is not up, the remaining steps are skipped.
+// Only the first call does anything.
+func (ep *Endpoint) CloseContext(ctx context.Context) error {
+	var err error
+	ep.closeOnce.Do(func() {
+		if drainErr := ep.drain(ctx); drainErr != nil {
+			ep.log.Info("[Endpoint] closing without drain", "error", drainErr)
+		}
+		ep.stopBackground()
+		ep.mu.Lock()
+		started := ep.state != ENDPOINT_CONNECTING
+		ep.mu.Unlock()
+		if started {
+			<-ep.done
+		}
+		ep.setState(ENDPOINT_CLOSED, nil)
+		unregisterEndpoint(ep)
+		err = ep.release()
+	})
+	return err
+}
+
+// drain runs the goodbye exchange while the poller is still running.
+func (ep *Endpoint) drain(ctx context.Context) error {
+	atomic.StoreInt32(&ep.closing, 1)
+	ep.mu.Lock()
+	state, peerClosed := ep.state, ep.peerClosed
+	ep.mu.Unlock()
+	if state != ENDPOINT_CONNECTED && state != ENDPOINT_CLOSING {
+		return errors.New(fmt.Sprintf("endpoint %v", state))
+	}
+	ep.setState(ENDPOINT_CLOSING, fmt.Errorf("[Endpoint] %w", ErrClosed))
+
+	// a Send in flight holds sendMu until its completion arrived
+	if !ep.lockSend(ctx) {
+		return ctx.Err()
+	}
+	defer ep.sendMu.Unlock()
+
+	if !peerClosed {
+		// the goodbye is signaled, its completion covers every send posted before it
+		ep.postMu.Lock()
+		wrID := ep.newWrID()
+		atomic.StoreUint64(&ep.sendWrID, wrID)
+		err := ep.postControlLocked(ENDPOINT_GOODBYE_IMM, wrID, true)
+		ep.postMu.Unlock()
+		if err != nil {
+			return err
+		}
+		select {
+		case err = <-ep.sendDone:
+			if err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		select {
+		case <-ep.goodbyeDone:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	// the peer said goodbye too, our acknowledgment must reach it before the QP goes away
+	ep.mu.Lock()
+	peerClosed = ep.peerClosed
+	ep.mu.Unlock()
+	if peerClosed {
+		select {
+		case <-ep.ackDone:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// lockSend acquires sendMu unless ctx is done first.
+func (ep *Endpoint) lockSend(ctx context.Context) bool {
+	locked := make(chan struct{})
+	go func() {
+		ep.sendMu.Lock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+		return true
+	case <-ctx.Done():
+		// the Send holding the lock returns once Close stopped the poller
+		go func() {
+			<-locked
+			ep.sendMu.Unlock()
+		}()
+		return false
+	}
+}
+
+// release frees the WC array and the IB resources; the event monitor, the receive pool,
+// QP and SRQ go with the device in dependency order.
+func (ep *Endpoint) release() error {
+	if ep.removeCollector != nil {
+		ep.removeCollector()
+		ep.removeCollector = nil
+	}
+	if metrics := ep.metrics.Load(); metrics != nil {
+		metrics.release()
+	}
+	// messages nobody received end their spans here
+	ep.mu.Lock()
+	for i := range ep.inbox {
+		if ep.inbox[i].span != nil {
+			ep.inbox[i].span.End()
+			ep.inbox[i].span = nil
+		}
+	}
+	ep.mu.Unlock()
+	if ep.wc != nil {
+		DestroyWC(ep.wc)
+		ep.wc = nil
+	}
+	if err := ep.res.FreeRCQP(); err != nil {
+		return fmt.Errorf("[Endpoint] %w", err)
+	}
+	if err := ep.res.capture.Close(); err != nil {
+		ep.log.Error("[Endpoint] capture incomplete", err, "file", ep.cfg.CaptureFile)
+	}
+	ep.res.SetCapture(nil)
+	ep.monitor = nil
+	ep.srq = nil
+	return nil
+}
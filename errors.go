@@ -0,0 +1,178 @@
+package RDMAGO
+
+/*
+#cgo CFLAGS: -I/usr/include/infiniband
+#cgo LDFLAGS: -libverbs -L. -lwrapper
+
+#include "wrapper.h"
+
+#include <stdlib.h>
+#include <infiniband/verbs.h>
+*/
+import "C"
+import (
+	"errors"
+	"fmt"
+	"syscall"
+)
+
+// Error classes, match them with errors.Is. VerbsError and WCError unwrap to them, and
+// to the syscall.Errno of the failed call where there is one.
+var (
+	ErrNoDevice         = errors.New("no such RDMA device")
+	ErrQPState          = errors.New("invalid QP state")
+	ErrRemoteAccess     = errors.New("remote access error")
+	ErrLocalAccess      = errors.New("local access or protection error")
+	ErrRNRRetryExceeded = errors.New("receiver not ready retry exceeded")
+	ErrRetryExceeded    = errors.New("transport retry exceeded")
+	ErrTimeout          = errors.New("timeout")
+	ErrFlushed          = errors.New("work request flushed")
+	ErrQueueFull        = errors.New("queue full")
+	ErrClosed           = errors.New("closed")
+)
+
+// VerbsError is a failed verbs call with the resource it acted on.
+type VerbsError struct {
+	Op       string        // e.g. "ibv_create_qp"
+	Resource string        // e.g. "device rxe_0", "QP 17"; empty when none exists yet
+	Errno    syscall.Errno // 0 when the call did not report one
+	Kind     error         // one of the Err* classes, nil when none applies
+}
+
+func (e *VerbsError) Error() string {
+	msg := e.Op
+	if e.Resource != "" {
+		msg += " on " + e.Resource
+	}
+	msg += " failed"
+	if e.Kind != nil {
+		msg += ": " + e.Kind.Error()
+	}
+	if e.Errno != 0 {
+		msg += fmt.Sprintf(": %v (errno %d)", e.Errno.Error(), int(e.Errno))
+	}
+	return msg
+}
+
+func (e *VerbsError) Unwrap() []error {
+	var errs []error
+	if e.Kind != nil {
+		errs = append(errs, e.Kind)
+	}
+	if e.Errno != 0 {
+		errs = append(errs, e.Errno)
+	}
+	return errs
+}
+
+// Is lets errno values that have an Err* class match it, e.g. ETIMEDOUT matches ErrTimeout.
+func (e *VerbsError) Is(target error) bool {
+	switch target {
+	case ErrTimeout:
+		return e.Errno == syscall.ETIMEDOUT
+	case ErrNoDevice:
+		return e.Errno == syscall.ENODEV
+	case ErrQueueFull:
+		return e.Errno == syscall.ENOMEM && e.Op == "ibv_post_send"
+	}
+	return false
+}
+
+// newVerbsError builds the error of a verbs call. cerr is the errno reported by cgo and
+// res the return value; verbs return either -1 with errno set or the errno itself.
+func newVerbsError(op, resource string, kind error, res int, cerr error) *VerbsError {
+	e := &VerbsError{Op: op, Resource: resource, Kind: kind}
+	var errno syscall.Errno
+	switch {
+	case res > 0:
+		e.Errno = syscall.Errno(res)
+	case res < -1:
+		e.Errno = syscall.Errno(-res)
+	case errors.As(cerr, &errno):
+		e.Errno = errno
+	}
+	return e
+}
+
+func qpResource(qp *C.struct_ibv_qp) string {
+	if qp == nil {
+		return ""
+	}
+	return fmt.Sprintf("QP %d", uint32(qp.qp_num))
+}
+
+func deviceResource(ctx *C.struct_ibv_context) string {
+	if ctx == nil {
+		return ""
+	}
+	return "device " + C.GoString(C.ibv_get_device_name(ctx.device))
+}
+
+// WCStatus is the status of a work completion, enum ibv_wc_status.
+type WCStatus uint32
+
+func (s WCStatus) String() string {
+	return C.GoString(C.ibv_wc_status_str(C.enum_ibv_wc_status(s)))
+}
+
+// WCError is a work completion with an error status.
+type WCError struct {
+	Status WCStatus
+	// Opcode is whatever the completion held, verbs leave it undefined on errors
+	Opcode    uint32
+	VendorErr uint32
+	WrID      uint64
+	QPNum     uint32
+}
+
+func newWCError(wc *C.struct_ibv_wc) *WCError {
+	return &WCError{
+		Status:    WCStatus(wc.status),
+		Opcode:    uint32(wc.opcode),
+		VendorErr: uint32(wc.vendor_err),
+		WrID:      uint64(wc.wr_id),
+		QPNum:     uint32(wc.qp_num),
+	}
+}
+
+// Err returns the error of the completion, nil when it succeeded.
+func (rec *WCRecord) Err() error {
+	if rec.Success() {
+		return nil
+	}
+	return &WCError{
+		Status:    WCStatus(rec.Status),
+		Opcode:    rec.Opcode,
+		VendorErr: rec.VendorErr,
+		WrID:      rec.WrID,
+		QPNum:     rec.QPNum,
+	}
+}
+
+func (e *WCError) Error() string {
+	return fmt.Sprintf("wr_id %#x on QP %d failed: %v (vendor error %#x)", e.WrID, e.QPNum, e.Status, e.VendorErr)
+}
+
+// Unwrap returns the Err* class of the status, nil for statuses without one.
+func (e *WCError) Unwrap() error {
+	switch e.Status {
+	case C.IBV_WC_RNR_RETRY_EXC_ERR:
+		return ErrRNRRetryExceeded
+	case C.IBV_WC_RETRY_EXC_ERR, C.IBV_WC_RESP_TIMEOUT_ERR:
+		return ErrRetryExceeded
+	case C.IBV_WC_REM_ACCESS_ERR:
+		return ErrRemoteAccess
+	case C.IBV_WC_LOC_ACCESS_ERR, C.IBV_WC_LOC_PROT_ERR, C.IBV_WC_MW_BIND_ERR:
+		return ErrLocalAccess
+	case C.IBV_WC_WR_FLUSH_ERR:
+		return ErrFlushed
+	case C.IBV_WC_LOC_QP_OP_ERR, C.IBV_WC_REM_INV_REQ_ERR, C.IBV_WC_BAD_RESP_ERR:
+		return ErrQPState
+	}
+	return nil
+}
+
+// Is lets a retry or response timeout match ErrTimeout as well.
+func (e *WCError) Is(target error) bool {
+	return target == ErrTimeout && (e.Status == C.IBV_WC_RETRY_EXC_ERR || e.Status == C.IBV_WC_RESP_TIMEOUT_ERR)
+}
@@ -0,0 +1,291 @@
+package RDMAGO
+
+/*
+#cgo CFLAGS: -I/usr/include/infiniband
+#cgo LDFLAGS: -libverbs -L. -lwrapper
+
+#include "wrapper.h"
+
+#include <stdlib.h>
+#include <infiniband/verbs.h>
+*/
+import "C"
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type AsyncEventType int
+
+const (
+	EVENT_CQ_ERR              AsyncEventType = C.IBV_EVENT_CQ_ERR
+	EVENT_QP_FATAL            AsyncEventType = C.IBV_EVENT_QP_FATAL
+	EVENT_QP_REQ_ERR          AsyncEventType = C.IBV_EVENT_QP_REQ_ERR
+	EVENT_QP_ACCESS_ERR       AsyncEventType = C.IBV_EVENT_QP_ACCESS_ERR
+	EVENT_COMM_EST            AsyncEventType = C.IBV_EVENT_COMM_EST
+	EVENT_SQ_DRAINED          AsyncEventType = C.IBV_EVENT_SQ_DRAINED
+	EVENT_PATH_MIG            AsyncEventType = C.IBV_EVENT_PATH_MIG
+	EVENT_PATH_MIG_ERR        AsyncEventType = C.IBV_EVENT_PATH_MIG_ERR
+	EVENT_DEVICE_FATAL        AsyncEventType = C.IBV_EVENT_DEVICE_FATAL
+	EVENT_PORT_ACTIVE         AsyncEventType = C.IBV_EVENT_PORT_ACTIVE
+	EVENT_PORT_ERR            AsyncEventType = C.IBV_EVENT_PORT_ERR
+	EVENT_LID_CHANGE          AsyncEventType = C.IBV_EVENT_LID_CHANGE
+	EVENT_PKEY_CHANGE         AsyncEventType = C.IBV_EVENT_PKEY_CHANGE
+	EVENT_SM_CHANGE           AsyncEventType = C.IBV_EVENT_SM_CHANGE
+	EVENT_SRQ_ERR             AsyncEventType = C.IBV_EVENT_SRQ_ERR
+	EVENT_SRQ_LIMIT_REACHED   AsyncEventType = C.IBV_EVENT_SRQ_LIMIT_REACHED
+	EVENT_QP_LAST_WQE_REACHED AsyncEventType = C.IBV_EVENT_QP_LAST_WQE_REACHED
+	EVENT_CLIENT_REREGISTER   AsyncEventType = C.IBV_EVENT_CLIENT_REREGISTER
+	EVENT_GID_CHANGE          AsyncEventType = C.IBV_EVENT_GID_CHANGE
+)
+
+const (
+	// how long one ibv_get_async_event_timeout call waits, bounds EventMonitor.Close
+	EVENT_POLL_TIMEOUT_MS = 100
+	EVENT_CHANNEL_SIZE    = 64
+)
+
+func (t AsyncEventType) String() string {
+	return C.GoString(C.ibv_event_type_str(C.enum_ibv_event_type(t)))
+}
+
+// AsyncEvent is an ibv_async_event translated to Go. Only the field matching the event
+// kind is set: QPNum for QP events, Port for port events.
+type AsyncEvent struct {
+	Type   AsyncEventType
+	Device string
+	QPNum  uint32
+	Port   int
+	Time   time.Time
+}
+
+// IsFatal reports whether the event leaves the affected resource unusable.
+func (e AsyncEvent) IsFatal() bool {
+	switch e.Type {
+	case EVENT_CQ_ERR, EVENT_QP_FATAL, EVENT_QP_REQ_ERR, EVENT_QP_ACCESS_ERR, EVENT_PATH_MIG_ERR,
+		EVENT_SRQ_ERR, EVENT_PORT_ERR, EVENT_DEVICE_FATAL:
+		return true
+	}
+	return false
+}
+
+func (e AsyncEvent) String() string {
+	switch {
+	case e.QPNum != 0:
+		return fmt.Sprintf("%v on %v QP %v", e.Type, e.Device, e.QPNum)
+	case e.Port != 0:
+		return fmt.Sprintf("%v on %v port %v", e.Type, e.Device, e.Port)
+	}
+	return fmt.Sprintf("%v on %v", e.Type, e.Device)
+}
+
+// MarkFailed flags the QP as unusable, blocked polling loops return an error on their next turn.
+func (ibRes *IBRes) MarkFailed(eventType AsyncEventType) {
+	atomic.StoreInt32(&ibRes.failedEvent, int32(eventType))
+	atomic.StoreInt32(&ibRes.failed, 1)
+}
+
+// ClearFailed resets the failure flag once the QP was recovered.
+func (ibRes *IBRes) ClearFailed() {
+	atomic.StoreInt32(&ibRes.failed, 0)
+}
+
+// Failed returns an error when the QP was marked failed by an async event.
+func (ibRes *IBRes) Failed() error {
+	if atomic.LoadInt32(&ibRes.failed) == 0 {
+		return nil
+	}
+	eventType := AsyncEventType(atomic.LoadInt32(&ibRes.failedEvent))
+	return fmt.Errorf("QP failed: %v: %w", eventType, ErrQPState)
+}
+
+// EventMonitor consumes the async events of one device context in its own goroutine.
+// Events are delivered to the OnEvent callbacks and, without blocking, to Events().
+// Fatal events mark the watched QPs failed; SRQ limit events refill the ManagedSRQ.
+type EventMonitor struct {
+	ctx    *C.struct_ibv_context
+	device string
+	log    Logger
+	events chan AsyncEvent
+
+	mu       sync.Mutex
+	qps      map[uint32]*IBRes
+	handlers []func(AsyncEvent)
+	dropped  uint64
+
+	stop chan struct{}
+	done chan struct{}
+	res  *Resource
+}
+
+// StartEventMonitor starts monitoring the device of ibRes and watches its QP.
+func StartEventMonitor(ibRes *IBRes) (*EventMonitor, error) {
+	if ibRes.Ctx == nil {
+		return nil, errors.New("[StartEventMonitor] device not opened")
+	}
+	m := &EventMonitor{
+		ctx:    ibRes.Ctx,
+		device: C.GoString(C.ibv_get_device_name(ibRes.Ctx.device)),
+		events: make(chan AsyncEvent, EVENT_CHANNEL_SIZE),
+		qps:    make(map[uint32]*IBRes),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	base := ibRes.baseLog
+	if base == nil {
+		base = DefaultLogger()
+	}
+	m.log = base.With("device", m.device)
+	if ibRes.Qp != nil {
+		m.Watch(ibRes)
+	}
+	go m.run()
+	m.res = newResource("event monitor", m.device, m.shutdown, ibRes.resources.device)
+	return m, nil
+}
+
+// Watch registers the QP of ibRes, which must belong to the monitored device.
+func (m *EventMonitor) Watch(ibRes *IBRes) {
+	if ibRes.Qp == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.qps[uint32(ibRes.Qp.qp_num)] = ibRes
+}
+
+// Unwatch stops watching the QP of ibRes, also after the QP was destroyed.
+func (m *EventMonitor) Unwatch(ibRes *IBRes) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for qpNum, watched := range m.qps {
+		if watched == ibRes {
+			delete(m.qps, qpNum)
+		}
+	}
+}
+
+// OnEvent adds a callback, it runs on the monitor goroutine and must not block.
+func (m *EventMonitor) OnEvent(fn func(AsyncEvent)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.handlers = append(m.handlers, fn)
+}
+
+// Events returns the event channel. Events are dropped when nobody drains it.
+func (m *EventMonitor) Events() <-chan AsyncEvent {
+	return m.events
+}
+
+// Dropped returns the number of events that did not fit into the channel.
+func (m *EventMonitor) Dropped() uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.dropped
+}
+
+// Close stops the goroutine, closing the device stops it as well.
+func (m *EventMonitor) Close() {
+	m.res.Close()
+}
+
+func (m *EventMonitor) shutdown() error {
+	close(m.stop)
+	<-m.done
+	close(m.events)
+	return nil
+}
+
+func (m *EventMonitor) run() {
+	defer close(m.done)
+	var info C.struct_async_event_info
+	for {
+		select {
+		case <-m.stop:
+			return
+		default:
+		}
+
+		res, err := C.ibv_get_async_event_timeout(m.ctx, EVENT_POLL_TIMEOUT_MS, &info)
+		if res < 0 {
+			m.log.Error("[EventMonitor] failed to get async event", err)
+			select {
+			case <-m.stop:
+				return
+			case <-time.After(EVENT_POLL_TIMEOUT_MS * time.Millisecond):
+			}
+			continue
+		}
+		if res == 0 {
+			continue
+		}
+
+		event := AsyncEvent{
+			Type:   AsyncEventType(info.event_type),
+			Device: m.device,
+			QPNum:  uint32(info.qp_num),
+			Port:   int(info.port_num),
+			Time:   time.Now(),
+		}
+		m.dispatch(event, info.cq, info.srq)
+	}
+}
+
+func (m *EventMonitor) dispatch(event AsyncEvent, cq *C.struct_ibv_cq, srq *C.struct_ibv_srq) {
+	if event.IsFatal() {
+		m.log.Error("[EventMonitor] fatal async event", nil, "event", event.Type.String(), "qp_num", event.QPNum, "port", event.Port)
+	} else if m.log.DebugEnabled() {
+		m.log.Debug("[EventMonitor] async event", "event", event.Type.String(), "qp_num", event.QPNum, "port", event.Port)
+	}
+
+	m.mu.Lock()
+	switch event.Type {
+	case EVENT_QP_FATAL, EVENT_QP_REQ_ERR, EVENT_QP_ACCESS_ERR, EVENT_PATH_MIG_ERR:
+		if ibRes, ok := m.qps[event.QPNum]; ok {
+			ibRes.MarkFailed(event.Type)
+		}
+	case EVENT_PORT_ERR:
+		for _, ibRes := range m.qps {
+			if event.Port == ibRes.Port {
+				ibRes.MarkFailed(event.Type)
+			}
+		}
+	case EVENT_CQ_ERR:
+		for _, ibRes := range m.qps {
+			if ibRes.Cq == cq {
+				ibRes.MarkFailed(event.Type)
+			}
+		}
+	case EVENT_DEVICE_FATAL:
+		for _, ibRes := range m.qps {
+			ibRes.MarkFailed(event.Type)
+		}
+	case EVENT_SRQ_ERR:
+		for _, ibRes := range m.qps {
+			if ibRes.Srq == srq {
+				ibRes.MarkFailed(event.Type)
+			}
+		}
+	}
+	handlers := append([]func(AsyncEvent){}, m.handlers...)
+	select {
+	case m.events <- event:
+	default:
+		m.dropped++
+	}
+	m.mu.Unlock()
+
+	if event.Type == EVENT_SRQ_LIMIT_REACHED {
+		if managed := lookupManagedSRQ(srq); managed != nil {
+			if err := managed.HandleLimitReached(); err != nil {
+				m.log.Error("[EventMonitor] refill SRQ failed", err)
+			}
+		}
+	}
+	for _, fn := range handlers {
+		fn(event)
+	}
+}
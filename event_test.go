@@ -0,0 +1,48 @@
+package RDMAGO
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestEventMonitorUnwatch(t *testing.T) {
+	// QPs are destroyed before Unwatch, Qp is nil for all of them
+	a, b := &IBRes{}, &IBRes{}
+	tests := []struct {
+		name  string
+		qps   map[uint32]*IBRes
+		ibRes *IBRes
+		want  int
+	}{
+		{"watched", map[uint32]*IBRes{7: a, 9: b}, a, 1},
+		{"not watched", map[uint32]*IBRes{9: b}, a, 1},
+		{"empty", map[uint32]*IBRes{}, a, 0},
+	}
+	for _, tt := range tests {
+		m := &EventMonitor{qps: tt.qps}
+		m.Unwatch(tt.ibRes)
+		if len(m.qps) != tt.want {
+			t.Errorf("%v: %v QPs watched, want %v", tt.name, len(m.qps), tt.want)
+		}
+		for _, watched := range m.qps {
+			if watched == tt.ibRes {
+				t.Errorf("%v: still watched", tt.name)
+			}
+		}
+	}
+}
+
+func TestFailedIsQPState(t *testing.T) {
+	ibRes := &IBRes{}
+	if err := ibRes.Failed(); err != nil {
+		t.Fatalf("Failed before MarkFailed: %v", err)
+	}
+	ibRes.MarkFailed(EVENT_QP_FATAL)
+	if err := ibRes.Failed(); !errors.Is(err, ErrQPState) {
+		t.Errorf("Failed = %v, want ErrQPState", err)
+	}
+	ibRes.ClearFailed()
+	if err := ibRes.Failed(); err != nil {
+		t.Errorf("Failed after ClearFailed: %v", err)
+	}
+}
@@ -18,6 +18,8 @@ func main() {
 	}
 
 	RDMA.InitLog(config.Debug)
+	RDMA.TrackResources(config.TrackResources)
+	defer RDMA.ReportLeaks()
 
 	RDMA.LogInfo("InitIBRes start")
 
@@ -28,6 +30,14 @@ func main() {
 	}
 	defer ibRes.FreeIBRes()
 
+	ibRes.SetSendOptions(config.MaxInlineData, config.SignalInterval)
+	ibRes.SetSRQOptions(RDMA.SRQOptions{
+		MaxWR:   config.SRQMaxWR,
+		Depth:   config.SRQDepth,
+		Buffers: config.SRQBuffers,
+		Limit:   config.SRQLimit,
+	})
+
 	qpInfo, err := ibRes.InitRCQP(config.DeviceName, config.MrSize)
 	if err != nil {
 		RDMA.LogError("InitRCQP Error: ", err)
@@ -40,6 +50,16 @@ func main() {
 		}
 	}(ibRes)
 
+	monitor, err := RDMA.StartEventMonitor(ibRes)
+	if err != nil {
+		RDMA.LogError("StartEventMonitor Error: ", err)
+		return
+	}
+	defer monitor.Close()
+	monitor.OnEvent(func(event RDMA.AsyncEvent) {
+		RDMA.LogInfo(fmt.Sprintf("async event: %v", event))
+	})
+
 	info, err := RDMA.ConmunicateQPInfo(config, qpInfo)
 	if err != nil {
 		RDMA.LogError("ConmunicateQPInfo Error: ", err)
@@ -0,0 +1,118 @@
+-- Wireshark dissector for captures written by RDMAGO (capture_file / CreateCapture).
+-- The records use link type LINKTYPE_USER0, see capture.go for the layout.
+--
+--   wireshark -X lua_script:example/rdmago.lua capture.pcapng
+
+local rdmago = Proto("rdmago", "RDMAGO operation")
+
+local record_types = {
+    [1] = "Post send",
+    [2] = "Post recv",
+    [3] = "Completion",
+    [4] = "Handshake sent",
+    [5] = "Handshake received",
+}
+
+local wr_opcodes = {
+    [0] = "RDMA_WRITE", [1] = "RDMA_WRITE_WITH_IMM", [2] = "SEND", [3] = "SEND_WITH_IMM",
+    [4] = "RDMA_READ", [5] = "ATOMIC_CMP_AND_SWP", [6] = "ATOMIC_FETCH_AND_ADD",
+}
+
+local wc_opcodes = {
+    [0] = "SEND", [1] = "RDMA_WRITE", [2] = "RDMA_READ", [3] = "COMP_SWAP", [4] = "FETCH_ADD",
+    [5] = "BIND_MW", [6] = "LOCAL_INV", [128] = "RECV", [129] = "RECV_RDMA_WITH_IMM",
+}
+
+local wc_status = {
+    [0] = "SUCCESS", [1] = "LOC_LEN_ERR", [2] = "LOC_QP_OP_ERR", [3] = "LOC_EEC_OP_ERR",
+    [4] = "LOC_PROT_ERR", [5] = "WR_FLUSH_ERR", [6] = "MW_BIND_ERR", [7] = "BAD_RESP_ERR",
+    [8] = "LOC_ACCESS_ERR", [9] = "REM_INV_REQ_ERR", [10] = "REM_ACCESS_ERR", [11] = "REM_OP_ERR",
+    [12] = "RETRY_EXC_ERR", [13] = "RNR_RETRY_EXC_ERR", [14] = "LOC_RDD_VIOL_ERR",
+    [15] = "REM_INV_RD_REQ_ERR", [16] = "REM_ABORT_ERR", [17] = "INV_EECN_ERR",
+    [18] = "INV_EEC_STATE_ERR", [19] = "FATAL_ERR", [20] = "RESP_TIMEOUT_ERR", [21] = "GENERAL_ERR",
+}
+
+local f = rdmago.fields
+f.version = ProtoField.uint8("rdmago.version", "Version")
+f.type = ProtoField.uint8("rdmago.type", "Record type", base.DEC, record_types)
+f.opcode = ProtoField.uint8("rdmago.opcode", "Opcode")
+f.status = ProtoField.uint8("rdmago.status", "Status", base.DEC, wc_status)
+f.qp_num = ProtoField.uint32("rdmago.qp_num", "QP number")
+f.peer_qp_num = ProtoField.uint32("rdmago.peer_qp_num", "Peer QP number")
+f.imm = ProtoField.uint32("rdmago.imm", "Immediate data", base.HEX)
+f.length = ProtoField.uint32("rdmago.length", "Length")
+f.flags = ProtoField.uint32("rdmago.flags", "Flags", base.HEX)
+f.signaled = ProtoField.bool("rdmago.flags.signaled", "Signaled", 32, nil, 0x1)
+f.inline = ProtoField.bool("rdmago.flags.inline", "Inline", 32, nil, 0x2)
+f.has_imm = ProtoField.bool("rdmago.flags.imm", "With immediate", 32, nil, 0x4)
+f.wr_id = ProtoField.uint64("rdmago.wr_id", "wr_id", base.HEX)
+f.grant = ProtoField.uint32("rdmago.credit_grant", "Credit grant")
+f.frame_flags = ProtoField.uint8("rdmago.frame_flags", "Frame flags", base.HEX)
+f.payload = ProtoField.bytes("rdmago.payload", "Payload")
+f.handshake = ProtoField.string("rdmago.handshake", "Handshake")
+
+local HEADER_SIZE = 32
+local ENDPOINT_HEADER_SIZE = 5
+
+function rdmago.dissector(tvb, pinfo, tree)
+    if tvb:len() < HEADER_SIZE then
+        return 0
+    end
+    pinfo.cols.protocol = "RDMAGO"
+
+    local typ = tvb(1, 1):uint()
+    local opcode = tvb(2, 1):uint()
+    local status = tvb(3, 1):uint()
+    local subtree = tree:add(rdmago, tvb(), "RDMAGO " .. (record_types[typ] or "record"))
+    subtree:add_le(f.version, tvb(0, 1))
+    subtree:add_le(f.type, tvb(1, 1))
+
+    local opname
+    if typ == 1 then
+        opname = wr_opcodes[opcode]
+    elseif typ == 3 then
+        opname = wc_opcodes[opcode]
+    end
+    subtree:add_le(f.opcode, tvb(2, 1)):append_text(opname and (" (" .. opname .. ")") or "")
+    if typ == 3 then
+        subtree:add_le(f.status, tvb(3, 1))
+    end
+    subtree:add_le(f.qp_num, tvb(4, 4))
+    subtree:add_le(f.peer_qp_num, tvb(8, 4))
+    subtree:add_le(f.imm, tvb(12, 4))
+    subtree:add_le(f.length, tvb(16, 4))
+    local flags = subtree:add_le(f.flags, tvb(20, 4))
+    flags:add_le(f.signaled, tvb(20, 4))
+    flags:add_le(f.inline, tvb(20, 4))
+    flags:add_le(f.has_imm, tvb(20, 4))
+    subtree:add_le(f.wr_id, tvb(24, 8))
+
+    local info = (record_types[typ] or "?") .. " qp " .. tvb(4, 4):le_uint()
+    if opname then
+        info = info .. " " .. opname
+    end
+    if typ == 3 and status ~= 0 then
+        info = info .. " " .. (wc_status[status] or status)
+    end
+    info = info .. " len " .. tvb(16, 4):le_uint()
+
+    local rest = tvb:len() - HEADER_SIZE
+    if rest > 0 then
+        local payload = tvb(HEADER_SIZE, rest)
+        if typ == 4 or typ == 5 then
+            subtree:add(f.handshake, payload)
+            info = info .. " " .. payload:string()
+        else
+            -- Endpoint frames start with the credit grant and the frame flags
+            if rest >= ENDPOINT_HEADER_SIZE and (typ == 1 or (typ == 3 and opcode >= 128)) then
+                subtree:add_le(f.grant, tvb(HEADER_SIZE, 4))
+                subtree:add_le(f.frame_flags, tvb(HEADER_SIZE + 4, 1))
+            end
+            subtree:add(f.payload, payload)
+        end
+    end
+    pinfo.cols.info = info
+    return tvb:len()
+end
+
+DissectorTable.get("wtap_encap"):add(wtap.USER0, rdmago)
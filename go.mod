@@ -2,6 +2,14 @@ module github.com/trinet2005/RDMA-GO
 
 go 1.20
 
-require go.uber.org/zap v1.27.0
+require (
+	go.opentelemetry.io/otel v1.11.1
+	go.opentelemetry.io/otel/trace v1.11.1
+	go.uber.org/zap v1.27.0
+)
 
-require go.uber.org/multierr v1.10.0 // indirect
+require (
+	github.com/go-logr/logr v1.2.3 // indirect
+	github.com/go-logr/stdr v1.2.2 // indirect
+	go.uber.org/multierr v1.10.0 // indirect
+)
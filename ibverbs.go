@@ -4,6 +4,7 @@ import "C"
 import (
 	"errors"
 	"fmt"
+	"syscall"
 	"unsafe"
 )
 
@@ -33,9 +34,9 @@ func GetIbvDeviceContext(ibRes *IBRes, deviceName string) (IbvDeviceContext, err
 
 	// get device list
 	var numDevices C.int
-	devList := C.ibv_get_device_list(&numDevices)
+	devList, err := C.ibv_get_device_list(&numDevices)
 	if devList == nil {
-		return res, errors.New("no RDMA devices found")
+		return res, newVerbsError("ibv_get_device_list", "", ErrNoDevice, 0, err)
 	}
 	defer C.ibv_free_device_list(devList)
 
@@ -54,52 +55,70 @@ func GetIbvDeviceContext(ibRes *IBRes, deviceName string) (IbvDeviceContext, err
 	}
 
 	if targetDevice == nil {
-		return res, errors.New(fmt.Sprintf("No RDMA device found with name %s\n", deviceName))
+		return res, &VerbsError{Op: "ibv_get_device_list", Resource: "device " + deviceName, Kind: ErrNoDevice}
 	}
 
 	// get device context
-	context := C.ibv_open_device(targetDevice)
+	context, err := C.ibv_open_device(targetDevice)
 	if context == nil {
-		return res, errors.New("failed to open device")
+		return res, newVerbsError("ibv_open_device", "device "+deviceName, nil, 0, err)
 	}
 
-	res.Ctx = context
-
 	// query device attributes
 	var deviceAttr C.struct_ibv_device_attr
-	if err := C.ibv_query_device(context, &deviceAttr); err != 0 {
-		return res, errors.New("failed to query device")
+	if ret := C.ibv_query_device(context, &deviceAttr); ret != 0 {
+		C.ibv_close_device(context)
+		return res, newVerbsError("ibv_query_device", "device "+deviceName, nil, int(ret), nil)
 	}
 
+	res.Ctx = context
+	ibRes.DevAttr = deviceAttr
+	ibRes.deviceName = deviceName
+	ibRes.resources.device = newResource("device", deviceName, func() error {
+		ret, err := C.ibv_close_device(context)
+		if ret != 0 {
+			return newVerbsError("ibv_close_device", "device "+deviceName, nil, int(ret), err)
+		}
+		ibRes.Ctx = nil
+		return nil
+	})
+	ibRes.resources.device.setDescribe(func() map[string]interface{} {
+		return map[string]interface{}{
+			"fw_ver":  C.GoString(&ibRes.DevAttr.fw_ver[0]),
+			"max_qp":  int(ibRes.DevAttr.max_qp),
+			"max_mr":  int(ibRes.DevAttr.max_mr),
+			"max_cqe": int(ibRes.DevAttr.max_cqe),
+		}
+	})
 	return res, nil
 }
 
+// IbvCloseDevice closes the device and everything created on it.
 func IbvCloseDevice(ibRes *IBRes) error {
-	_, err := C.ibv_close_device(ibRes.Ctx)
-	if err != nil {
-		return errors.New(fmt.Sprintf("failed to close device: %v", err))
-	}
-	return nil
+	return ibRes.resources.device.Close()
 }
 
 func IbvAllocPD(ibRes *IBRes) error {
 	pd, err := C.ibv_alloc_pd(ibRes.Ctx)
-	if err != nil {
-		return errors.New(fmt.Sprintf("failed to allocate protection domain: %v", err))
-	}
 	if pd == nil {
-		return errors.New("failed to allocate protection domain")
+		return newVerbsError("ibv_alloc_pd", deviceResource(ibRes.Ctx), nil, 0, err)
 	}
 	ibRes.Pd = pd
+	device := deviceResource(ibRes.Ctx)
+	ibRes.resources.pd = newResource("PD", "", func() error {
+		ret, err := C.ibv_dealloc_pd(pd)
+		if ret != 0 {
+			return newVerbsError("ibv_dealloc_pd", device, nil, int(ret), err)
+		}
+		ibRes.Pd = nil
+		return nil
+	}, ibRes.resources.device)
 	return nil
 }
 
+// IbvDeallocPD deallocates the PD after the MRs, SRQs and QPs created on it.
 func IbvDeallocPD(ibRes *IBRes) error {
-	_, err := C.ibv_dealloc_pd(ibRes.Pd)
-	if err != nil {
-		return errors.New(fmt.Sprintf("failed to deallocate protection domain: %v", err))
-	}
-	return nil
+	return ibRes.resources.pd.Close()
 }
 
 // IbvQueryGid queries the GID of the specified port.
@@ -108,11 +127,13 @@ func IbvDeallocPD(ibRes *IBRes) error {
 // index：用于多个 GID 的索引值，表示要查询的具体 GID。
 // gid：用于存储查询结果的 union ibv_gid 结构体或其指针。
 func IbvQueryGid(ibRes *IBRes) error {
-	//index 固定为1选择index的值
-	_, err := C.ibv_query_gid(ibRes.Ctx, IB_PORT, 1, &ibRes.Gid)
-	if err != nil {
-		return errors.New(fmt.Sprintf("failed to query device: %v", err))
+	// port 与 index 由 SetAddress 选择
+	ret, err := C.ibv_query_gid(ibRes.Ctx, C.uint8_t(ibRes.Port), C.int(ibRes.GidIndex), &ibRes.Gid)
+	if ret != 0 {
+		return newVerbsError("ibv_query_gid", fmt.Sprintf("%v port %v gid index %v", deviceResource(ibRes.Ctx),
+			ibRes.Port, ibRes.GidIndex), nil, int(ret), err)
 	}
+	ibRes.gidType = gidType(ibRes.deviceName, ibRes.Port, ibRes.GidIndex, ibRes.PortAttr.link_layer).String()
 	return nil
 }
 
@@ -125,132 +146,275 @@ func IbvRegMR(ibRes *IBRes, IbBufSize int) error {
 	if ibRes.IbBuf == nil {
 		return errors.New("failed to allocate memory")
 	}
+	ibRes.resources.buf = newResource("buffer", fmt.Sprintf("%v bytes", IbBufSize), func() error {
+		C.free(ptr)
+		ibRes.IbBuf = nil
+		return nil
+	})
 
-	mr, err := C.ibv_reg_mr(ibRes.Pd, unsafe.Pointer(ibRes.IbBuf), ibRes.IbBufSize,
-		C.IBV_ACCESS_LOCAL_WRITE|
-			C.IBV_ACCESS_REMOTE_WRITE|
-			C.IBV_ACCESS_REMOTE_READ)
-	if err != nil {
-		return errors.New(fmt.Sprintf("failed to allocate memory region: %v", err))
-	}
+	access := C.IBV_ACCESS_LOCAL_WRITE |
+		C.IBV_ACCESS_REMOTE_WRITE |
+		C.IBV_ACCESS_REMOTE_READ
+	mr, err := C.ibv_reg_mr(ibRes.Pd, unsafe.Pointer(ibRes.IbBuf), ibRes.IbBufSize, C.int(access))
 	if mr == nil {
-		return errors.New("failed to allocate memory region")
+		return newVerbsError("ibv_reg_mr", deviceResource(ibRes.Ctx), nil, 0, err)
 	}
 	ibRes.Mr = mr
+	device := deviceResource(ibRes.Ctx)
+	ibRes.resources.mr = newResource("MR", fmt.Sprintf("lkey %#x", uint32(mr.lkey)), func() error {
+		ret, err := C.ibv_dereg_mr(mr)
+		if ret != 0 {
+			return newVerbsError("ibv_dereg_mr", device, nil, int(ret), err)
+		}
+		ibRes.Mr = nil
+		return nil
+	}, ibRes.resources.pd, ibRes.resources.buf)
+	ibRes.resources.mr.setDescribe(func() map[string]interface{} {
+		return map[string]interface{}{
+			"length": uint64(mr.length),
+			"lkey":   uint32(mr.lkey),
+			"rkey":   uint32(mr.rkey),
+			"access": accessFlagNames(access),
+		}
+	})
 	return nil
 }
 
 func IbvDeregMR(ibRes *IBRes) error {
-	_, err := C.ibv_dereg_mr(ibRes.Mr)
-	if err != nil {
-		return errors.New(fmt.Sprintf("failed to deallocate memory region: %v", err))
-	}
-	return nil
+	return ibRes.resources.mr.Close()
 }
 
 func IbvQueryDevice(ibRes *IBRes) error {
-	_, err := C.ibv_query_device(ibRes.Ctx, &ibRes.DevAttr)
-	if err != nil {
-		return errors.New(fmt.Sprintf("failed to query device: %v", err))
+	ret, err := C.ibv_query_device(ibRes.Ctx, &ibRes.DevAttr)
+	if ret != 0 {
+		return newVerbsError("ibv_query_device", deviceResource(ibRes.Ctx), nil, int(ret), err)
 	}
 	return nil
 }
 
 func IbvCreateCQ(ibRes *IBRes) error {
 	cq, err := C.ibv_create_cq(ibRes.Ctx, ibRes.DevAttr.max_cqe, nil, nil, 0)
-	if err != nil {
-		return errors.New(fmt.Sprintf("failed to create completion queue: %v", err))
-	}
 	if cq == nil {
-		return errors.New("failed to create completion queue")
+		return newVerbsError("ibv_create_cq", deviceResource(ibRes.Ctx), nil, 0, err)
 	}
 	ibRes.Cq = cq
+	device := deviceResource(ibRes.Ctx)
+	ibRes.resources.cq = newResource("CQ", "", func() error {
+		ret, err := C.ibv_destroy_cq(cq)
+		if ret != 0 {
+			return newVerbsError("ibv_destroy_cq", device, nil, int(ret), err)
+		}
+		ibRes.Cq = nil
+		return nil
+	}, ibRes.resources.device)
+	ibRes.resources.cq.setDescribe(func() map[string]interface{} {
+		return map[string]interface{}{"cqe": int(cq.cqe)}
+	})
 	return nil
 }
 
+// IbvDestroyCQ destroys the CQ after the QPs using it.
 func IbvDestroyCQ(ibRes *IBRes) error {
-	_, err := C.ibv_destroy_cq(ibRes.Cq)
-	if err != nil {
-		return errors.New(fmt.Sprintf("failed to destroy completion queue: %v", err))
-	}
-	return nil
+	return ibRes.resources.cq.Close()
 }
 
+// IbvCreateSRQ creates the SRQ with SRQMaxWR entries (device maximum when unset).
+// The limit event is armed separately by IbvModifySRQLimit once receives are posted.
 func IbvCreateSRQ(ibRes *IBRes) error {
+	maxWR := (C.uint)(ibRes.DevAttr.max_srq_wr)
+	if ibRes.SRQMaxWR > 0 && ibRes.SRQMaxWR < maxWR {
+		maxWR = ibRes.SRQMaxWR
+	}
 	attr := C.struct_ibv_srq_init_attr{
 		attr: C.struct_ibv_srq_attr{
-			max_wr:    (C.uint)(ibRes.DevAttr.max_srq_wr),
-			max_sge:   0,
+			max_wr:    maxWR,
+			max_sge:   1,
 			srq_limit: 0,
 		},
 	}
 
 	srq, err := C.ibv_create_srq(ibRes.Pd, &attr)
-	if err != nil {
-		return errors.New(fmt.Sprintf("failed to create shared receive queue: %v", err))
-	}
 	if srq == nil {
-		return errors.New("failed to create shared receive queue")
+		return newVerbsError("ibv_create_srq", deviceResource(ibRes.Ctx), nil, 0, err)
 	}
 	ibRes.Srq = srq
+	device := deviceResource(ibRes.Ctx)
+	ibRes.resources.srq = newResource("SRQ", "", func() error {
+		ret, err := C.ibv_destroy_srq(srq)
+		if ret != 0 {
+			return newVerbsError("ibv_destroy_srq", device, nil, int(ret), err)
+		}
+		ibRes.Srq = nil
+		return nil
+	}, ibRes.resources.pd)
+	ibRes.resources.srq.setDescribe(func() map[string]interface{} {
+		return map[string]interface{}{"max_wr": uint32(attr.attr.max_wr)}
+	})
 
 	return nil
 }
 
-func IbvDestroySRQ(ibRes *IBRes) error {
-	_, err := C.ibv_destroy_srq(ibRes.Srq)
-	if err != nil {
-		return errors.New(fmt.Sprintf("failed to destroy shared receive queue: %v", err))
+// IbvModifySRQLimit arms the SRQ limit: IBV_EVENT_SRQ_LIMIT_REACHED is raised once when
+// fewer than limit receives are left in the SRQ, after which the limit must be armed again.
+func IbvModifySRQLimit(srq *C.struct_ibv_srq, limit C.uint) error {
+	attr := C.struct_ibv_srq_attr{
+		srq_limit: limit,
+	}
+	res := C.ibv_modify_srq(srq, &attr, C.IBV_SRQ_LIMIT)
+	if res != 0 {
+		return newVerbsError("ibv_modify_srq", "", nil, int(res), nil)
 	}
 	return nil
 }
 
+// IbvDestroySRQ destroys the SRQ after the QPs attached to it.
+func IbvDestroySRQ(ibRes *IBRes) error {
+	return ibRes.resources.srq.Close()
+}
+
 func IbvCreateQP(ibRes *IBRes) error {
 	attr := C.struct_ibv_qp_init_attr{
 		send_cq: ibRes.Cq,
 		recv_cq: ibRes.Cq,
 		srq:     ibRes.Srq,
 		cap: C.struct_ibv_qp_cap{
-			max_send_wr:  (C.uint)(ibRes.DevAttr.max_qp_wr),
-			max_recv_wr:  (C.uint)(ibRes.DevAttr.max_qp_wr),
-			max_send_sge: 1,
-			max_recv_sge: 1,
+			max_send_wr:     (C.uint)(ibRes.DevAttr.max_qp_wr),
+			max_recv_wr:     (C.uint)(ibRes.DevAttr.max_qp_wr),
+			max_send_sge:    1,
+			max_recv_sge:    1,
+			max_inline_data: ibRes.MaxInlineData,
 		},
-		qp_type: C.IBV_QPT_RC,
+		qp_type: ibRes.qpType.verbs(),
 	}
 
 	qp, err := C.ibv_create_qp(ibRes.Pd, &attr)
-	if err != nil {
-		return errors.New(fmt.Sprintf("failed to create queue pair: %v", err))
-	}
 	if qp == nil {
-		return errors.New("failed to create queue pair")
+		return newVerbsError("ibv_create_qp", deviceResource(ibRes.Ctx), nil, 0, err)
 	}
-	ibRes.Qp = qp
 
-	return nil
+	// ibv_create_qp writes the capabilities actually granted back into attr.cap
+	if attr.cap.max_inline_data < ibRes.MaxInlineData {
+		C.ibv_destroy_qp(qp)
+		return &VerbsError{Op: "ibv_create_qp", Resource: deviceResource(ibRes.Ctx), Errno: syscall.EINVAL,
+			Kind: errors.New(fmt.Sprintf("max_inline_data %v not supported, device granted %v",
+				ibRes.MaxInlineData, attr.cap.max_inline_data))}
+	}
+	ibRes.Qp = qp
+	ibRes.MaxInlineData = attr.cap.max_inline_data
+	ibRes.MaxSendWR = attr.cap.max_send_wr
+	ibRes.resources.qp = newResource("QP", fmt.Sprint(uint32(qp.qp_num)), func() error {
+		ret, err := C.ibv_destroy_qp(qp)
+		if ret != 0 {
+			return newVerbsError("ibv_destroy_qp", qpResource(qp), nil, int(ret), err)
+		}
+		freeSendSlots(ibRes)
+		ibRes.Qp = nil
+		return nil
+	}, ibRes.resources.pd, ibRes.resources.cq, ibRes.resources.srq)
+	ibRes.resources.qp.setDescribe(func() map[string]interface{} {
+		return describeQP(qp)
+	})
+
+	return initSendSlots(ibRes)
 }
 
 func IbvDestroyQP(ibRes *IBRes) error {
-	_, err := C.ibv_destroy_qp(ibRes.Qp)
+	return ibRes.resources.qp.Close()
+}
+
+// IbvQueryQP queries the attributes of qp selected by mask, and its capabilities.
+func IbvQueryQP(qp *C.struct_ibv_qp, mask C.int) (C.struct_ibv_qp_attr, C.struct_ibv_qp_init_attr, error) {
+	var attr C.struct_ibv_qp_attr
+	var initAttr C.struct_ibv_qp_init_attr
+	ret, err := C.ibv_query_qp(qp, &attr, mask, &initAttr)
+	if ret != 0 {
+		return attr, initAttr, newVerbsError("ibv_query_qp", qpResource(qp), nil, int(ret), err)
+	}
+	return attr, initAttr, nil
+}
+
+var qpStateNamesVerbs = map[C.enum_ibv_qp_state]string{C.IBV_QPS_RESET: "RESET", C.IBV_QPS_INIT: "INIT",
+	C.IBV_QPS_RTR: "RTR", C.IBV_QPS_RTS: "RTS", C.IBV_QPS_SQD: "SQD", C.IBV_QPS_SQE: "SQE", C.IBV_QPS_ERR: "ERR"}
+
+func describeQP(qp *C.struct_ibv_qp) map[string]interface{} {
+	attr, initAttr, err := IbvQueryQP(qp, C.IBV_QP_STATE|C.IBV_QP_PATH_MTU|C.IBV_QP_RQ_PSN|C.IBV_QP_SQ_PSN|
+		C.IBV_QP_DEST_QPN|C.IBV_QP_PORT|C.IBV_QP_CAP)
 	if err != nil {
-		return errors.New(fmt.Sprintf("failed to destroy queue pair: %v", err))
+		return map[string]interface{}{"qp_num": uint32(qp.qp_num), "error": err.Error()}
+	}
+	state, ok := qpStateNamesVerbs[attr.qp_state]
+	if !ok {
+		state = fmt.Sprint(attr.qp_state)
+	}
+	pathMTU := 0
+	if attr.path_mtu != 0 {
+		pathMTU = 128 << uint(attr.path_mtu) // IBV_MTU_256 is 1
+	}
+	return map[string]interface{}{
+		"qp_num":          uint32(qp.qp_num),
+		"state":           state,
+		"dest_qp_num":     uint32(attr.dest_qp_num),
+		"rq_psn":          uint32(attr.rq_psn),
+		"sq_psn":          uint32(attr.sq_psn),
+		"path_mtu":        pathMTU,
+		"port":            int(attr.port_num),
+		"max_send_wr":     uint32(initAttr.cap.max_send_wr),
+		"max_inline_data": uint32(initAttr.cap.max_inline_data),
 	}
-	return nil
+}
+
+func accessFlagNames(access int) []string {
+	names := []string{}
+	for _, flag := range []struct {
+		bit  int
+		name string
+	}{
+		{C.IBV_ACCESS_LOCAL_WRITE, "LOCAL_WRITE"},
+		{C.IBV_ACCESS_REMOTE_WRITE, "REMOTE_WRITE"},
+		{C.IBV_ACCESS_REMOTE_READ, "REMOTE_READ"},
+		{C.IBV_ACCESS_REMOTE_ATOMIC, "REMOTE_ATOMIC"},
+	} {
+		if access&flag.bit != 0 {
+			names = append(names, flag.name)
+		}
+	}
+	return names
 }
 
 func IbvModifyQP(qp *C.struct_ibv_qp, attr *C.struct_ibv_qp_attr, mask C.int) error {
 	res, err := C.ibv_modify_qp(qp, attr, mask)
-	if err != nil {
-		return errors.New(fmt.Sprintf("failed to modify qp: %v ,res :%v", err, res))
-	}
 	if res != 0 {
-		return errors.New("failed to modify qp")
+		return modifyQPError(qp, attr, int(res), err)
 	}
 	return nil
 }
 
+// modifyQPError reports a failed transition, EINVAL there means the QP was not in a state
+// the transition starts from or the attributes do not fit it.
+func modifyQPError(qp *C.struct_ibv_qp, attr *C.struct_ibv_qp_attr, res int, cerr error) error {
+	e := newVerbsError("ibv_modify_qp", qpResource(qp), nil, res, cerr)
+	e.Resource += fmt.Sprintf(" to state %d", int(attr.qp_state))
+	if e.Errno == syscall.EINVAL {
+		e.Kind = ErrQPState
+	}
+	return e
+}
+
+// IbvModifyQPState moves the QP to a state that needs no other attributes: RESET to
+// recycle it, ERR to flush every outstanding WR.
+func IbvModifyQPState(qp *C.struct_ibv_qp, state C.enum_ibv_qp_state) error {
+	attr := C.struct_ibv_qp_attr{
+		qp_state: state,
+	}
+	return IbvModifyQP(qp, &attr, C.IBV_QP_STATE)
+}
+
 func IbvModifyQPInit(qp *C.struct_ibv_qp) error {
+	return IbvModifyQPInitPort(qp, IBV_PORT_NUM)
+}
+
+// IbvModifyQPInitPort is IbvModifyQPInit on port.
+func IbvModifyQPInitPort(qp *C.struct_ibv_qp, port int) error {
 	attr := (*C.struct_ibv_qp_attr)(C.malloc(C.size_t(unsafe.Sizeof(C.struct_ibv_qp_attr{}))))
 	if attr == nil {
 		return errors.New("failed to allocate memory")
@@ -262,11 +426,15 @@ func IbvModifyQPInit(qp *C.struct_ibv_qp) error {
 	// init attributes
 	attr.qp_state = C.IBV_QPS_INIT
 	attr.pkey_index = 0
-	attr.port_num = IBV_PORT_NUM
+	attr.port_num = C.uint8_t(port)
 	attr.qp_access_flags = C.IBV_ACCESS_LOCAL_WRITE |
 		C.IBV_ACCESS_REMOTE_WRITE |
 		C.IBV_ACCESS_REMOTE_READ |
 		C.IBV_ACCESS_REMOTE_ATOMIC
+	if qp.qp_type == C.IBV_QPT_UC {
+		// UC has neither RDMA read nor atomics
+		attr.qp_access_flags = C.IBV_ACCESS_LOCAL_WRITE | C.IBV_ACCESS_REMOTE_WRITE
+	}
 
 	err := IbvModifyQP(qp, attr, C.IBV_QP_STATE|
 		C.IBV_QP_PKEY_INDEX|
@@ -280,23 +448,28 @@ func IbvModifyQPInit(qp *C.struct_ibv_qp) error {
 }
 
 func IbvModifyQPRTRDefault(qp *C.struct_ibv_qp, targetQPNum C.uint, targetLid C.ushort, rGid C.union_ibv_gid) error {
+	return IbvModifyQPRTRAddress(qp, targetQPNum, IBVAHAttr{
+		dlid:         targetLid,
+		grhDgid:      rGid,
+		isGlobal:     1,
+		grhHopLimit:  1,
+		grhSgidIndex: 1,
+		SL:           0,
+		srcPathBits:  0,
+		portNum:      IBV_PORT_NUM,
+	})
+}
+
+// IbvModifyQPRTRAddress moves the QP to RTR towards targetQPNum, ahAttr is the address
+// vector built for the local port, see addressVector.
+func IbvModifyQPRTRAddress(qp *C.struct_ibv_qp, targetQPNum C.uint, ahAttr IBVAHAttr) error {
 	qpAttr := IBVQPAttr{
 		destQPNum:       targetQPNum,
 		pathMTU:         C.IBV_MTU_4096,
 		RQPsn:           0,
 		maxDestRDAtomic: 1,
 		minRNRTimer:     12,
-
-		ahAttr: IBVAHAttr{
-			dlid:         targetLid,
-			grhDgid:      rGid,
-			isGlobal:     1,
-			grhHopLimit:  1,
-			grhSgidIndex: 1,
-			SL:           0,
-			srcPathBits:  0,
-			portNum:      IBV_PORT_NUM,
-		},
+		ahAttr:          ahAttr,
 	}
 	return IbvModifyQPRTR(qp, qpAttr)
 
@@ -318,31 +491,45 @@ func IbvModifyQPRTR(qp *C.struct_ibv_qp, qpAttr IBVQPAttr) error {
 	attr.rq_psn = qpAttr.RQPsn
 	attr.max_dest_rd_atomic = qpAttr.maxDestRDAtomic
 	attr.min_rnr_timer = qpAttr.minRNRTimer
-	attr.ah_attr.is_global = qpAttr.ahAttr.isGlobal
-
-	attr.ah_attr.grh.hop_limit = qpAttr.ahAttr.grhHopLimit
-	attr.ah_attr.grh.dgid = qpAttr.ahAttr.grhDgid
-	attr.ah_attr.grh.sgid_index = qpAttr.ahAttr.grhSgidIndex
-
-	attr.ah_attr.dlid = qpAttr.ahAttr.dlid
-	attr.ah_attr.sl = qpAttr.ahAttr.SL
-	attr.ah_attr.src_path_bits = qpAttr.ahAttr.srcPathBits
-	attr.ah_attr.port_num = qpAttr.ahAttr.portNum
-
-	_, err := C.ibv_modify_qp_wrapper(qp, attr, C.IBV_QP_STATE|
-		C.IBV_QP_AV|
-		C.IBV_QP_PATH_MTU|
-		C.IBV_QP_DEST_QPN|
-		C.IBV_QP_RQ_PSN|
-		C.IBV_QP_MAX_DEST_RD_ATOMIC|
-		C.IBV_QP_MIN_RNR_TIMER)
-	if err != nil {
-		return err
+	qpAttr.ahAttr.fill(&attr.ah_attr)
+
+	mask := C.int(C.IBV_QP_STATE |
+		C.IBV_QP_AV |
+		C.IBV_QP_PATH_MTU |
+		C.IBV_QP_DEST_QPN |
+		C.IBV_QP_RQ_PSN)
+	if qp.qp_type != C.IBV_QPT_UC {
+		// UC QPs do not respond, so they take no responder resources or RNR timer
+		mask |= C.IBV_QP_MAX_DEST_RD_ATOMIC | C.IBV_QP_MIN_RNR_TIMER
+	}
+	res, err := C.ibv_modify_qp_wrapper(qp, attr, mask)
+	if res != 0 {
+		return modifyQPError(qp, attr, int(res), err)
 	}
 
 	return nil
 }
 
+// IbvModifyQPUD brings a UD QP from RESET to RTS. UD QPs have no peer, each send names
+// its destination with an address handle; qkey must match the senders' remote qkey.
+func IbvModifyQPUD(qp *C.struct_ibv_qp, port int, qkey uint32) error {
+	attr := C.struct_ibv_qp_attr{
+		qp_state:   C.IBV_QPS_INIT,
+		pkey_index: 0,
+		port_num:   C.uint8_t(port),
+		qkey:       C.uint32_t(qkey),
+	}
+	if err := IbvModifyQP(qp, &attr, C.IBV_QP_STATE|C.IBV_QP_PKEY_INDEX|C.IBV_QP_PORT|C.IBV_QP_QKEY); err != nil {
+		return err
+	}
+	attr = C.struct_ibv_qp_attr{qp_state: C.IBV_QPS_RTR}
+	if err := IbvModifyQP(qp, &attr, C.IBV_QP_STATE); err != nil {
+		return err
+	}
+	attr = C.struct_ibv_qp_attr{qp_state: C.IBV_QPS_RTS, sq_psn: 0}
+	return IbvModifyQP(qp, &attr, C.IBV_QP_STATE|C.IBV_QP_SQ_PSN)
+}
+
 func IbvModifyQPRTSDefault(qp *C.struct_ibv_qp) error {
 	qpAttr := IBVQPAttr{
 		timeout:     14,
@@ -379,6 +566,10 @@ func IbvModifyQPRTS(qp *C.struct_ibv_qp, qpAttr IBVQPAttr) error {
 
 	mask := (C.int)(C.IBV_QP_STATE | C.IBV_QP_TIMEOUT | C.IBV_QP_RETRY_CNT | C.IBV_QP_RNR_RETRY |
 		C.IBV_QP_SQ_PSN | C.IBV_QP_MAX_QP_RD_ATOMIC)
+	if qp.qp_type == C.IBV_QPT_UC {
+		// nothing is acknowledged on UC, so there is nothing to time out or retry
+		mask = C.IBV_QP_STATE | C.IBV_QP_SQ_PSN
+	}
 
 	err := IbvModifyQP(qp, attr, mask)
 	if err != nil {
@@ -389,15 +580,10 @@ func IbvModifyQPRTS(qp *C.struct_ibv_qp, qpAttr IBVQPAttr) error {
 }
 
 func IbvQueryPort(ibRes *IBRes, portNum int) error {
-
-	portAttr := (*C.struct_ibv_port_attr)(C.malloc(C.size_t(unsafe.Sizeof(C.struct_ibv_port_attr{}))))
-
-	res, err := C.ibv_query_port_wrapper(ibRes.Ctx, C.uint8_t(portNum), portAttr)
-	if err != nil {
-		return errors.New(fmt.Sprintf("failed to query port: %v", err))
-	}
+	var portAttr C.struct_ibv_port_attr
+	res, err := C.ibv_query_port_wrapper(ibRes.Ctx, C.uint8_t(portNum), &portAttr)
 	if res != 0 {
-		return errors.New("failed to query port")
+		return newVerbsError("ibv_query_port", fmt.Sprintf("%v port %v", deviceResource(ibRes.Ctx), portNum), nil, int(res), err)
 	}
 
 	ibRes.PortAttr = portAttr
@@ -428,15 +614,16 @@ func IbvPostSRQRecv(srq *C.struct_ibv_srq, wrID C.ulong, lkey, bufSize C.uint, b
 
 	defer C.free(unsafe.Pointer(recvWr))
 
-	_, err := C.ibv_post_srq_recv(srq, recvWr, &badRecvWr)
-	if err != nil {
-		return errors.New(fmt.Sprintf("[IbvPostSRQRecv] failed to post recv: %v", err))
+	res, err := C.ibv_post_srq_recv(srq, recvWr, &badRecvWr)
+	if res != 0 {
+		return newVerbsError("ibv_post_srq_recv", fmt.Sprintf("wr_id %#x", uint64(wrID)), nil, int(res), err)
 	}
 	return nil
 }
 
+// IbvPostSendRes sends the whole IbBuf as a signaled send through the send queue accounting.
 func IbvPostSendRes(ibRes *IBRes, immData int, wrID uint64) error {
-	return IbvPostSend(C.uint(ibRes.IbBufSize), ibRes.Mr.lkey, C.ulong(wrID), C.uint(immData), ibRes.Qp, ibRes.IbBuf)
+	return ibRes.PostSend(int(ibRes.IbBufSize), uint32(immData), wrID, true)
 }
 
 func IbvPostSend(reqSize C.uint, lkey C.uint, wrID C.ulong, immData C.uint, qp *C.struct_ibv_qp, buf *C.char) error {
@@ -459,22 +646,54 @@ func IbvPostSend(reqSize C.uint, lkey C.uint, wrID C.ulong, immData C.uint, qp *
 	sendWr.opcode = C.IBV_WR_SEND_WITH_IMM
 	sendWr.send_flags = C.IBV_SEND_SIGNALED
 
-	_, err := C.ibv_post_send_wrapper(qp, sendWr, &badSendWr, immData)
-	if err != nil {
-		return errors.New(fmt.Sprintf("[IbvPostSend] failed to post send: %v", err))
+	res, err := C.ibv_post_send_wrapper(qp, sendWr, &badSendWr, immData)
+	if res != 0 {
+		return postSendError(qp, uint64(wrID), int(res), err)
+	}
+	return nil
+}
+
+// IbvPostSendFlags posts a SEND_WITH_IMM with the given send flags without allocating a WR.
+// With IBV_SEND_INLINE the provider copies the payload during the call, so buf may point to
+// unregistered (even Go) memory and lkey is ignored.
+func IbvPostSendFlags(qp *C.struct_ibv_qp, buf unsafe.Pointer, length C.uint, lkey C.uint, wrID C.ulong,
+	immData C.uint, sendFlags C.uint) error {
+	res := C.ibv_post_send_flags_wrapper(qp, C.uint64_t(wrID), buf, length, lkey, immData, sendFlags)
+	if res != 0 {
+		return postSendError(qp, uint64(wrID), int(res), nil)
 	}
 	return nil
 }
 
+// IbvPostWriteImm posts an RDMA_WRITE_WITH_IMM of length bytes at buf to remoteAddr, the
+// peer gets immData with a receive completion.
+func IbvPostWriteImm(qp *C.struct_ibv_qp, buf unsafe.Pointer, length C.uint, lkey C.uint, wrID C.ulong,
+	immData C.uint, remoteAddr uint64, rkey uint32, sendFlags C.uint) error {
+	res := C.ibv_post_write_imm_wrapper(qp, C.uint64_t(wrID), buf, length, lkey, immData, C.uint64_t(remoteAddr),
+		C.uint(rkey), sendFlags)
+	if res != 0 {
+		return postSendError(qp, uint64(wrID), int(res), nil)
+	}
+	return nil
+}
+
+func postSendError(qp *C.struct_ibv_qp, wrID uint64, res int, cerr error) error {
+	e := newVerbsError("ibv_post_send", fmt.Sprintf("%v wr_id %#x", qpResource(qp), wrID), nil, res, cerr)
+	if e.Errno == syscall.EINVAL {
+		e.Kind = ErrQPState
+	}
+	return e
+}
+
 // IbvPollCQ polls the completion queue for completion events.
 // numEntries specifies the maximum number of completion events to poll.
 // wc is a pointer to an array of completion queue work completion structs.
 // Returns the number of completion events polled.
 // if numEntries is greater than the returned num, means the CQ is empty
 func IbvPollCQ(cq *C.struct_ibv_cq, numEntries C.int, wc *C.struct_ibv_wc) (int, error) {
-	num, err := C.ibv_poll_cq(cq, numEntries, wc)
-	if err != nil {
-		return 0, errors.New(fmt.Sprintf("failed to poll completion queue: %v", err))
+	num := C.ibv_poll_cq(cq, numEntries, wc)
+	if num < 0 {
+		return 0, newVerbsError("ibv_poll_cq", "", nil, int(num), nil)
 	}
 	return int(num), nil
 }
@@ -0,0 +1,411 @@
+package RDMAGO
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// completion latency buckets in seconds, 1µs to about 1s
+var LATENCY_BUCKETS = []float64{1e-6, 4e-6, 16e-6, 64e-6, 256e-6, 1e-3, 4e-3, 16e-3, 64e-3, 256e-3, 1}
+
+// DefaultMetrics is the registry endpoints report to unless Config.Metrics is set.
+var DefaultMetrics = NewMetricsRegistry()
+
+type Counter struct {
+	v uint64
+}
+
+func (c *Counter) Inc()          { atomic.AddUint64(&c.v, 1) }
+func (c *Counter) Add(n uint64)  { atomic.AddUint64(&c.v, n) }
+func (c *Counter) Value() uint64 { return atomic.LoadUint64(&c.v) }
+
+// set mirrors a counter kept elsewhere, e.g. by the hardware
+func (c *Counter) set(v uint64) { atomic.StoreUint64(&c.v, v) }
+
+type Gauge struct {
+	v int64
+}
+
+func (g *Gauge) Set(v int64)  { atomic.StoreInt64(&g.v, v) }
+func (g *Gauge) Value() int64 { return atomic.LoadInt64(&g.v) }
+
+// Histogram counts observations into cumulative buckets with fixed upper bounds.
+type Histogram struct {
+	bounds []float64
+	counts []uint64 // per bucket, the last one is +Inf
+	count  uint64
+	sum    uint64 // float64 bits
+}
+
+func newHistogram(bounds []float64) *Histogram {
+	return &Histogram{bounds: bounds, counts: make([]uint64, len(bounds)+1)}
+}
+
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.bounds, v)
+	atomic.AddUint64(&h.counts[i], 1)
+	atomic.AddUint64(&h.count, 1)
+	for {
+		old := atomic.LoadUint64(&h.sum)
+		if atomic.CompareAndSwapUint64(&h.sum, old, math.Float64bits(math.Float64frombits(old)+v)) {
+			return
+		}
+	}
+}
+
+func (h *Histogram) Count() uint64 { return atomic.LoadUint64(&h.count) }
+func (h *Histogram) Sum() float64  { return math.Float64frombits(atomic.LoadUint64(&h.sum)) }
+
+type metricKind int
+
+const (
+	metricCounter metricKind = iota
+	metricGauge
+	metricHistogram
+)
+
+func (k metricKind) String() string {
+	return [...]string{"counter", "gauge", "histogram"}[k]
+}
+
+type metricSeries struct {
+	values    []string
+	counter   Counter
+	gauge     Gauge
+	histogram *Histogram
+}
+
+type metricFamily struct {
+	name   string
+	help   string
+	kind   metricKind
+	labels []string
+	bounds []float64
+
+	mu     sync.Mutex
+	series map[string]*metricSeries
+}
+
+// with returns the series for the label values, creating it on first use.
+func (f *metricFamily) with(values ...string) *metricSeries {
+	key := strings.Join(values, "\xff")
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s := f.series[key]
+	if s == nil {
+		s = &metricSeries{values: append([]string(nil), values...)}
+		if f.kind == metricHistogram {
+			s.histogram = newHistogram(f.bounds)
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+// deletePrefix removes the series whose first labels are names with the values prefix.
+func (f *metricFamily) deletePrefix(names, prefix []string) {
+	if len(f.labels) < len(names) || strings.Join(f.labels[:len(names)], "\xff") != strings.Join(names, "\xff") {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for key, s := range f.series {
+		if strings.Join(s.values[:len(prefix)], "\xff") == strings.Join(prefix, "\xff") {
+			delete(f.series, key)
+		}
+	}
+}
+
+func (f *metricFamily) sorted() []*metricSeries {
+	f.mu.Lock()
+	list := make([]*metricSeries, 0, len(f.series))
+	for _, s := range f.series {
+		list = append(list, s)
+	}
+	f.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool {
+		return strings.Join(list[i].values, "\xff") < strings.Join(list[j].values, "\xff")
+	})
+	return list
+}
+
+// MetricsRegistry holds labeled counters, gauges and histograms. It serves them in the
+// Prometheus text format as an http.Handler and as JSON as an expvar.Var, e.g.
+// expvar.Publish("rdma", DefaultMetrics).
+type MetricsRegistry struct {
+	mu         sync.Mutex
+	families   []*metricFamily
+	byName     map[string]*metricFamily
+	collectors map[int]func()
+	nextID     int
+	// endpoints using the series of a device, port and peer, see acquire
+	users map[string]int
+}
+
+func NewMetricsRegistry() *MetricsRegistry {
+	return &MetricsRegistry{byName: make(map[string]*metricFamily)}
+}
+
+// family returns the family called name, registering it on first use.
+func (r *MetricsRegistry) family(name, help string, kind metricKind, bounds []float64, labels ...string) *metricFamily {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if f := r.byName[name]; f != nil {
+		return f
+	}
+	f := &metricFamily{name: name, help: help, kind: kind, labels: labels, bounds: bounds,
+		series: make(map[string]*metricSeries)}
+	r.families = append(r.families, f)
+	r.byName[name] = f
+	return f
+}
+
+// acquire counts a user of the series whose device, port and peer are prefix.
+func (r *MetricsRegistry) acquire(prefix []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.users == nil {
+		r.users = make(map[string]int)
+	}
+	r.users[strings.Join(prefix, "\xff")]++
+}
+
+// release drops a user of the series whose device, port and peer are prefix and deletes
+// them with the last one.
+func (r *MetricsRegistry) release(prefix []string) {
+	key := strings.Join(prefix, "\xff")
+	r.mu.Lock()
+	r.users[key]--
+	if r.users[key] > 0 {
+		r.mu.Unlock()
+		return
+	}
+	delete(r.users, key)
+	families := append([]*metricFamily(nil), r.families...)
+	r.mu.Unlock()
+	for _, f := range families {
+		f.deletePrefix([]string{"device", "port", "peer"}, prefix)
+	}
+}
+
+// AddCollector runs collect before every exposition of the registry, to update series
+// read from elsewhere. The returned function removes it.
+func (r *MetricsRegistry) AddCollector(collect func()) (remove func()) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.collectors == nil {
+		r.collectors = make(map[int]func())
+	}
+	id := r.nextID
+	r.nextID++
+	r.collectors[id] = collect
+	return func() {
+		r.mu.Lock()
+		delete(r.collectors, id)
+		r.mu.Unlock()
+	}
+}
+
+// snapshot runs the collectors and returns the families.
+func (r *MetricsRegistry) snapshot() []*metricFamily {
+	r.mu.Lock()
+	collectors := make([]func(), 0, len(r.collectors))
+	for _, collect := range r.collectors {
+		collectors = append(collectors, collect)
+	}
+	r.mu.Unlock()
+	for _, collect := range collectors {
+		collect()
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]*metricFamily(nil), r.families...)
+}
+
+// WritePrometheus writes every series in the Prometheus text exposition format.
+func (r *MetricsRegistry) WritePrometheus(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	for _, f := range r.snapshot() {
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.kind)
+		for _, s := range f.sorted() {
+			labels := formatLabels(f.labels, s.values)
+			switch f.kind {
+			case metricCounter:
+				fmt.Fprintf(bw, "%s%s %d\n", f.name, labels, s.counter.Value())
+			case metricGauge:
+				fmt.Fprintf(bw, "%s%s %d\n", f.name, labels, s.gauge.Value())
+			case metricHistogram:
+				writeHistogram(bw, f, s)
+			}
+		}
+	}
+	return bw.Flush()
+}
+
+func writeHistogram(w io.Writer, f *metricFamily, s *metricSeries) {
+	h := s.histogram
+	names := append(append([]string(nil), f.labels...), "le")
+	var cumulative uint64
+	for i := range h.counts {
+		cumulative += atomic.LoadUint64(&h.counts[i])
+		le := "+Inf"
+		if i < len(h.bounds) {
+			le = strconv.FormatFloat(h.bounds[i], 'g', -1, 64)
+		}
+		values := append(append([]string(nil), s.values...), le)
+		fmt.Fprintf(w, "%s_bucket%s %d\n", f.name, formatLabels(names, values), cumulative)
+	}
+	labels := formatLabels(f.labels, s.values)
+	fmt.Fprintf(w, "%s_sum%s %s\n", f.name, labels, strconv.FormatFloat(h.Sum(), 'g', -1, 64))
+	fmt.Fprintf(w, "%s_count%s %d\n", f.name, labels, h.Count())
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(name)
+		b.WriteString(`="`)
+		b.WriteString(labelEscaper.Replace(values[i]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// ServeHTTP serves the Prometheus text format, mount it on /metrics.
+func (r *MetricsRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.WritePrometheus(w)
+}
+
+type jsonSeries struct {
+	Labels  map[string]string `json:"labels"`
+	Value   *float64          `json:"value,omitempty"`
+	Count   *uint64           `json:"count,omitempty"`
+	Sum     *float64          `json:"sum,omitempty"`
+	Buckets map[string]uint64 `json:"buckets,omitempty"`
+}
+
+// String returns the series as JSON, which makes the registry an expvar.Var.
+func (r *MetricsRegistry) String() string {
+	out := make(map[string][]jsonSeries)
+	for _, f := range r.snapshot() {
+		list := []jsonSeries{}
+		for _, s := range f.sorted() {
+			js := jsonSeries{Labels: make(map[string]string, len(f.labels))}
+			for i, name := range f.labels {
+				js.Labels[name] = s.values[i]
+			}
+			switch f.kind {
+			case metricCounter:
+				v := float64(s.counter.Value())
+				js.Value = &v
+			case metricGauge:
+				v := float64(s.gauge.Value())
+				js.Value = &v
+			case metricHistogram:
+				count, sum := s.histogram.Count(), s.histogram.Sum()
+				js.Count, js.Sum = &count, &sum
+				js.Buckets = make(map[string]uint64, len(s.histogram.counts))
+				var cumulative uint64
+				for i := range s.histogram.counts {
+					cumulative += atomic.LoadUint64(&s.histogram.counts[i])
+					le := "+Inf"
+					if i < len(s.histogram.bounds) {
+						le = strconv.FormatFloat(s.histogram.bounds[i], 'g', -1, 64)
+					}
+					js.Buckets[le] = cumulative
+				}
+			}
+			list = append(list, js)
+		}
+		out[f.name] = list
+	}
+	data, err := json.Marshal(out)
+	if err != nil {
+		return "{}"
+	}
+	return string(data)
+}
+
+// endpointMetrics are the series of one endpoint, labeled by device, port and peer.
+// Endpoints sharing the labels share the series, the last release deletes them.
+type endpointMetrics struct {
+	registry *MetricsRegistry
+	labels   []string
+
+	sendOps, sendBytes *Counter
+	recvOps, recvBytes *Counter
+	sendLatency        *Histogram
+	srqOutstanding     *Gauge
+	polls, emptyPolls  *Counter
+	reconnects         *Counter
+	reconnectFailures  *Counter
+	creditStalls       *Histogram
+	errors             *metricFamily
+}
+
+func newEndpointMetrics(r *MetricsRegistry, device, port, peer string) *endpointMetrics {
+	labels := []string{device, port, peer}
+	ops := r.family("rdma_ops_total", "Sends posted and receives completed, by opcode.", metricCounter, nil,
+		"device", "port", "peer", "opcode")
+	bytes := r.family("rdma_bytes_total", "Payload bytes transferred, by opcode.", metricCounter, nil,
+		"device", "port", "peer", "opcode")
+	latency := r.family("rdma_completion_latency_seconds", "Time from posting a signaled send to its completion.",
+		metricHistogram, LATENCY_BUCKETS, "device", "port", "peer", "opcode")
+	withOp := func(op string) []string { return append(append([]string(nil), labels...), op) }
+
+	r.acquire(labels)
+	return &endpointMetrics{
+		registry:    r,
+		labels:      labels,
+		sendOps:     &ops.with(withOp("send")...).counter,
+		sendBytes:   &bytes.with(withOp("send")...).counter,
+		recvOps:     &ops.with(withOp("recv")...).counter,
+		recvBytes:   &bytes.with(withOp("recv")...).counter,
+		sendLatency: latency.with(withOp("send")...).histogram,
+		srqOutstanding: &r.family("rdma_srq_outstanding", "Receives posted on the SRQ.", metricGauge, nil,
+			"device", "port", "peer").with(labels...).gauge,
+		polls: &r.family("rdma_cq_polls_total", "CQ polls.", metricCounter, nil,
+			"device", "port", "peer").with(labels...).counter,
+		emptyPolls: &r.family("rdma_cq_empty_polls_total", "CQ polls that returned no completion.", metricCounter, nil,
+			"device", "port", "peer").with(labels...).counter,
+		reconnects: &r.family("rdma_reconnects_total", "Connections re-established after a failure.", metricCounter, nil,
+			"device", "port", "peer").with(labels...).counter,
+		reconnectFailures: &r.family("rdma_reconnect_failures_total", "Reconnect attempts that failed.", metricCounter, nil,
+			"device", "port", "peer").with(labels...).counter,
+		creditStalls: r.family("rdma_credit_stall_seconds", "Time sends waited for credits from the peer.",
+			metricHistogram, LATENCY_BUCKETS, "device", "port", "peer").with(labels...).histogram,
+		errors: r.family("rdma_completion_errors_total", "Completions with an error status.", metricCounter, nil,
+			"device", "port", "peer", "status"),
+	}
+}
+
+// release deletes the series once no other endpoint uses them. Updates of m afterwards
+// are lost, so a Send still returning does not need to check.
+func (m *endpointMetrics) release() {
+	m.registry.release(m.labels)
+}
+
+func (m *endpointMetrics) completionError(status WCStatus) {
+	m.errors.with(append(append([]string(nil), m.labels...), status.String())...).counter.Inc()
+}
@@ -0,0 +1,210 @@
+package RDMAGO
+
+/*
+#cgo CFLAGS: -I/usr/include/infiniband
+#cgo LDFLAGS: -libverbs -L. -lwrapper
+
+#include "wrapper.h"
+
+#include <stdlib.h>
+#include <infiniband/verbs.h>
+*/
+import "C"
+import (
+	"errors"
+	"fmt"
+	"time"
+	"unsafe"
+)
+
+const (
+	// completions of a QP moved to ERR arrive asynchronously, drainCQ polls until the
+	// CQ stayed empty for CQ_DRAIN_QUIET or CQ_DRAIN_TIMEOUT passed
+	CQ_DRAIN_QUIET   = 10 * time.Millisecond
+	CQ_DRAIN_TIMEOUT = time.Second
+	CQ_DRAIN_SLEEP   = 50 * time.Microsecond
+)
+
+// WCRecord is a completion in the fixed layout of struct wc_record (wrapper.h),
+// so records written by C can be read from Go without decoding struct ibv_wc.
+type WCRecord struct {
+	WrID      uint64
+	Status    uint32
+	Opcode    uint32
+	ByteLen   uint32
+	ImmData   uint32
+	QPNum     uint32
+	SrcQP     uint32
+	WCFlags   uint32
+	VendorErr uint32
+}
+
+// compile time check that WCRecord and struct wc_record have the same size
+var _ [unsafe.Sizeof(WCRecord{}) - C.sizeof_struct_wc_record]byte
+var _ [C.sizeof_struct_wc_record - unsafe.Sizeof(WCRecord{})]byte
+
+func (rec *WCRecord) Success() bool {
+	return rec.Status == C.IBV_WC_SUCCESS
+}
+
+func (rec *WCRecord) IsRecv() bool {
+	return rec.Opcode&C.IBV_WC_RECV != 0
+}
+
+// captureRecord is the capture record of the completion, the peer QP is not known to it.
+func (rec *WCRecord) captureRecord() captureRecord {
+	c := captureRecord{
+		typ:    CAPTURE_COMPLETION,
+		opcode: uint8(rec.Opcode),
+		status: uint8(rec.Status),
+		qpNum:  rec.QPNum,
+		length: rec.ByteLen,
+		wrID:   rec.WrID,
+	}
+	if rec.WCFlags&C.IBV_WC_WITH_IMM != 0 {
+		c.imm = rec.ImmData
+		c.flags |= CAPTURE_FLAG_IMM
+	}
+	return c
+}
+
+// CompletionRing polls a CQ in C and keeps the completions as WCRecords in a ring
+// of C memory. One Poll call drains up to the free space of the ring with a single
+// cgo crossing, Next then hands out the records without further cgo calls.
+type CompletionRing struct {
+	cq         *C.struct_ibv_cq
+	scratch    *C.struct_ibv_wc
+	scratchLen int
+	recs       *C.struct_wc_record
+	size       uint32
+	head       uint32
+	tail       uint32
+	capture    *Capture
+
+	// Spin is how many extra times Poll polls an empty CQ before giving up.
+	Spin int
+}
+
+// NewCompletionRing creates a ring holding up to size records for cq.
+// size is rounded up to a power of two.
+func NewCompletionRing(cq *C.struct_ibv_cq, size int) (*CompletionRing, error) {
+	if size < 1 {
+		return nil, errors.New(fmt.Sprintf("[NewCompletionRing] invalid size %v", size))
+	}
+	ringSize := uint32(1)
+	for ringSize < uint32(size) {
+		ringSize <<= 1
+	}
+
+	scratchLen := 64
+	if scratchLen > int(ringSize) {
+		scratchLen = int(ringSize)
+	}
+	scratch, err := CreateWC(scratchLen)
+	if err != nil {
+		return nil, fmt.Errorf("[NewCompletionRing] %w", err)
+	}
+	recs := (*C.struct_wc_record)(C.calloc(C.size_t(ringSize), C.sizeof_struct_wc_record))
+	if recs == nil {
+		DestroyWC(scratch)
+		return nil, errors.New("[NewCompletionRing] failed to allocate memory")
+	}
+
+	return &CompletionRing{
+		cq:         cq,
+		scratch:    scratch,
+		scratchLen: scratchLen,
+		recs:       recs,
+		size:       ringSize,
+	}, nil
+}
+
+func (r *CompletionRing) records() []WCRecord {
+	return unsafe.Slice((*WCRecord)(unsafe.Pointer(r.recs)), r.size)
+}
+
+// Len returns the number of polled records not yet returned by Next.
+func (r *CompletionRing) Len() int {
+	return int(r.tail - r.head)
+}
+
+// Poll moves up to max completions from the CQ into the ring, limited by the free space.
+// It returns the number of new records.
+func (r *CompletionRing) Poll(max int) (int, error) {
+	free := int(r.size - (r.tail - r.head))
+	if max <= 0 || max > free {
+		max = free
+	}
+	if max == 0 {
+		return 0, nil
+	}
+
+	num := C.ibv_poll_cq_records(r.cq, r.scratch, C.int(r.scratchLen), r.recs, C.uint32_t(r.size),
+		C.uint32_t(r.tail), C.int(max), C.int(r.Spin))
+	if num < 0 {
+		return 0, fmt.Errorf("[CompletionRing] %w", newVerbsError("ibv_poll_cq", "", nil, int(num), nil))
+	}
+	if r.capture != nil {
+		recs := r.records()
+		for i := r.tail; i != r.tail+uint32(num); i++ {
+			r.capture.record(recs[i&(r.size-1)].captureRecord(), nil)
+		}
+	}
+	r.tail += uint32(num)
+	return int(num), nil
+}
+
+// SetCapture records the polled completions to c, nil stops it. The ring does not see
+// the received data, the records carry no payload.
+func (r *CompletionRing) SetCapture(c *Capture) {
+	r.capture = c
+}
+
+// Next returns the oldest polled record. The pointer stays valid until the next Poll.
+func (r *CompletionRing) Next() (*WCRecord, bool) {
+	if r.head == r.tail {
+		return nil, false
+	}
+	rec := &r.records()[r.head&(r.size-1)]
+	r.head++
+	return rec, true
+}
+
+// Free releases the C memory of the ring, it must not be used afterwards.
+func (r *CompletionRing) Free() {
+	if r.scratch != nil {
+		DestroyWC(r.scratch)
+		r.scratch = nil
+	}
+	if r.recs != nil {
+		C.free(unsafe.Pointer(r.recs))
+		r.recs = nil
+	}
+	r.head, r.tail, r.size = 0, 0, 0
+}
+
+// wcAt returns the i-th entry of a WC array created by CreateWC.
+func wcAt(wc *C.struct_ibv_wc, i int) *C.struct_ibv_wc {
+	return (*C.struct_ibv_wc)(unsafe.Add(unsafe.Pointer(wc), i*C.sizeof_struct_ibv_wc))
+}
+
+// drainCQ hands every completion left in cq to fn, wc must hold num entries.
+func drainCQ(cq *C.struct_ibv_cq, wc *C.struct_ibv_wc, num int, fn func(*C.struct_ibv_wc)) error {
+	deadline := time.Now().Add(CQ_DRAIN_TIMEOUT)
+	quietSince := time.Now()
+	for time.Now().Before(deadline) && time.Since(quietSince) < CQ_DRAIN_QUIET {
+		n, err := IbvPollCQ(cq, C.int(num), wc)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			time.Sleep(CQ_DRAIN_SLEEP)
+			continue
+		}
+		quietSince = time.Now()
+		for i := 0; i < n; i++ {
+			fn(wcAt(wc, i))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+package RDMAGO
+
+import (
+	"os"
+	"testing"
+)
+
+// The benchmarks need an RDMA device, e.g. a soft-RoCE link:
+//
+//	RDMAGO_BENCH_DEVICE=rxe_0 go test -run NONE -bench Poll
+//
+// Each iteration posts pollBenchBatch zero-length inline sends on a QP connected to itself
+// and polls the 2*pollBenchBatch completions, so both variants pay the same posting cost.
+
+const pollBenchBatch = 64
+
+func newLoopbackRes(b *testing.B) (*IBRes, *RecvBatch) {
+	deviceName := os.Getenv("RDMAGO_BENCH_DEVICE")
+	if deviceName == "" {
+		b.Skip("RDMAGO_BENCH_DEVICE not set")
+	}
+
+	ibRes, err := InitIBRes()
+	if err != nil {
+		b.Fatal(err)
+	}
+	ibRes.SetSendOptions(0, 1)
+	qpInfo, err := ibRes.InitRCQP(deviceName, 4096)
+	if err != nil {
+		ibRes.FreeIBRes()
+		b.Fatal(err)
+	}
+	b.Cleanup(func() {
+		ibRes.FreeRCQP()
+		ibRes.FreeIBRes()
+	})
+	if err = ibRes.ModifyQPRTS(qpInfo); err != nil {
+		b.Fatal(err)
+	}
+
+	recvBatch, err := NewRecvBatch(pollBenchBatch)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(recvBatch.Free)
+	for i := 0; i < pollBenchBatch; i++ {
+		if err = recvBatch.AddRecvRes(ibRes, 0, int(ibRes.IbBufSize), uint64(i)); err != nil {
+			b.Fatal(err)
+		}
+	}
+	return ibRes, recvBatch
+}
+
+func postLoopbackRound(b *testing.B, ibRes *IBRes, recvBatch *RecvBatch) {
+	if _, err := IbvPostSRQRecvBatch(ibRes.Srq, recvBatch); err != nil {
+		b.Fatal(err)
+	}
+	ibRes.ResetSendSlots()
+	for i := 0; i < pollBenchBatch; i++ {
+		if err := ibRes.PostInline(nil, uint32(i), uint64(i), true); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkPollCQ(b *testing.B) {
+	ibRes, recvBatch := newLoopbackRes(b)
+	wc, err := CreateWC(16)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer DestroyWC(wc)
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		postLoopbackRound(b, ibRes, recvBatch)
+		var sum uint64
+		for done := 0; done < 2*pollBenchBatch; {
+			num, err := IbvPollCQ(ibRes.Cq, 16, wc)
+			if err != nil {
+				b.Fatal(err)
+			}
+			for i := 0; i < num; i++ {
+				entry := wcAt(wc, i)
+				sum += uint64(entry.wr_id) + uint64(entry.status) + uint64(entry.opcode) + uint64(entry.byte_len)
+			}
+			done += num
+		}
+		_ = sum
+	}
+}
+
+func BenchmarkCompletionRing(b *testing.B) {
+	ibRes, recvBatch := newLoopbackRes(b)
+	ring, err := NewCompletionRing(ibRes.Cq, 2*pollBenchBatch)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer ring.Free()
+	ring.Spin = 64
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		postLoopbackRound(b, ibRes, recvBatch)
+		var sum uint64
+		for done := 0; done < 2*pollBenchBatch; {
+			num, err := ring.Poll(0)
+			if err != nil {
+				b.Fatal(err)
+			}
+			for rec, ok := ring.Next(); ok; rec, ok = ring.Next() {
+				sum += rec.WrID + uint64(rec.Status) + uint64(rec.Opcode) + uint64(rec.ByteLen)
+			}
+			done += num
+		}
+		_ = sum
+	}
+}
+
+func TestCompletionRingNext(t *testing.T) {
+	tests := []struct {
+		name     string
+		size     int
+		wantSize uint32
+		start    uint32 // head and tail before the records are added
+		records  int
+	}{
+		{"exact", 4, 4, 0, 3},
+		{"rounded up", 5, 8, 0, 8},
+		{"index wraps", 4, 4, 2, 4},
+		{"counter wraps", 4, 4, 1<<32 - 2, 4},
+	}
+	for _, tt := range tests {
+		r, err := NewCompletionRing(nil, tt.size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.size != tt.wantSize {
+			t.Errorf("%v: size %v rounds to %v, want %v", tt.name, tt.size, r.size, tt.wantSize)
+		}
+		// stand in for Poll, which writes the records in C
+		r.head, r.tail = tt.start, tt.start
+		for i := 0; i < tt.records; i++ {
+			r.records()[r.tail&(r.size-1)] = WCRecord{WrID: uint64(i)}
+			r.tail++
+		}
+		if r.Len() != tt.records {
+			t.Errorf("%v: Len = %v, want %v", tt.name, r.Len(), tt.records)
+		}
+		for i := 0; i < tt.records; i++ {
+			rec, ok := r.Next()
+			if !ok || rec.WrID != uint64(i) {
+				t.Errorf("%v: record %v is %+v, %v", tt.name, i, rec, ok)
+				break
+			}
+		}
+		if _, ok := r.Next(); ok || r.Len() != 0 {
+			t.Errorf("%v: ring not empty after %v records", tt.name, tt.records)
+		}
+		r.Free()
+	}
+}
@@ -0,0 +1,175 @@
+package RDMAGO
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+)
+
+// QoSClass is one traffic class of a QoSEndpoint, the fields override those of the Config.
+type QoSClass struct {
+	Name string `json:"name"`
+	// bootstrap port of the class, the port of the Config plus the index of the class when empty
+	Port string `json:"port"`
+
+	SL            uint8  `json:"sl"`
+	TrafficClass  uint8  `json:"traffic_class"`
+	DSCP          uint8  `json:"dscp"`
+	FlowLabel     uint32 `json:"flow_label"`
+	AutoFlowLabel bool   `json:"auto_flow_label"`
+}
+
+// QoSEndpoint carries each QoS class over its own Endpoint, so every class has its own QP
+// whose SL, traffic class and flow label map it onto a priority of the fabric. Both sides
+// must list the same classes in the same order; messages of different classes are not
+// ordered with respect to each other.
+type QoSEndpoint struct {
+	classes   []string
+	endpoints map[string]*Endpoint
+}
+
+// NewQoSEndpoint connects one Endpoint per class of cfg.QoSClasses.
+func NewQoSEndpoint(cfg *Config) (*QoSEndpoint, error) {
+	return NewQoSEndpointContext(context.Background(), cfg)
+}
+
+// NewQoSEndpointContext is NewQoSEndpoint with ctx bounding the first connections. The
+// classes connect in parallel; when one fails the others stop waiting and are closed.
+func NewQoSEndpointContext(ctx context.Context, cfg *Config) (*QoSEndpoint, error) {
+	if len(cfg.QoSClasses) == 0 {
+		return nil, errors.New("[NewQoSEndpoint] no qos_classes configured")
+	}
+	q := &QoSEndpoint{endpoints: make(map[string]*Endpoint, len(cfg.QoSClasses))}
+	cfgs := make([]*Config, len(cfg.QoSClasses))
+	for i, class := range cfg.QoSClasses {
+		if class.Name == "" {
+			return nil, errors.New(fmt.Sprintf("[NewQoSEndpoint] QoS class %v has no name", i))
+		}
+		if _, ok := q.endpoints[class.Name]; ok {
+			return nil, errors.New("[NewQoSEndpoint] duplicate QoS class " + class.Name)
+		}
+		c, err := cfg.forClass(i)
+		if err != nil {
+			return nil, err
+		}
+		cfgs[i] = c
+		q.classes = append(q.classes, class.Name)
+		q.endpoints[class.Name] = nil
+	}
+
+	// a server class would wait for its client until ctx is done, the first failure ends
+	// the wait of the others
+	connectCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	eps := make([]*Endpoint, len(cfgs))
+	var failure error
+	var failOnce sync.Once
+	var wg sync.WaitGroup
+	for i := range cfgs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var err error
+			if eps[i], err = NewEndpointContext(connectCtx, cfgs[i]); err != nil {
+				failOnce.Do(func() {
+					failure = fmt.Errorf("QoS class %v: %w", q.classes[i], err)
+					cancel()
+				})
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if failure != nil {
+		for _, ep := range eps {
+			if ep != nil {
+				ep.Close()
+			}
+		}
+		return nil, fmt.Errorf("[NewQoSEndpoint] %w", failure)
+	}
+	for i, name := range q.classes {
+		q.endpoints[name] = eps[i]
+	}
+	return q, nil
+}
+
+// forClass returns the config of the Endpoint of class i.
+func (cfg *Config) forClass(i int) (*Config, error) {
+	class := cfg.QoSClasses[i]
+	c := *cfg
+	c.QoSClasses = nil
+	c.qosClass = class.Name
+	c.SL = class.SL
+	c.TrafficClass = class.TrafficClass
+	c.DSCP = class.DSCP
+	c.FlowLabel = class.FlowLabel
+	c.AutoFlowLabel = class.AutoFlowLabel
+	if c.CaptureFile != "" {
+		// each Endpoint writes its own capture
+		c.CaptureFile += "." + class.Name
+	}
+
+	port := class.Port
+	if port == "" {
+		base, err := strconv.Atoi(cfg.Port)
+		if cfg.Mode == "client" {
+			var p string
+			_, p, err = net.SplitHostPort(cfg.Address)
+			if err == nil {
+				base, err = strconv.Atoi(p)
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("[NewQoSEndpoint] QoS class %v needs a port: %w", class.Name, err)
+		}
+		port = strconv.Itoa(base + i)
+	}
+	c.Port = port
+	if cfg.Mode == "client" {
+		host, _, err := net.SplitHostPort(cfg.Address)
+		if err != nil {
+			return nil, fmt.Errorf("[NewQoSEndpoint] invalid address %v: %w", cfg.Address, err)
+		}
+		c.Address = net.JoinHostPort(host, port)
+	}
+	return &c, nil
+}
+
+// Classes returns the names of the classes in the order of the Config.
+func (q *QoSEndpoint) Classes() []string {
+	return append([]string(nil), q.classes...)
+}
+
+// Endpoint returns the Endpoint of class, nil when there is no such class.
+func (q *QoSEndpoint) Endpoint(class string) *Endpoint {
+	return q.endpoints[class]
+}
+
+// Send sends data on the QP of class, see Endpoint.Send.
+func (q *QoSEndpoint) Send(class string, data []byte, immData uint32) error {
+	return q.SendContext(context.Background(), class, data, immData)
+}
+
+// SendContext is Send that gives up when ctx is done.
+func (q *QoSEndpoint) SendContext(ctx context.Context, class string, data []byte, immData uint32) error {
+	ep := q.endpoints[class]
+	if ep == nil {
+		return errors.New("[QoSEndpoint] unknown QoS class " + class)
+	}
+	return ep.SendContext(ctx, data, immData)
+}
+
+// Close closes the Endpoints of all classes.
+func (q *QoSEndpoint) Close() error {
+	var errs []error
+	for _, name := range q.classes {
+		if err := q.endpoints[name].Close(); err != nil {
+			errs = append(errs, fmt.Errorf("[QoSEndpoint] class %v: %w", name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
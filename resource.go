@@ -0,0 +1,283 @@
+package RDMAGO
+
+import (
+	"errors"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+)
+
+// resourceMu guards the dependency graph of every Resource and the registry of open ones.
+// Describes run with it held and must not create resources. Releases run without it, so
+// they may wait for goroutines that use the registry.
+var resourceMu sync.Mutex
+
+// resourceReleased is signaled when a Close finished releasing, see Resource.closing.
+var resourceReleased = sync.NewCond(&resourceMu)
+
+var leakTracking bool
+var liveResources = map[*Resource]struct{}{}
+var nextResourceID uint64
+
+// Resource is a verbs object or C allocation. It depends on the resources it was created
+// from, e.g. a QP on its PD, CQ and SRQ, and Close releases everything depending on it
+// first, so destruction order follows from creation. Close is safe to call again.
+type Resource struct {
+	id       uint64
+	kind     string
+	name     string
+	release  func() error
+	describe func() map[string]interface{}
+
+	parents  []*Resource
+	children []*Resource
+	closed   bool
+	// closing is set while a Close releases the resource without resourceMu
+	closing bool
+
+	created time.Time
+	stack   []byte
+}
+
+// newResource registers an object that was just created. nil parents are skipped.
+func newResource(kind, name string, release func() error, parents ...*Resource) *Resource {
+	r := &Resource{kind: kind, name: name, release: release, created: time.Now()}
+
+	resourceMu.Lock()
+	defer resourceMu.Unlock()
+	nextResourceID++
+	r.id = nextResourceID
+	for _, parent := range parents {
+		if parent == nil {
+			continue
+		}
+		r.parents = append(r.parents, parent)
+		parent.children = append(parent.children, r)
+	}
+	if leakTracking {
+		r.stack = resourceStack()
+	}
+	liveResources[r] = struct{}{}
+	return r
+}
+
+// setDescribe sets the function reporting the attributes of the resource, see OpenResources.
+func (r *Resource) setDescribe(describe func() map[string]interface{}) {
+	if r == nil {
+		return
+	}
+	resourceMu.Lock()
+	defer resourceMu.Unlock()
+	r.describe = describe
+}
+
+// dependOn makes r a dependent of parent, which was created after r.
+func (r *Resource) dependOn(parent *Resource) {
+	if r == nil || parent == nil {
+		return
+	}
+	resourceMu.Lock()
+	defer resourceMu.Unlock()
+	if r.closed || parent.closed {
+		return
+	}
+	r.parents = append(r.parents, parent)
+	parent.children = append(parent.children, r)
+}
+
+func resourceStack() []byte {
+	buf := make([]byte, 4096)
+	return buf[:runtime.Stack(buf, false)]
+}
+
+func (r *Resource) String() string {
+	if r.name == "" {
+		return r.kind
+	}
+	return r.kind + " " + r.name
+}
+
+func (r *Resource) Closed() bool {
+	if r == nil {
+		return true
+	}
+	resourceMu.Lock()
+	defer resourceMu.Unlock()
+	return r.closed
+}
+
+// Close releases the resource after its dependents, newest first. When a dependent
+// fails to release, the resource stays open so Close can be retried. nil is a no-op.
+// A Close reaching a resource that another Close is releasing waits for it.
+func (r *Resource) Close() error {
+	if r == nil {
+		return nil
+	}
+	resourceMu.Lock()
+	for r.busyLocked() {
+		resourceReleased.Wait()
+	}
+	var order []*Resource
+	r.appendReleaseOrder(&order, map[*Resource]bool{})
+	parents := make([][]*Resource, len(order))
+	for i, res := range order {
+		res.closing = true
+		parents[i] = append([]*Resource(nil), res.parents...)
+	}
+	resourceMu.Unlock()
+
+	// a resource whose dependent did not release stays open, and so do its parents
+	kept := map[*Resource]bool{}
+	released := make([]bool, len(order))
+	var errs []error
+	for i, res := range order {
+		if !kept[res] && res.release != nil {
+			if err := res.release(); err != nil {
+				errs = append(errs, err)
+				kept[res] = true
+			}
+		}
+		if kept[res] {
+			for _, parent := range parents[i] {
+				kept[parent] = true
+			}
+			continue
+		}
+		released[i] = true
+	}
+
+	resourceMu.Lock()
+	defer resourceMu.Unlock()
+	for i, res := range order {
+		res.closing = false
+		if !released[i] {
+			continue
+		}
+		res.closed = true
+		for _, parent := range res.parents {
+			parent.removeChild(res)
+		}
+		res.parents = nil
+		delete(liveResources, res)
+	}
+	resourceReleased.Broadcast()
+	return errors.Join(errs...)
+}
+
+// busyLocked reports whether r or one of its dependents is being released.
+func (r *Resource) busyLocked() bool {
+	if r.closing {
+		return true
+	}
+	for _, child := range r.children {
+		if child.busyLocked() {
+			return true
+		}
+	}
+	return false
+}
+
+// appendReleaseOrder appends the open resources depending on r, newest first and each
+// after its own dependents, and then r.
+func (r *Resource) appendReleaseOrder(order *[]*Resource, seen map[*Resource]bool) {
+	if r.closed || seen[r] {
+		return
+	}
+	seen[r] = true
+	for i := len(r.children) - 1; i >= 0; i-- {
+		r.children[i].appendReleaseOrder(order, seen)
+	}
+	*order = append(*order, r)
+}
+
+func (r *Resource) removeChild(child *Resource) {
+	for i, c := range r.children {
+		if c == child {
+			r.children = append(r.children[:i], r.children[i+1:]...)
+			return
+		}
+	}
+}
+
+// TrackResources switches the leak registry. While it is on, resources remember the
+// stack that created them until they are closed, see LeakedResources.
+func TrackResources(enable bool) {
+	resourceMu.Lock()
+	defer resourceMu.Unlock()
+	leakTracking = enable
+}
+
+type LeakedResource struct {
+	Resource string
+	Created  time.Time
+	Stack    string
+}
+
+// LeakedResources returns the tracked resources that are still open, oldest first.
+func LeakedResources() []LeakedResource {
+	resourceMu.Lock()
+	defer resourceMu.Unlock()
+	leaks := make([]LeakedResource, 0, len(liveResources))
+	for r := range liveResources {
+		if r.stack == nil {
+			continue
+		}
+		leaks = append(leaks, LeakedResource{Resource: r.String(), Created: r.created, Stack: string(r.stack)})
+	}
+	sort.Slice(leaks, func(i, j int) bool { return leaks[i].Created.Before(leaks[j].Created) })
+	return leaks
+}
+
+// ReportLeaks logs every tracked resource that is still open and returns their number.
+// Call it at shutdown, after everything was supposed to be closed.
+func ReportLeaks() int {
+	leaks := LeakedResources()
+	for _, leak := range leaks {
+		DefaultLogger().Error("[ReportLeaks] resource was not closed", nil, "resource", leak.Resource,
+			"created", leak.Created, "stack", leak.Stack)
+	}
+	return len(leaks)
+}
+
+// ResourceInfo describes an open resource. Parents are the IDs of the resources it was
+// created from, Attrs depend on the kind, e.g. the keys of an MR or the state of a QP.
+type ResourceInfo struct {
+	ID      uint64                 `json:"id"`
+	Kind    string                 `json:"kind"`
+	Name    string                 `json:"name,omitempty"`
+	Parents []uint64               `json:"parents,omitempty"`
+	Created time.Time              `json:"created"`
+	Attrs   map[string]interface{} `json:"attrs,omitempty"`
+}
+
+// OpenResources returns every resource that is open, in creation order.
+func OpenResources() []ResourceInfo {
+	resourceMu.Lock()
+	defer resourceMu.Unlock()
+	infos := make([]ResourceInfo, 0, len(liveResources))
+	for r := range liveResources {
+		info := ResourceInfo{ID: r.id, Kind: r.kind, Name: r.name, Created: r.created}
+		for _, parent := range r.parents {
+			info.Parents = append(info.Parents, parent.id)
+		}
+		// a resource being released may be gone already
+		if r.describe != nil && !r.closing {
+			info.Attrs = r.describe()
+		}
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+	return infos
+}
+
+// ibResources are the resources behind the handles of an IBRes.
+type ibResources struct {
+	device *Resource
+	pd     *Resource
+	buf    *Resource
+	mr     *Resource
+	cq     *Resource
+	srq    *Resource
+	qp     *Resource
+}
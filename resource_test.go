@@ -0,0 +1,63 @@
+package RDMAGO
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestResourceClose(t *testing.T) {
+	tests := []struct {
+		name     string
+		fail     string
+		want     []string
+		wantOpen []string
+	}{
+		{"all released", "", []string{"qp", "mr", "pd"}, nil},
+		{"dependent fails", "qp", []string{"qp", "mr"}, []string{"pd", "qp"}},
+		{"last fails", "pd", []string{"qp", "mr", "pd"}, []string{"pd"}},
+	}
+	for _, tt := range tests {
+		var released []string
+		errFail := errors.New("release failed")
+		release := func(name string) func() error {
+			return func() error {
+				// releases run without resourceMu, the registry stays usable
+				OpenResources()
+				released = append(released, name)
+				if name == tt.fail {
+					return errFail
+				}
+				return nil
+			}
+		}
+		pd := newResource("pd", "", release("pd"))
+		mr := newResource("mr", "", release("mr"), pd)
+		qp := newResource("qp", "", release("qp"), pd)
+
+		err := pd.Close()
+		if (tt.fail != "") != errors.Is(err, errFail) {
+			t.Errorf("%v: Close = %v", tt.name, err)
+		}
+		if !reflect.DeepEqual(released, tt.want) {
+			t.Errorf("%v: released %v, want %v", tt.name, released, tt.want)
+		}
+		var open []string
+		for _, r := range []*Resource{pd, mr, qp} {
+			if !r.Closed() {
+				open = append(open, r.kind)
+			}
+		}
+		if !reflect.DeepEqual(open, tt.wantOpen) {
+			t.Errorf("%v: open %v, want %v", tt.name, open, tt.wantOpen)
+		}
+
+		tt.fail = ""
+		if err := pd.Close(); err != nil {
+			t.Errorf("%v: second Close = %v", tt.name, err)
+		}
+		if !pd.Closed() || !qp.Closed() {
+			t.Errorf("%v: open after second Close", tt.name)
+		}
+	}
+}
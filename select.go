@@ -0,0 +1,233 @@
+package RDMAGO
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	// GID index InitRCQP uses unless SetAddress chose another
+	DEFAULT_GID_INDEX = 1
+	// time SelectDevice waits for a port to become ACTIVE
+	DEFAULT_PORT_WAIT_MS = 10000
+	// interval of the port state checks while waiting
+	PORT_WAIT_INTERVAL = 100 * time.Millisecond
+)
+
+// DeviceSelector picks a device, port and GID index. Empty fields match anything; when
+// several GIDs match, RoCE v2 is preferred over v1 and IPv4 over IPv6.
+type DeviceSelector struct {
+	Device  string // device name, e.g. "mlx5_0"
+	Netdev  string // network interface of the device or GID, e.g. "eth0"
+	LocalIP string // address a RoCE GID must map to
+	Port    int    // 0 for any port
+
+	// GidIndex skips GID matching when set
+	GidIndex *int
+	// 1 or 2, 0 prefers RoCE v2
+	RoceVersion int
+	// "ipv4" or "ipv6", empty prefers IPv4
+	GidFamily string
+
+	// how long to wait for the port to become ACTIVE, DEFAULT_PORT_WAIT_MS when 0;
+	// negative fails right away
+	PortWait time.Duration
+}
+
+// Selection is where a QP should be created.
+type Selection struct {
+	Device   string
+	Port     int
+	GidIndex int
+	GID      GIDEntry
+}
+
+// selector returns the selection policy of the config.
+func (cfg *Config) selector() DeviceSelector {
+	sel := DeviceSelector{
+		Device:      cfg.DeviceName,
+		Netdev:      cfg.Netdev,
+		LocalIP:     cfg.LocalIP,
+		Port:        cfg.IbPort,
+		GidIndex:    cfg.GidIndex,
+		RoceVersion: cfg.RoceVersion,
+		GidFamily:   cfg.GidFamily,
+		PortWait:    time.Duration(cfg.PortWaitMs) * time.Millisecond,
+	}
+	return sel
+}
+
+// SelectDevice finds the device, port and GID matching sel and waits until the port is
+// ACTIVE, or ctx is done.
+func SelectDevice(ctx context.Context, sel DeviceSelector) (*Selection, error) {
+	if sel.RoceVersion != 0 && sel.RoceVersion != 1 && sel.RoceVersion != 2 {
+		return nil, errors.New(fmt.Sprintf("[SelectDevice] invalid RoCE version %v", sel.RoceVersion))
+	}
+	if sel.GidFamily != "" && sel.GidFamily != "ipv4" && sel.GidFamily != "ipv6" {
+		return nil, errors.New("[SelectDevice] invalid GID family " + sel.GidFamily)
+	}
+	var localIP net.IP
+	if sel.LocalIP != "" {
+		if localIP = net.ParseIP(sel.LocalIP); localIP == nil {
+			return nil, errors.New("[SelectDevice] invalid local IP " + sel.LocalIP)
+		}
+	}
+	wait := sel.PortWait
+	if wait == 0 {
+		wait = DEFAULT_PORT_WAIT_MS * time.Millisecond
+	}
+	deadline := time.Now().Add(wait)
+
+	for {
+		devices, err := Devices()
+		if err != nil {
+			return nil, fmt.Errorf("[SelectDevice] %w", err)
+		}
+		found, inactive := selectPort(devices, sel, localIP)
+		if found != nil {
+			return found, nil
+		}
+		if inactive == nil {
+			return nil, &VerbsError{Op: "SelectDevice", Resource: sel.String(), Kind: ErrNoDevice}
+		}
+		if !time.Now().Before(deadline) {
+			return nil, fmt.Errorf("[SelectDevice] %v port %v is not active: %w", inactive.Device, inactive.Port, ErrTimeout)
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(PORT_WAIT_INTERVAL):
+		}
+	}
+}
+
+// selectPort returns the best match on an active port or, when the only matches are on
+// ports that are not active yet, one of those as inactive.
+func selectPort(devices []DeviceInfo, sel DeviceSelector, localIP net.IP) (found, inactive *Selection) {
+	bestScore := -1
+	for _, device := range devices {
+		if sel.Device != "" && device.Name != sel.Device {
+			continue
+		}
+		for _, port := range device.Ports {
+			if sel.Port != 0 && port.Port != sel.Port {
+				continue
+			}
+			for _, candidate := range portCandidates(device, port, sel, localIP) {
+				if !port.Active() {
+					if inactive == nil {
+						c := candidate
+						inactive = &c
+					}
+					continue
+				}
+				if score := candidateScore(candidate.GID, sel); score > bestScore {
+					c := candidate
+					found, bestScore = &c, score
+				}
+			}
+		}
+	}
+	return found, inactive
+}
+
+// portCandidates returns the GIDs of port that sel allows.
+func portCandidates(device DeviceInfo, port PortInfo, sel DeviceSelector, localIP net.IP) []Selection {
+	var candidates []Selection
+	for _, gid := range port.GIDs {
+		if sel.GidIndex != nil {
+			if gid.Index != *sel.GidIndex {
+				continue
+			}
+		} else {
+			if (sel.RoceVersion == 1 && gid.Type != GID_TYPE_ROCE_V1) || (sel.RoceVersion == 2 && gid.Type != GID_TYPE_ROCE_V2) {
+				continue
+			}
+			if (sel.GidFamily == "ipv4" && (gid.IP == nil || gid.IP.To4() == nil)) ||
+				(sel.GidFamily == "ipv6" && (gid.IP == nil || gid.IP.To4() != nil)) {
+				continue
+			}
+			if localIP != nil && !localIP.Equal(gid.IP) {
+				continue
+			}
+		}
+		if sel.Netdev != "" && gid.Netdev != sel.Netdev && !containsString(device.Netdevs, sel.Netdev) {
+			continue
+		}
+		candidates = append(candidates, Selection{Device: device.Name, Port: port.Port, GidIndex: gid.Index, GID: gid})
+	}
+	if sel.GidIndex != nil && len(candidates) == 0 && len(port.GIDs) == 0 && port.LinkLayer == "InfiniBand" {
+		// the table of an IB port that is down may be empty
+		candidates = append(candidates, Selection{Device: device.Name, Port: port.Port, GidIndex: *sel.GidIndex})
+	}
+	return candidates
+}
+
+// candidateScore ranks GIDs: RoCE v2 over v1 over IB, IPv4 over IPv6, routable IPv6 over
+// link-local, and lower indexes first.
+func candidateScore(gid GIDEntry, sel DeviceSelector) int {
+	score := 0
+	if sel.RoceVersion == 0 && gid.Type == GID_TYPE_ROCE_V2 {
+		score += 8
+	}
+	if gid.Type != GID_TYPE_IB {
+		score += 4
+	}
+	if gid.IP != nil {
+		if gid.IP.To4() != nil {
+			score += 2
+		} else if !gid.IP.IsLinkLocalUnicast() {
+			score += 1
+		}
+	}
+	return score*1024 - gid.Index
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (sel DeviceSelector) String() string {
+	var parts []string
+	if sel.Device != "" {
+		parts = append(parts, "device "+sel.Device)
+	}
+	if sel.Netdev != "" {
+		parts = append(parts, "netdev "+sel.Netdev)
+	}
+	if sel.LocalIP != "" {
+		parts = append(parts, "ip "+sel.LocalIP)
+	}
+	if sel.Port != 0 {
+		parts = append(parts, fmt.Sprintf("port %v", sel.Port))
+	}
+	if sel.GidIndex != nil {
+		parts = append(parts, fmt.Sprintf("gid index %v", *sel.GidIndex))
+	}
+	if sel.RoceVersion != 0 {
+		parts = append(parts, fmt.Sprintf("RoCE v%v", sel.RoceVersion))
+	}
+	if sel.GidFamily != "" {
+		parts = append(parts, sel.GidFamily)
+	}
+	if len(parts) == 0 {
+		return "any device"
+	}
+	return strings.Join(parts, ", ")
+}
+
+// SetAddress sets the port and GID index the QP uses, e.g. from a Selection. It must be
+// called before InitRCQP; the defaults are IB_PORT and DEFAULT_GID_INDEX.
+func (ibRes *IBRes) SetAddress(port, gidIndex int) {
+	ibRes.Port = port
+	ibRes.GidIndex = gidIndex
+}
@@ -0,0 +1,103 @@
+package RDMAGO
+
+import (
+	"fmt"
+	"net"
+	"testing"
+)
+
+// port states as ibv_query_port reports them
+const (
+	testPortDown   = 1 // IBV_PORT_DOWN
+	testPortActive = 4 // IBV_PORT_ACTIVE
+)
+
+func TestCandidateScore(t *testing.T) {
+	tests := []struct {
+		name string
+		gid  GIDEntry
+		sel  DeviceSelector
+		want int
+	}{
+		{"RoCE v2 IPv4", GIDEntry{Index: 3, Type: GID_TYPE_ROCE_V2, IP: net.ParseIP("192.0.2.1")}, DeviceSelector{}, 14*1024 - 3},
+		{"RoCE v2 routable IPv6", GIDEntry{Index: 5, Type: GID_TYPE_ROCE_V2, IP: net.ParseIP("2001:db8::1")}, DeviceSelector{}, 13*1024 - 5},
+		{"RoCE v2 link-local", GIDEntry{Index: 1, Type: GID_TYPE_ROCE_V2, IP: net.ParseIP("fe80::1")}, DeviceSelector{}, 12*1024 - 1},
+		{"RoCE v1 IPv4", GIDEntry{Index: 2, Type: GID_TYPE_ROCE_V1, IP: net.ParseIP("192.0.2.1")}, DeviceSelector{}, 6*1024 - 2},
+		{"RoCE v2 when v2 is required", GIDEntry{Index: 3, Type: GID_TYPE_ROCE_V2, IP: net.ParseIP("192.0.2.1")}, DeviceSelector{RoceVersion: 2}, 6*1024 - 3},
+		{"InfiniBand", GIDEntry{Index: 0, Type: GID_TYPE_IB}, DeviceSelector{}, 0},
+	}
+	for _, tt := range tests {
+		if got := candidateScore(tt.gid, tt.sel); got != tt.want {
+			t.Errorf("%v: candidateScore = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSelectPort(t *testing.T) {
+	roce := DeviceInfo{
+		Name:    "mlx5_0",
+		Netdevs: []string{"eth0"},
+		Ports: []PortInfo{{
+			Port:      1,
+			LinkLayer: "Ethernet",
+			state:     testPortActive,
+			GIDs: []GIDEntry{
+				{Index: 0, Type: GID_TYPE_ROCE_V1, IP: net.ParseIP("fe80::1"), Netdev: "eth0"},
+				{Index: 1, Type: GID_TYPE_ROCE_V2, IP: net.ParseIP("fe80::1"), Netdev: "eth0"},
+				{Index: 2, Type: GID_TYPE_ROCE_V1, IP: net.ParseIP("192.0.2.1"), Netdev: "eth0"},
+				{Index: 3, Type: GID_TYPE_ROCE_V2, IP: net.ParseIP("192.0.2.1"), Netdev: "eth0"},
+			},
+		}},
+	}
+	down := DeviceInfo{
+		Name: "mlx5_1",
+		Ports: []PortInfo{{
+			Port:      1,
+			LinkLayer: "Ethernet",
+			state:     testPortDown,
+			GIDs:      []GIDEntry{{Index: 3, Type: GID_TYPE_ROCE_V2, IP: net.ParseIP("198.51.100.1")}},
+		}},
+	}
+	ib := DeviceInfo{
+		Name:  "mlx4_0",
+		Ports: []PortInfo{{Port: 2, LinkLayer: "InfiniBand", state: testPortDown}},
+	}
+	devices := []DeviceInfo{roce, down, ib}
+	index := func(i int) *int { return &i }
+
+	tests := []struct {
+		name         string
+		sel          DeviceSelector
+		localIP      string
+		wantFound    string // device/gid index
+		wantInactive string
+	}{
+		{"best GID", DeviceSelector{}, "", "mlx5_0/3", "mlx5_1/3"},
+		{"RoCE v1", DeviceSelector{RoceVersion: 1}, "", "mlx5_0/2", ""},
+		{"IPv6", DeviceSelector{GidFamily: "ipv6"}, "", "mlx5_0/1", ""},
+		{"GID index", DeviceSelector{Device: "mlx5_0", GidIndex: index(0)}, "", "mlx5_0/0", ""},
+		{"netdev", DeviceSelector{Netdev: "eth0", RoceVersion: 1}, "", "mlx5_0/2", ""},
+		{"local IP on a port that is down", DeviceSelector{}, "198.51.100.1", "", "mlx5_1/3"},
+		{"empty GID table of a down IB port", DeviceSelector{Device: "mlx4_0", GidIndex: index(0)}, "", "", "mlx4_0/0"},
+		{"no match", DeviceSelector{Device: "mlx5_9"}, "", "", ""},
+	}
+	describe := func(s *Selection) string {
+		if s == nil {
+			return ""
+		}
+		return fmt.Sprintf("%v/%v", s.Device, s.GidIndex)
+	}
+	for _, tt := range tests {
+		var localIP net.IP
+		if tt.localIP != "" {
+			localIP = net.ParseIP(tt.localIP)
+		}
+		found, inactive := selectPort(devices, tt.sel, localIP)
+		if got := describe(found); got != tt.wantFound {
+			t.Errorf("%v: found %q, want %q", tt.name, got, tt.wantFound)
+		}
+		if got := describe(inactive); got != tt.wantInactive {
+			t.Errorf("%v: inactive %q, want %q", tt.name, got, tt.wantInactive)
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package RDMAGO
+
+/*
+#cgo CFLAGS: -I/usr/include/infiniband
+#cgo LDFLAGS: -libverbs -L. -lwrapper
+
+#include "wrapper.h"
+
+#include <stdlib.h>
+#include <infiniband/verbs.h>
+*/
+import "C"
+import (
+	"errors"
+	"fmt"
+	"unsafe"
+)
+
+// Send queue accounting with selective signaling.
+//
+// Only every SignalInterval-th send asks for a completion. An RC QP completes its send
+// WRs in order, so one signaled completion means every WR posted before it has left the
+// send queue too. sigRing remembers, for every signaled WR still outstanding, the value
+// of sendPosted right after it was posted; popping it on completion tells how many slots
+// became free.
+
+// SetSendOptions must be called before InitRCQP.
+// maxInlineData: payload size up to which sends are posted with IBV_SEND_INLINE, 0 disables inline.
+// signalInterval: request a completion for every Nth send, values <= 1 signal every send.
+func (ibRes *IBRes) SetSendOptions(maxInlineData, signalInterval int) {
+	if maxInlineData < 0 {
+		maxInlineData = 0
+	}
+	if signalInterval < 1 {
+		signalInterval = 1
+	}
+	ibRes.MaxInlineData = C.uint(maxInlineData)
+	ibRes.SignalInterval = signalInterval
+}
+
+func initSendSlots(ibRes *IBRes) error {
+	if ibRes.SignalInterval < 1 {
+		ibRes.SignalInterval = 1
+	}
+	// every outstanding WR may be signaled, callers ask for signals on top of the interval.
+	// A power of two keeps the ring index continuous when the counters wrap.
+	size := uint32(1)
+	for size < uint32(ibRes.MaxSendWR) {
+		size <<= 1
+	}
+	ibRes.sigRing = make([]uint32, size)
+	ibRes.sigRingSize = size
+	ibRes.ResetSendSlots()
+	return nil
+}
+
+func freeSendSlots(ibRes *IBRes) {
+	ibRes.sigRing = nil
+	ibRes.sigRingSize = 0
+}
+
+// ResetSendSlots forgets every outstanding send. Call it after the QP was drained or reset,
+// since flushed WRs complete regardless of whether they were signaled.
+func (ibRes *IBRes) ResetSendSlots() {
+	ibRes.sendPosted = 0
+	ibRes.sendReclaimed = 0
+	ibRes.sendUnsignaled = 0
+	ibRes.sigHead = 0
+	ibRes.sigTail = 0
+}
+
+// SendSlotsAvailable returns how many more sends can be posted before the send queue is full.
+func (ibRes *IBRes) SendSlotsAvailable() int {
+	return int(uint32(ibRes.MaxSendWR) - (ibRes.sendPosted - ibRes.sendReclaimed))
+}
+
+// OnSendCompletion must be called for every successful send completion polled from the CQ,
+// it frees the send queue slots covered by that completion.
+func (ibRes *IBRes) OnSendCompletion() {
+	if ibRes.sigHead == ibRes.sigTail {
+		ibRes.logger().Debug("[OnSendCompletion] send completion without outstanding signaled WR")
+		return
+	}
+	ibRes.sendReclaimed = ibRes.sigRing[ibRes.sigHead%ibRes.sigRingSize]
+	ibRes.sigHead++
+}
+
+// nextSendFlags decides whether the next send is signaled and reserves its slot.
+func (ibRes *IBRes) nextSendFlags(length int, signaled bool) (C.uint, error) {
+	if ibRes.sigRing == nil {
+		return 0, fmt.Errorf("[PostSend] QP not created: %w", ErrQPState)
+	}
+	outstanding := ibRes.sendPosted - ibRes.sendReclaimed
+	if outstanding >= uint32(ibRes.MaxSendWR) {
+		return 0, fmt.Errorf("[PostSend] %w", ErrQueueFull)
+	}
+
+	// the last free slot is always signaled, otherwise nothing would ever reclaim the queue
+	if ibRes.sendUnsignaled+1 >= ibRes.SignalInterval || outstanding+1 == uint32(ibRes.MaxSendWR) {
+		signaled = true
+	}
+
+	var flags C.uint
+	if length > 0 && length <= int(ibRes.MaxInlineData) {
+		flags |= C.IBV_SEND_INLINE
+	}
+	if signaled {
+		if ibRes.sigTail-ibRes.sigHead == ibRes.sigRingSize {
+			return 0, fmt.Errorf("[PostSend] %w", ErrQueueFull)
+		}
+		flags |= C.IBV_SEND_SIGNALED
+	}
+	return flags, nil
+}
+
+func (ibRes *IBRes) commitSend(flags C.uint) {
+	ibRes.sendPosted++
+	if flags&C.IBV_SEND_SIGNALED != 0 {
+		ibRes.sigRing[ibRes.sigTail%ibRes.sigRingSize] = ibRes.sendPosted
+		ibRes.sigTail++
+		ibRes.sendUnsignaled = 0
+	} else {
+		ibRes.sendUnsignaled++
+	}
+}
+
+// sendSlotState is what commitSend changes, saved to undo the commits of a chain
+// that was only partially accepted by ibv_post_send.
+type sendSlotState struct {
+	posted     uint32
+	unsignaled int
+	tail       uint32
+}
+
+func (ibRes *IBRes) saveSendSlots() sendSlotState {
+	return sendSlotState{posted: ibRes.sendPosted, unsignaled: ibRes.sendUnsignaled, tail: ibRes.sigTail}
+}
+
+func (ibRes *IBRes) restoreSendSlots(state sendSlotState) {
+	ibRes.sendPosted = state.posted
+	ibRes.sendUnsignaled = state.unsignaled
+	ibRes.sigTail = state.tail
+}
+
+// PostSend sends the first length bytes of IbBuf with immData. Payloads that fit into
+// MaxInlineData go inline. The send is signaled when signaled is set or the signal
+// interval or send queue depth require it; wait for a signaled send before reusing IbBuf.
+func (ibRes *IBRes) PostSend(length int, immData uint32, wrID uint64, signaled bool) error {
+	return ibRes.PostSendAt(0, length, immData, wrID, signaled)
+}
+
+// PostSendAt is PostSend for the length bytes at offset in IbBuf.
+func (ibRes *IBRes) PostSendAt(offset, length int, immData uint32, wrID uint64, signaled bool) error {
+	if offset < 0 || length < 0 || offset+length > int(ibRes.IbBufSize) {
+		return errors.New(fmt.Sprintf("[PostSend] invalid range %v+%v", offset, length))
+	}
+	flags, err := ibRes.nextSendFlags(length, signaled)
+	if err != nil {
+		return err
+	}
+
+	err = IbvPostSendFlags(ibRes.Qp, unsafe.Add(unsafe.Pointer(ibRes.IbBuf), offset), C.uint(length), ibRes.Mr.lkey,
+		C.ulong(wrID), C.uint(immData), flags)
+	if err != nil {
+		return err
+	}
+	ibRes.commitSend(flags)
+	if ibRes.capture != nil {
+		ibRes.captureSend(C.IBV_WR_SEND_WITH_IMM, unsafe.Slice((*byte)(unsafe.Add(unsafe.Pointer(ibRes.IbBuf), offset)), length), immData, wrID, flags)
+	}
+	return nil
+}
+
+// PostInline sends data inline without copying it into the MR, for small control messages.
+// data may be empty to send only the immediate value.
+func (ibRes *IBRes) PostInline(data []byte, immData uint32, wrID uint64, signaled bool) error {
+	if len(data) > int(ibRes.MaxInlineData) {
+		return errors.New(fmt.Sprintf("[PostInline] %v bytes exceeds max_inline_data %v", len(data), ibRes.MaxInlineData))
+	}
+	flags, err := ibRes.nextSendFlags(len(data), signaled)
+	if err != nil {
+		return err
+	}
+
+	var buf unsafe.Pointer
+	if len(data) > 0 {
+		buf = unsafe.Pointer(&data[0])
+	}
+	err = IbvPostSendFlags(ibRes.Qp, buf, C.uint(len(data)), 0, C.ulong(wrID), C.uint(immData), flags)
+	if err != nil {
+		return err
+	}
+	ibRes.commitSend(flags)
+	ibRes.captureSend(C.IBV_WR_SEND_WITH_IMM, data, immData, wrID, flags)
+	return nil
+}
+
+// captureSend records a posted send WR, immData is ignored unless opcode carries one.
+func (ibRes *IBRes) captureSend(opcode C.uint, data []byte, immData uint32, wrID uint64, flags C.uint) {
+	if ibRes.capture == nil {
+		return
+	}
+	rec := captureRecord{
+		typ:       CAPTURE_POST_SEND,
+		opcode:    uint8(opcode),
+		qpNum:     uint32(ibRes.Qp.qp_num),
+		peerQpNum: ibRes.peerQpNum,
+		length:    uint32(len(data)),
+		wrID:      wrID,
+	}
+	if opcode == C.IBV_WR_SEND_WITH_IMM || opcode == C.IBV_WR_RDMA_WRITE_WITH_IMM {
+		rec.imm = immData
+		rec.flags |= CAPTURE_FLAG_IMM
+	}
+	if flags&C.IBV_SEND_SIGNALED != 0 {
+		rec.flags |= CAPTURE_FLAG_SIGNALED
+	}
+	if flags&C.IBV_SEND_INLINE != 0 {
+		rec.flags |= CAPTURE_FLAG_INLINE
+	}
+	ibRes.capture.record(rec, data)
+}
@@ -0,0 +1,48 @@
+package RDMAGO
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestSendSlotsSignaled(t *testing.T) {
+	tests := []struct {
+		name           string
+		signalInterval int
+		signaled       bool
+		start          uint32 // counters before the first send
+	}{
+		{"interval", 16, false, 0},
+		{"every send signaled", 16, true, 0},
+		{"every send signaled across the wrap", 16, true, 1<<32 - 50},
+		{"interval across the wrap", 7, false, 1<<32 - 50},
+	}
+	for _, tt := range tests {
+		ibRes := &IBRes{}
+		ibRes.MaxSendWR = 128
+		ibRes.SetSendOptions(0, tt.signalInterval)
+		initSendSlots(ibRes)
+		ibRes.sendPosted, ibRes.sendReclaimed = tt.start, tt.start
+		ibRes.sigHead, ibRes.sigTail = tt.start, tt.start
+
+		// fill the queue, complete what was signaled and fill it again
+		for round := 0; round < 3; round++ {
+			for i := 0; i < 128; i++ {
+				flags, err := ibRes.nextSendFlags(0, tt.signaled)
+				if err != nil {
+					t.Fatalf("%v: round %v send %v: %v", tt.name, round, i, err)
+				}
+				ibRes.commitSend(flags)
+			}
+			if _, err := ibRes.nextSendFlags(0, tt.signaled); !errors.Is(err, ErrQueueFull) {
+				t.Fatalf("%v: round %v send 129 returned %v, want ErrQueueFull", tt.name, round, err)
+			}
+			for ibRes.sigHead != ibRes.sigTail {
+				ibRes.OnSendCompletion()
+			}
+			if free := ibRes.SendSlotsAvailable(); free != 128 {
+				t.Fatalf("%v: round %v leaves %v free slots, want 128", tt.name, round, free)
+			}
+		}
+	}
+}
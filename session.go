@@ -0,0 +1,387 @@
+package RDMAGO
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+const (
+	DEFAULT_SESSION_WINDOW = 64
+
+	// frame header: kind, sequence number, cumulative ack
+	SESSION_HEADER_SIZE = 17
+
+	sessionFrameData = 1
+	sessionFrameAck  = 2
+)
+
+// sessionEndpoint is what a Session uses of its Endpoint.
+type sessionEndpoint interface {
+	Send(data []byte, immData uint32) error
+	SendContext(ctx context.Context, data []byte, immData uint32) error
+	Recv() (Message, error)
+	State() EndpointState
+	MaxMessageSize() int
+	setSession(s *Session)
+}
+
+type sessionEntry struct {
+	seq     uint64
+	data    []byte
+	immData uint32
+}
+
+type SessionStats struct {
+	Sent       uint64 // messages accepted by Send
+	Replayed   uint64 // frames sent again after a reconnect
+	Delivered  uint64 // messages handed to Recv
+	Duplicates uint64 // frames dropped because they were already delivered
+	Gaps       uint64 // frames dropped because an earlier one was missing
+	Unacked    int    // messages buffered until the peer acknowledges them
+}
+
+// Session numbers the messages sent over an Endpoint and keeps them until the peer
+// acknowledges them. On reconnect both sides exchange the last sequence number they
+// received in order and the sender replays everything after it, so Recv sees every
+// message exactly once and in order across QP failures. Acks ride on data frames and
+// are sent on their own every window/2 messages when the receiver has nothing to send.
+//
+// The Session owns the Endpoint's receive side, Endpoint.Recv must not be called directly.
+type Session struct {
+	ep     sessionEndpoint
+	log    Logger
+	window int
+
+	// sendMu keeps frames on the wire in sequence order and serializes replays
+	sendMu sync.Mutex
+
+	mu          sync.Mutex
+	windowFree  *sync.Cond
+	nextSeq     uint64
+	unacked     []sessionEntry
+	recvSeq     uint64
+	ackedSeq    uint64 // last recvSeq sent to the peer
+	peerRecvSeq uint64
+	replay      bool
+	stats       SessionStats
+	err         error
+
+	inbox    chan Message
+	replayCh chan struct{}
+	ackCh    chan struct{}
+	// ctx ends the ack sends when the session is closed
+	ctx    context.Context
+	cancel context.CancelFunc
+	stop   chan struct{}
+	done   chan struct{}
+	once   sync.Once
+}
+
+// NewSession starts a session on ep. window is the number of unacknowledged messages
+// Send buffers before it blocks, DEFAULT_SESSION_WINDOW when 0.
+func NewSession(ep *Endpoint, window int) (*Session, error) {
+	return newSession(ep, ep.log, window)
+}
+
+func newSession(ep sessionEndpoint, log Logger, window int) (*Session, error) {
+	if window < 0 {
+		return nil, errors.New(fmt.Sprintf("[NewSession] invalid window %v", window))
+	}
+	if window == 0 {
+		window = DEFAULT_SESSION_WINDOW
+	}
+	s := &Session{
+		ep:       ep,
+		log:      log,
+		window:   window,
+		inbox:    make(chan Message, window),
+		replayCh: make(chan struct{}, 1),
+		ackCh:    make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	s.windowFree = sync.NewCond(&s.mu)
+	ep.setSession(s)
+
+	go s.recvLoop()
+	go s.replayLoop()
+	go s.ackLoop()
+	return s, nil
+}
+
+// MaxMessageSize is the largest payload Send accepts.
+func (s *Session) MaxMessageSize() int {
+	return s.ep.MaxMessageSize() - SESSION_HEADER_SIZE
+}
+
+func (s *Session) lastRecvSeq() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.recvSeq
+}
+
+// resume runs during the handshake with the peer's last received sequence number.
+func (s *Session) resume(peerRecvSeq uint64) {
+	s.mu.Lock()
+	s.peerRecvSeq = peerRecvSeq
+	s.ackLocked(peerRecvSeq)
+	s.replay = len(s.unacked) > 0
+	s.mu.Unlock()
+
+	select {
+	case s.replayCh <- struct{}{}:
+	default:
+	}
+}
+
+// ackLocked drops the messages up to seq, the peer has them.
+func (s *Session) ackLocked(seq uint64) {
+	n := 0
+	for n < len(s.unacked) && s.unacked[n].seq <= seq {
+		s.unacked[n] = sessionEntry{}
+		n++
+	}
+	if n > 0 {
+		s.unacked = s.unacked[n:]
+		s.windowFree.Broadcast()
+	}
+}
+
+func encodeFrame(kind uint8, seq, ack uint64, data []byte) []byte {
+	frame := make([]byte, SESSION_HEADER_SIZE+len(data))
+	frame[0] = kind
+	binary.LittleEndian.PutUint64(frame[1:], seq)
+	binary.LittleEndian.PutUint64(frame[9:], ack)
+	copy(frame[SESSION_HEADER_SIZE:], data)
+	return frame
+}
+
+// Send buffers data until the peer acknowledges it and transmits it. It blocks while the
+// window is full. A transmission cut off by a connection failure is replayed after the
+// reconnect, Send only fails when the endpoint gave up or the session was closed.
+func (s *Session) Send(data []byte, immData uint32) error {
+	if len(data) > s.MaxMessageSize() {
+		return errors.New(fmt.Sprintf("[Session] message of %v bytes exceeds %v", len(data), s.MaxMessageSize()))
+	}
+
+	s.mu.Lock()
+	for len(s.unacked) >= s.window && s.err == nil {
+		s.windowFree.Wait()
+	}
+	if s.err != nil {
+		err := s.err
+		s.mu.Unlock()
+		return err
+	}
+	s.nextSeq++
+	entry := sessionEntry{seq: s.nextSeq, data: append([]byte(nil), data...), immData: immData}
+	s.unacked = append(s.unacked, entry)
+	s.stats.Sent++
+	s.mu.Unlock()
+
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+	if err := s.replayLocked(); err != nil {
+		return err
+	}
+	return s.transmit(entry)
+}
+
+// transmit sends one data frame, sendMu must be held.
+func (s *Session) transmit(entry sessionEntry) error {
+	s.mu.Lock()
+	ack := s.recvSeq
+	s.ackedSeq = ack
+	s.mu.Unlock()
+
+	err := s.ep.Send(encodeFrame(sessionFrameData, entry.seq, ack, entry.data), entry.immData)
+	return s.sendResult(err)
+}
+
+// sendResult ignores errors of sends the reconnect will replay. Only a connected or
+// reconnecting endpoint replays; once it is closing the message is never delivered.
+func (s *Session) sendResult(err error) error {
+	if err == nil {
+		return nil
+	}
+	switch s.ep.State() {
+	case ENDPOINT_CONNECTED, ENDPOINT_RECONNECTING:
+		s.log.Debug("[Session] send deferred to replay", "error", err)
+		return nil
+	case ENDPOINT_FAILED, ENDPOINT_CLOSED:
+		s.fail(err)
+	}
+	return err
+}
+
+// replayLocked resends everything the peer did not receive before the last reconnect,
+// sendMu must be held.
+func (s *Session) replayLocked() error {
+	s.mu.Lock()
+	if !s.replay {
+		s.mu.Unlock()
+		return nil
+	}
+	s.replay = false
+	entries := append([]sessionEntry(nil), s.unacked...)
+	peerRecvSeq := s.peerRecvSeq
+	s.stats.Replayed += uint64(len(entries))
+	s.mu.Unlock()
+
+	s.log.Info("[Session] replaying", "messages", len(entries), "after_seq", peerRecvSeq)
+	for _, entry := range entries {
+		if err := s.transmit(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Session) replayLoop() {
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-s.replayCh:
+		}
+		s.sendMu.Lock()
+		s.replayLocked()
+		s.sendMu.Unlock()
+	}
+}
+
+func (s *Session) recvLoop() {
+	defer close(s.done)
+	for {
+		msg, err := s.ep.Recv()
+		if err != nil {
+			s.fail(err)
+			return
+		}
+		if len(msg.Data) < SESSION_HEADER_SIZE {
+			s.log.Error("[Session] dropping frame", nil, "bytes", len(msg.Data))
+			continue
+		}
+		kind := msg.Data[0]
+		seq := binary.LittleEndian.Uint64(msg.Data[1:])
+		ack := binary.LittleEndian.Uint64(msg.Data[9:])
+
+		s.mu.Lock()
+		s.ackLocked(ack)
+		if kind != sessionFrameData {
+			s.mu.Unlock()
+			continue
+		}
+		expected := s.recvSeq + 1
+		if !s.deliverLocked(seq) {
+			s.mu.Unlock()
+			if seq > expected && s.log.DebugEnabled() {
+				s.log.Debug("[Session] dropping frame after gap", "seq", seq, "expected_seq", expected)
+			}
+			continue
+		}
+		sendAck := s.recvSeq-s.ackedSeq >= uint64(s.window/2+1)
+		s.mu.Unlock()
+
+		select {
+		case s.inbox <- Message{Data: msg.Data[SESSION_HEADER_SIZE:], ImmData: msg.ImmData}:
+		case <-s.stop:
+			return
+		}
+		if sendAck {
+			select {
+			case s.ackCh <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// deliverLocked takes the data frame seq when it is the next in order. Frames already
+// delivered are duplicates; frames after a gap were sent between a reconnect and the
+// replay, which brings them again.
+func (s *Session) deliverLocked(seq uint64) bool {
+	switch {
+	case seq <= s.recvSeq:
+		s.stats.Duplicates++
+		return false
+	case seq > s.recvSeq+1:
+		s.stats.Gaps++
+		return false
+	}
+	s.recvSeq = seq
+	s.stats.Delivered++
+	return true
+}
+
+// ackLoop acknowledges everything received so far in a frame of its own when no data
+// frame carried the ack. It runs apart from recvLoop, which must keep receiving while the
+// ack waits for a credit, and without sendMu, which a Send waiting for a credit holds.
+func (s *Session) ackLoop() {
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-s.ackCh:
+		}
+		s.mu.Lock()
+		ack := s.recvSeq
+		carried := ack == s.ackedSeq
+		s.ackedSeq = ack
+		s.mu.Unlock()
+		if !carried {
+			s.sendResult(s.ep.SendContext(s.ctx, encodeFrame(sessionFrameAck, 0, ack, nil), 0))
+		}
+	}
+}
+
+// Recv returns the next message in sequence order.
+func (s *Session) Recv() (Message, error) {
+	select {
+	case msg := <-s.inbox:
+		return msg, nil
+	case <-s.done:
+	case <-s.stop:
+	}
+	// deliver what arrived before the session ended
+	select {
+	case msg := <-s.inbox:
+		return msg, nil
+	default:
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return Message{}, s.err
+}
+
+func (s *Session) fail(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err == nil {
+		s.err = fmt.Errorf("[Session] %w", err)
+	}
+	s.windowFree.Broadcast()
+}
+
+func (s *Session) Stats() SessionStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := s.stats
+	stats.Unacked = len(s.unacked)
+	return stats
+}
+
+// Close stops the session, unacknowledged messages are discarded. The Endpoint stays
+// open and must be closed by the caller, which also ends the receive goroutine.
+func (s *Session) Close() {
+	s.once.Do(func() {
+		s.ep.setSession(nil)
+		s.fail(ErrClosed)
+		close(s.stop)
+		s.cancel()
+	})
+}
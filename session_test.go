@@ -0,0 +1,194 @@
+package RDMAGO
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSessionDeliver(t *testing.T) {
+	tests := []struct {
+		seq         uint64
+		want        bool
+		wantRecvSeq uint64
+	}{
+		{1, true, 1},
+		{2, true, 2},
+		{2, false, 2}, // duplicate
+		{4, false, 2}, // gap, the replay brings it again
+		{3, true, 3},
+		{1, false, 3}, // duplicate of an older frame
+		{4, true, 4},
+	}
+	s := &Session{}
+	for i, tt := range tests {
+		if got := s.deliverLocked(tt.seq); got != tt.want {
+			t.Errorf("%v: deliverLocked(%v) = %v, want %v", i, tt.seq, got, tt.want)
+		}
+		if s.recvSeq != tt.wantRecvSeq {
+			t.Errorf("%v: recvSeq = %v, want %v", i, s.recvSeq, tt.wantRecvSeq)
+		}
+	}
+	want := SessionStats{Delivered: 4, Duplicates: 2, Gaps: 1}
+	if s.stats != want {
+		t.Errorf("stats = %+v, want %+v", s.stats, want)
+	}
+}
+
+func TestSessionAck(t *testing.T) {
+	tests := []struct {
+		ack  uint64
+		want []uint64
+	}{
+		{2, []uint64{3, 4, 5}},
+		{3, []uint64{4, 5}},
+		{4, []uint64{5}},
+		{9, nil},
+	}
+	for _, tt := range tests {
+		s := &Session{unacked: []sessionEntry{{seq: 3}, {seq: 4}, {seq: 5}}}
+		s.windowFree = sync.NewCond(&s.mu)
+		s.ackLocked(tt.ack)
+		var got []uint64
+		for _, entry := range s.unacked {
+			got = append(got, entry.seq)
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("ackLocked(%v) leaves %v, want %v", tt.ack, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("ackLocked(%v) leaves %v, want %v", tt.ack, got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+// pipeEndpoint hands frames to its peer through a channel whose capacity is the credit the
+// peer granted: Send blocks until the peer's Recv took a frame, like an Endpoint out of
+// credits.
+type pipeEndpoint struct {
+	out    chan<- Message
+	in     <-chan Message
+	closed chan struct{}
+}
+
+func newPipeEndpoints(credits int) (*pipeEndpoint, *pipeEndpoint) {
+	ab, ba := make(chan Message, credits), make(chan Message, credits)
+	closed := make(chan struct{})
+	return &pipeEndpoint{out: ab, in: ba, closed: closed}, &pipeEndpoint{out: ba, in: ab, closed: closed}
+}
+
+func (p *pipeEndpoint) Send(data []byte, immData uint32) error {
+	return p.SendContext(context.Background(), data, immData)
+}
+
+func (p *pipeEndpoint) SendContext(ctx context.Context, data []byte, immData uint32) error {
+	select {
+	case p.out <- Message{Data: append([]byte(nil), data...), ImmData: immData}:
+		return nil
+	case <-p.closed:
+		return ErrClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (p *pipeEndpoint) Recv() (Message, error) {
+	select {
+	case msg := <-p.in:
+		return msg, nil
+	case <-p.closed:
+		return Message{}, ErrClosed
+	}
+}
+
+func (p *pipeEndpoint) State() EndpointState {
+	select {
+	case <-p.closed:
+		return ENDPOINT_CLOSED
+	default:
+		return ENDPOINT_CONNECTED
+	}
+}
+
+func (p *pipeEndpoint) MaxMessageSize() int { return 1024 }
+
+func (p *pipeEndpoint) setSession(*Session) {}
+
+func TestSessionBidirectionalCredits(t *testing.T) {
+	tests := []struct {
+		name     string
+		credits  int
+		window   int
+		messages int
+	}{
+		{"one credit", 1, 4, 200},
+		{"credits below the window", 2, 8, 500},
+		{"credits above the window", 16, 4, 500},
+	}
+	for _, tt := range tests {
+		a, b := newPipeEndpoints(tt.credits)
+		sa, err := newSession(a, NopLogger(), tt.window)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sb, err := newSession(b, NopLogger(), tt.window)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// both sides send and receive at once, every Send may wait for a credit
+		errs := make(chan error, 4)
+		for _, s := range []*Session{sa, sb} {
+			s := s
+			go func() {
+				for i := 0; i < tt.messages; i++ {
+					if err := s.Send([]byte{byte(i)}, uint32(i)); err != nil {
+						errs <- err
+						return
+					}
+				}
+				errs <- nil
+			}()
+			go func() {
+				for i := 0; i < tt.messages; i++ {
+					msg, err := s.Recv()
+					if err != nil {
+						errs <- err
+						return
+					}
+					if msg.ImmData != uint32(i) || len(msg.Data) != 1 || msg.Data[0] != byte(i) {
+						errs <- fmt.Errorf("message %v arrived as %v %v", i, msg.ImmData, msg.Data)
+						return
+					}
+				}
+				errs <- nil
+			}()
+		}
+		timeout := time.After(10 * time.Second)
+		for i := 0; i < 4; i++ {
+			select {
+			case err := <-errs:
+				if err != nil {
+					t.Errorf("%v: %v", tt.name, err)
+				}
+			case <-timeout:
+				t.Fatalf("%v: no progress, stats %+v and %+v", tt.name, sa.Stats(), sb.Stats())
+			}
+		}
+
+		for _, s := range []*Session{sa, sb} {
+			if stats := s.Stats(); stats.Delivered != uint64(tt.messages) || stats.Duplicates != 0 || stats.Gaps != 0 {
+				t.Errorf("%v: stats %+v", tt.name, stats)
+			}
+		}
+		sa.Close()
+		sb.Close()
+		close(a.closed)
+	}
+}
@@ -3,17 +3,45 @@ package RDMAGO
 import "C"
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"net"
+	"os"
 	"strings"
+	"time"
 	"unsafe"
 )
 
+const (
+	HANDSHAKE_TIMEOUT = 10 * time.Second
+	handshakeReady    = "ready"
+)
+
 type GoQPInfo struct {
 	QpNum uint32   `json:"qp_num"`
 	Lid   uint16   `json:"lid"`
 	Gid   [16]byte `json:"gid"`
+
+	// LastRecvSeq is the last session sequence number the sender received in order
+	LastRecvSeq uint64 `json:"last_recv_seq,omitempty"`
+	// Credits is the number of receives the sender has posted for the connection
+	Credits uint32 `json:"credits,omitempty"`
+	// EndpointID identifies the sending Endpoint across reconnects
+	EndpointID uint64 `json:"endpoint_id,omitempty"`
+
+	// port, GID index and GID type the sender chose
+	Port     int    `json:"port,omitempty"`
+	GidIndex int    `json:"gid_index,omitempty"`
+	GidType  string `json:"gid_type,omitempty"`
+
+	// buffer of the sender that accepts RDMA writes
+	Addr uint64 `json:"addr,omitempty"`
+	Rkey uint32 `json:"rkey,omitempty"`
+	Len  uint32 `json:"len,omitempty"`
 }
 
 func ConvertToGoQPInfo(qpInfo QPInfo) GoQPInfo {
@@ -21,9 +49,15 @@ func ConvertToGoQPInfo(qpInfo QPInfo) GoQPInfo {
 	copy(gid[:], C.GoBytes(unsafe.Pointer(&qpInfo.Gid), 16))
 
 	return GoQPInfo{
-		QpNum: uint32(qpInfo.QpNum),
-		Lid:   uint16(qpInfo.Lid),
-		Gid:   gid,
+		QpNum:    uint32(qpInfo.QpNum),
+		Lid:      uint16(qpInfo.Lid),
+		Gid:      gid,
+		Port:     qpInfo.Port,
+		GidIndex: qpInfo.GidIndex,
+		GidType:  qpInfo.GidType,
+		Addr:     qpInfo.Addr,
+		Rkey:     qpInfo.Rkey,
+		Len:      qpInfo.Len,
 	}
 }
 
@@ -36,23 +70,57 @@ func ConvertToCQPInfo(goQPInfo GoQPInfo) QPInfo {
 	copy((*[16]byte)(unsafe.Pointer(&gid))[:], goQPInfo.Gid[:])
 
 	qpInfo.Gid = gid
+	qpInfo.Port = goQPInfo.Port
+	qpInfo.GidIndex = goQPInfo.GidIndex
+	qpInfo.GidType = goQPInfo.GidType
+	qpInfo.Addr = goQPInfo.Addr
+	qpInfo.Rkey = goQPInfo.Rkey
+	qpInfo.Len = goQPInfo.Len
 	return qpInfo
 }
 
+// watchContext closes c when ctx is done before the returned function is called,
+// which unblocks Accept, Read and Write on it.
+func watchContext(ctx context.Context, c io.Closer) func() {
+	if ctx.Done() == nil {
+		return func() {}
+	}
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.Close()
+		case <-stop:
+		}
+	}()
+	return func() { close(stop) }
+}
+
 // StartServer start server
 func StartServer(port string, info QPInfo) (error, *QPInfo) {
-	listener, err := net.Listen("tcp", ":"+port)
+	return StartServerContext(context.Background(), port, info)
+}
+
+// StartServerContext is StartServer that returns ctx.Err() when ctx is done first.
+func StartServerContext(ctx context.Context, port string, info QPInfo) (error, *QPInfo) {
+	var lc net.ListenConfig
+	listener, err := lc.Listen(ctx, "tcp", ":"+port)
 	if err != nil {
-		return errors.New("[Socket] Error starting server: " + err.Error()), nil
+		return fmt.Errorf("[Socket] Error starting server: %w", err), nil
 	}
 	defer listener.Close()
 
+	stopWatch := watchContext(ctx, listener)
 	conn, err := listener.Accept()
+	stopWatch()
 	if err != nil {
-		return errors.New("[Socket] Error accepting connection: " + err.Error()), nil
+		if ctx.Err() != nil {
+			return ctx.Err(), nil
+		}
+		return fmt.Errorf("[Socket] Error accepting connection: %w", err), nil
 	}
 
-	err, QPInfo := handleConnection(conn, info)
+	err, QPInfo := handleConnection(ctx, conn, info)
 	if err != nil {
 		return err, nil
 	}
@@ -60,21 +128,29 @@ func StartServer(port string, info QPInfo) (error, *QPInfo) {
 	return nil, QPInfo
 }
 
-func handleConnection(conn net.Conn, info QPInfo) (error, *QPInfo) {
+func handleConnection(ctx context.Context, conn net.Conn, info QPInfo) (error, *QPInfo) {
 	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	defer watchContext(ctx, conn)()
+
 	message, err := bufio.NewReader(conn).ReadString('\n')
 	if err != nil {
-		return errors.New("[Socket] Error reading message: " + err.Error()), nil
+		if ctx.Err() != nil {
+			return ctx.Err(), nil
+		}
+		return fmt.Errorf("[Socket] Error reading message: %w", err), nil
 	}
 
 	jsonData, err := json.Marshal(ConvertToGoQPInfo(info))
 	if err != nil {
-		return errors.New("[Socket] Error marshalling QP info: " + err.Error()), nil
+		return fmt.Errorf("[Socket] Error marshalling QP info: %w", err), nil
 	}
 
 	_, err = conn.Write(append(jsonData, '\n'))
 	if err != nil {
-		return errors.New("[Socket] Error writing response: " + err.Error()), nil
+		return fmt.Errorf("[Socket] Error writing response: %w", err), nil
 	}
 
 	message = strings.TrimSuffix(message, "\n")
@@ -93,25 +169,41 @@ func handleConnection(conn net.Conn, info QPInfo) (error, *QPInfo) {
 
 // StartClient start client
 func StartClient(address string, info QPInfo) (error, *QPInfo) {
-	conn, err := net.Dial("tcp", address)
+	return StartClientContext(context.Background(), address, info)
+}
+
+// StartClientContext is StartClient that returns ctx.Err() when ctx is done first.
+func StartClientContext(ctx context.Context, address string, info QPInfo) (error, *QPInfo) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", address)
 	if err != nil {
-		return errors.New("[Socket] Error connecting to server: " + err.Error()), nil
+		if ctx.Err() != nil {
+			return ctx.Err(), nil
+		}
+		return fmt.Errorf("[Socket] Error connecting to server: %w", err), nil
 	}
 	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	defer watchContext(ctx, conn)()
 
 	jsonData, err := json.Marshal(ConvertToGoQPInfo(info))
 	if err != nil {
-		return errors.New("[Socket] Error marshalling QP info: " + err.Error()), nil
+		return fmt.Errorf("[Socket] Error marshalling QP info: %w", err), nil
 	}
 
 	_, err = conn.Write(append(jsonData, '\n'))
 	if err != nil {
-		return errors.New("[Socket] Error writing message: " + err.Error()), nil
+		return fmt.Errorf("[Socket] Error writing message: %w", err), nil
 	}
 
 	response, err := bufio.NewReader(conn).ReadString('\n')
 	if err != nil {
-		return errors.New("Error reading response: " + err.Error()), nil
+		if ctx.Err() != nil {
+			return ctx.Err(), nil
+		}
+		return fmt.Errorf("Error reading response: %w", err), nil
 	}
 
 	response = strings.TrimSuffix(response, "\n")
@@ -127,3 +219,134 @@ func StartClient(address string, info QPInfo) (error, *QPInfo) {
 
 	return nil, &QPInfo
 }
+
+// handshake is a bootstrap connection that outlives the QP info exchange, so both
+// sides can confirm that their QP reached RTS before the first send.
+type handshake struct {
+	conn      net.Conn
+	reader    *bufio.Reader
+	stopWatch func()
+
+	// records the lines exchanged, labeled with the local QP number
+	capture *Capture
+	qpNum   uint32
+}
+
+// newHandshake bounds the handshake by HANDSHAKE_TIMEOUT or the deadline of ctx, whichever
+// is earlier; cancelling ctx closes conn.
+func newHandshake(ctx context.Context, conn net.Conn) *handshake {
+	deadline := time.Now().Add(HANDSHAKE_TIMEOUT)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	conn.SetDeadline(deadline)
+	return &handshake{conn: conn, reader: bufio.NewReader(conn), stopWatch: watchContext(ctx, conn)}
+}
+
+func (h *handshake) writeLine(data []byte) error {
+	_, err := h.conn.Write(append(data, '\n'))
+	if err == nil {
+		h.capture.record(captureRecord{typ: CAPTURE_HANDSHAKE_TX, qpNum: h.qpNum, length: uint32(len(data))}, data)
+	}
+	return handshakeError(err)
+}
+
+func (h *handshake) readLine() (string, error) {
+	line, err := h.reader.ReadString('\n')
+	if err != nil {
+		return "", handshakeError(err)
+	}
+	line = strings.TrimSuffix(line, "\n")
+	h.capture.record(captureRecord{typ: CAPTURE_HANDSHAKE_RX, qpNum: h.qpNum, length: uint32(len(line))}, []byte(line))
+	return line, nil
+}
+
+// handshakeError marks errors of an expired handshake deadline as ErrTimeout.
+func handshakeError(err error) error {
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return fmt.Errorf("%w: %w", ErrTimeout, err)
+	}
+	return err
+}
+
+// handshakeState is the connection state exchanged next to the QP info.
+type handshakeState struct {
+	LastRecvSeq uint64
+	Credits     uint32
+	EndpointID  uint64
+}
+
+// exchange sends the local QP info and reads the peer's, both sides write first.
+func (h *handshake) exchange(info QPInfo, local handshakeState) (*QPInfo, handshakeState, error) {
+	goInfo := ConvertToGoQPInfo(info)
+	goInfo.LastRecvSeq = local.LastRecvSeq
+	goInfo.Credits = local.Credits
+	goInfo.EndpointID = local.EndpointID
+	jsonData, err := json.Marshal(goInfo)
+	if err != nil {
+		return nil, handshakeState{}, fmt.Errorf("[Socket] Error marshalling QP info: %w", err)
+	}
+	if err = h.writeLine(jsonData); err != nil {
+		return nil, handshakeState{}, fmt.Errorf("[Socket] Error writing QP info: %w", err)
+	}
+
+	line, err := h.readLine()
+	if err != nil {
+		return nil, handshakeState{}, fmt.Errorf("[Socket] Error reading QP info: %w", err)
+	}
+	var goQPInfo GoQPInfo
+	if err = json.Unmarshal([]byte(line), &goQPInfo); err != nil {
+		return nil, handshakeState{}, fmt.Errorf("[Socket] Error unmarshalling QP info: %w", err)
+	}
+	peer := ConvertToCQPInfo(goQPInfo)
+	return &peer, handshakeState{LastRecvSeq: goQPInfo.LastRecvSeq, Credits: goQPInfo.Credits, EndpointID: goQPInfo.EndpointID}, nil
+}
+
+// replayConn is a bootstrap connection whose first line was read before the handshake
+// started, Read returns it again.
+type replayConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c *replayConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// peekQPInfo reads the QP info the peer opens its handshake with, within timeout, and
+// returns it with a connection that replays it to the handshake.
+func peekQPInfo(conn net.Conn, timeout time.Duration) (*GoQPInfo, net.Conn, error) {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	reader := bufio.NewReader(conn)
+	line, err := reader.ReadSlice('\n')
+	if err != nil {
+		return nil, nil, fmt.Errorf("[Socket] Error reading QP info: %w", handshakeError(err))
+	}
+	line = append([]byte(nil), line...)
+	var info GoQPInfo
+	if err = json.Unmarshal(line, &info); err != nil {
+		return nil, nil, fmt.Errorf("[Socket] Error unmarshalling QP info: %w", err)
+	}
+	conn.SetReadDeadline(time.Time{})
+	return &info, &replayConn{Conn: conn, reader: io.MultiReader(bytes.NewReader(line), reader)}, nil
+}
+
+// syncReady tells the peer the local QP is in RTS and waits until the peer's is too.
+func (h *handshake) syncReady() error {
+	if err := h.writeLine([]byte(handshakeReady)); err != nil {
+		return fmt.Errorf("[Socket] Error writing ready: %w", err)
+	}
+	line, err := h.readLine()
+	if err != nil {
+		return fmt.Errorf("[Socket] Error reading ready: %w", err)
+	}
+	if line != handshakeReady {
+		return errors.New("[Socket] unexpected handshake message: " + line)
+	}
+	return nil
+}
+
+func (h *handshake) close() {
+	h.stopWatch()
+	h.conn.Close()
+}
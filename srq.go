@@ -0,0 +1,403 @@
+package RDMAGO
+
+/*
+#cgo CFLAGS: -I/usr/include/infiniband
+#cgo LDFLAGS: -libverbs -L. -lwrapper
+
+#include "wrapper.h"
+
+#include <stdlib.h>
+#include <infiniband/verbs.h>
+*/
+import "C"
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"unsafe"
+)
+
+const (
+	DEFAULT_SRQ_DEPTH = 16
+)
+
+// SRQOptions sizes the SRQ and the ManagedSRQ on top of it.
+type SRQOptions struct {
+	MaxWR   int // SRQ max_wr, device maximum when 0
+	Depth   int // receives kept posted, DEFAULT_SRQ_DEPTH when 0
+	Buffers int // receive buffers in the pool, 2*Depth when 0
+	Limit   int // arm IBV_EVENT_SRQ_LIMIT_REACHED below this many receives, 0 disables
+}
+
+// SetSRQOptions must be called before InitRCQP.
+func (ibRes *IBRes) SetSRQOptions(opts SRQOptions) {
+	if opts.MaxWR < 0 {
+		opts.MaxWR = 0
+	}
+	ibRes.SRQMaxWR = C.uint(opts.MaxWR)
+	ibRes.SRQDepth = opts.Depth
+	ibRes.SRQBuffers = opts.Buffers
+	ibRes.SRQLimit = opts.Limit
+}
+
+type SRQStats struct {
+	Posted      uint64 // receives posted in total
+	Completed   uint64 // receives consumed by incoming messages
+	LimitEvents uint64 // IBV_EVENT_SRQ_LIMIT_REACHED handled
+	Starved     uint64 // refills that could not bring the SRQ back to Depth
+	Outstanding int    // receives currently in the SRQ
+	Free        int    // buffers neither posted nor held by the application
+}
+
+// RecvBuffer is a pool buffer holding a received message until it is released.
+type RecvBuffer struct {
+	Data  []byte
+	index int
+}
+
+// managedSRQs maps SRQ handles to their ManagedSRQ for the EventMonitor.
+var managedSRQs sync.Map
+
+func lookupManagedSRQ(srq *C.struct_ibv_srq) *ManagedSRQ {
+	if managed, ok := managedSRQs.Load(srq); ok {
+		return managed.(*ManagedSRQ)
+	}
+	return nil
+}
+
+const (
+	bufFree = iota
+	bufPosted
+	bufHeld
+)
+
+// ManagedSRQ keeps Depth receive buffers posted on ibRes.Srq. Buffers come from a pool
+// registered as its own MR; a completed receive is handed to the application as a
+// RecvBuffer and goes back to the pool on Release. wr_id is the buffer address.
+type ManagedSRQ struct {
+	mu      sync.Mutex
+	ibRes   *IBRes
+	handle  *C.struct_ibv_srq // registry key, ibRes.Srq may be cleared before Close
+	res     *Resource
+	mem     *C.char
+	mr      *C.struct_ibv_mr
+	bufSize int
+	state   []uint8
+	free    []int
+	batch   *RecvBatch
+
+	depth  int
+	refill int
+	limit  int
+	armed  bool
+	posted int
+	stats  SRQStats
+
+	// OnStarved is called when the pool ran out of buffers before the SRQ was back to Depth.
+	OnStarved func(SRQStats)
+}
+
+// NewManagedSRQ creates the buffer pool for ibRes.Srq from the sizes set by SetSRQOptions
+// and posts the first Depth receives. bufSize is the size of one receive buffer.
+func NewManagedSRQ(ibRes *IBRes, bufSize int) (*ManagedSRQ, error) {
+	depth := ibRes.SRQDepth
+	if depth <= 0 {
+		depth = DEFAULT_SRQ_DEPTH
+	}
+	if ibRes.SRQMaxWR > 0 && depth > int(ibRes.SRQMaxWR) {
+		return nil, errors.New(fmt.Sprintf("[NewManagedSRQ] depth %v exceeds SRQ max_wr %v", depth, ibRes.SRQMaxWR))
+	}
+	numBufs := ibRes.SRQBuffers
+	if numBufs <= 0 {
+		numBufs = 2 * depth
+	}
+	if numBufs < depth {
+		return nil, errors.New(fmt.Sprintf("[NewManagedSRQ] %v buffers cannot keep %v receives posted", numBufs, depth))
+	}
+	if bufSize <= 0 {
+		return nil, errors.New(fmt.Sprintf("[NewManagedSRQ] invalid buffer size %v", bufSize))
+	}
+
+	mem := (*C.char)(C.calloc(C.size_t(numBufs), C.size_t(bufSize)))
+	if mem == nil {
+		return nil, errors.New("[NewManagedSRQ] failed to allocate memory")
+	}
+	mr, cerr := C.ibv_reg_mr(ibRes.Pd, unsafe.Pointer(mem), C.size_t(numBufs*bufSize), C.IBV_ACCESS_LOCAL_WRITE)
+	if mr == nil {
+		C.free(unsafe.Pointer(mem))
+		return nil, fmt.Errorf("[NewManagedSRQ] %w", newVerbsError("ibv_reg_mr", "receive pool", nil, 0, cerr))
+	}
+	batch, err := NewRecvBatch(depth)
+	if err != nil {
+		C.ibv_dereg_mr(mr)
+		C.free(unsafe.Pointer(mem))
+		return nil, fmt.Errorf("[NewManagedSRQ] %w", err)
+	}
+
+	refill := depth / 8
+	if refill < 1 {
+		refill = 1
+	}
+	srq := &ManagedSRQ{
+		ibRes:   ibRes,
+		handle:  ibRes.Srq,
+		mem:     mem,
+		mr:      mr,
+		bufSize: bufSize,
+		state:   make([]uint8, numBufs),
+		free:    make([]int, 0, numBufs),
+		batch:   batch,
+		depth:   depth,
+		refill:  refill,
+		limit:   ibRes.SRQLimit,
+	}
+	for i := numBufs - 1; i >= 0; i-- {
+		srq.free = append(srq.free, i)
+	}
+	srq.res = newResource("receive pool", fmt.Sprintf("%v x %v bytes", numBufs, bufSize), srq.release, ibRes.resources.pd)
+	srq.res.setDescribe(func() map[string]interface{} {
+		stats := srq.Stats()
+		return map[string]interface{}{
+			"depth":       srq.depth,
+			"outstanding": stats.Outstanding,
+			"free":        stats.Free,
+			"posted":      stats.Posted,
+			"completed":   stats.Completed,
+		}
+	})
+	// receives posted on the SRQ point into the pool, so the SRQ goes first
+	ibRes.resources.srq.dependOn(srq.res)
+
+	if err = srq.Fill(); err != nil {
+		srq.Close()
+		return nil, err
+	}
+	managedSRQs.Store(srq.handle, srq)
+	return srq, nil
+}
+
+// managedSRQ returns the pool of ibRes.Srq and creates it on first use. Its receives stay
+// posted after the caller returned, so the pool lives until FreeRCQP destroyed the SRQ.
+func (ibRes *IBRes) managedSRQ(bufSize int) (*ManagedSRQ, error) {
+	if srq := lookupManagedSRQ(ibRes.Srq); srq != nil {
+		return srq, nil
+	}
+	return NewManagedSRQ(ibRes, bufSize)
+}
+
+func (srq *ManagedSRQ) bufAddr(index int) *C.char {
+	return (*C.char)(unsafe.Add(unsafe.Pointer(srq.mem), index*srq.bufSize))
+}
+
+// Fill posts free buffers until Depth receives are outstanding and arms the SRQ limit.
+func (srq *ManagedSRQ) Fill() error {
+	srq.mu.Lock()
+	starved, err := srq.fillLocked()
+	stats := srq.statsLocked()
+	srq.mu.Unlock()
+
+	if starved {
+		srq.ibRes.logger().Info("[ManagedSRQ] starved", "outstanding", stats.Outstanding, "depth", srq.depth)
+		if srq.OnStarved != nil {
+			srq.OnStarved(stats)
+		}
+	}
+	return err
+}
+
+func (srq *ManagedSRQ) fillLocked() (bool, error) {
+	want := srq.depth - srq.posted
+	if want <= 0 {
+		return false, nil
+	}
+	n := want
+	if n > len(srq.free) {
+		n = len(srq.free)
+	}
+
+	if n > 0 {
+		// take buffers from the end of the free list, so a partially posted batch
+		// leaves exactly the unposted ones in it
+		srq.batch.Reset()
+		for i := len(srq.free) - 1; i >= len(srq.free)-n; i-- {
+			addr := srq.bufAddr(srq.free[i])
+			err := srq.batch.AddRecv(addr, C.uint(srq.bufSize), srq.mr.lkey, C.ulong(uintptr(unsafe.Pointer(addr))))
+			if err != nil {
+				return false, fmt.Errorf("[ManagedSRQ] %w", err)
+			}
+		}
+
+		posted, err := IbvPostSRQRecvBatch(srq.ibRes.Srq, srq.batch)
+		for _, index := range srq.free[len(srq.free)-posted:] {
+			srq.state[index] = bufPosted
+			if capture := srq.ibRes.capture; capture != nil {
+				capture.record(captureRecord{
+					typ:    CAPTURE_POST_RECV,
+					length: uint32(srq.bufSize),
+					wrID:   uint64(uintptr(unsafe.Pointer(srq.bufAddr(index)))),
+				}, nil)
+			}
+		}
+		srq.free = srq.free[:len(srq.free)-posted]
+		srq.posted += posted
+		srq.stats.Posted += uint64(posted)
+		if err != nil {
+			return false, fmt.Errorf("[ManagedSRQ] %w", err)
+		}
+	}
+
+	if srq.limit > 0 && !srq.armed && srq.posted > srq.limit {
+		if err := IbvModifySRQLimit(srq.ibRes.Srq, C.uint(srq.limit)); err != nil {
+			return false, fmt.Errorf("[ManagedSRQ] %w", err)
+		}
+		srq.armed = true
+	}
+
+	if srq.posted < srq.depth {
+		srq.stats.Starved++
+		return true, nil
+	}
+	return false, nil
+}
+
+// OnRecv takes the buffer of a successful receive completion out of the SRQ accounting
+// and returns it to the caller, who must Release it. Receives are reposted in batches.
+func (srq *ManagedSRQ) OnRecv(wrID uint64, byteLen int) (*RecvBuffer, error) {
+	srq.mu.Lock()
+	index, err := srq.indexOf(wrID)
+	if err != nil {
+		srq.mu.Unlock()
+		return nil, err
+	}
+	if byteLen > srq.bufSize {
+		byteLen = srq.bufSize
+	}
+	srq.state[index] = bufHeld
+	srq.posted--
+	srq.stats.Completed++
+	needFill := srq.depth-srq.posted >= srq.refill
+	srq.mu.Unlock()
+
+	buf := &RecvBuffer{
+		Data:  unsafe.Slice((*byte)(unsafe.Pointer(srq.bufAddr(index))), byteLen),
+		index: index,
+	}
+	if needFill {
+		if err = srq.Fill(); err != nil {
+			return buf, err
+		}
+	}
+	return buf, nil
+}
+
+// OnFlush accounts a receive that completed with an error, its buffer goes back to the pool.
+func (srq *ManagedSRQ) OnFlush(wrID uint64) error {
+	srq.mu.Lock()
+	defer srq.mu.Unlock()
+	index, err := srq.indexOf(wrID)
+	if err != nil {
+		return err
+	}
+	srq.state[index] = bufFree
+	srq.free = append(srq.free, index)
+	srq.posted--
+	return nil
+}
+
+// owns reports whether wrID is the address of a pool buffer, i.e. a receive of the SRQ.
+// Only wr_id is valid on a failed completion, so this tells flushed receives from sends.
+func (srq *ManagedSRQ) owns(wrID uint64) bool {
+	if srq == nil {
+		return false
+	}
+	srq.mu.Lock()
+	defer srq.mu.Unlock()
+	if srq.mem == nil {
+		return false
+	}
+	offset := uintptr(wrID) - uintptr(unsafe.Pointer(srq.mem))
+	return offset%uintptr(srq.bufSize) == 0 && offset/uintptr(srq.bufSize) < uintptr(len(srq.state))
+}
+
+func (srq *ManagedSRQ) indexOf(wrID uint64) (int, error) {
+	offset := int(uintptr(wrID) - uintptr(unsafe.Pointer(srq.mem)))
+	if offset < 0 || offset%srq.bufSize != 0 || offset/srq.bufSize >= len(srq.state) {
+		return 0, errors.New(fmt.Sprintf("[ManagedSRQ] wr_id %#x is not a pool buffer", wrID))
+	}
+	index := offset / srq.bufSize
+	if srq.state[index] != bufPosted {
+		return 0, errors.New(fmt.Sprintf("[ManagedSRQ] buffer %v was not posted", index))
+	}
+	return index, nil
+}
+
+// Release gives a buffer returned by OnRecv back to the pool. buf.Data must not be used afterwards.
+func (srq *ManagedSRQ) Release(buf *RecvBuffer) error {
+	srq.mu.Lock()
+	if buf.index < 0 || buf.index >= len(srq.state) || srq.state[buf.index] != bufHeld {
+		srq.mu.Unlock()
+		return errors.New("[ManagedSRQ] release of a buffer not held")
+	}
+	srq.state[buf.index] = bufFree
+	srq.free = append(srq.free, buf.index)
+	buf.Data = nil
+	buf.index = -1
+	needFill := srq.depth-srq.posted >= srq.refill
+	srq.mu.Unlock()
+
+	if needFill {
+		return srq.Fill()
+	}
+	return nil
+}
+
+// HandleLimitReached refills the SRQ and re-arms the limit, call it on IBV_EVENT_SRQ_LIMIT_REACHED.
+func (srq *ManagedSRQ) HandleLimitReached() error {
+	srq.mu.Lock()
+	srq.armed = false
+	srq.stats.LimitEvents++
+	srq.mu.Unlock()
+	return srq.Fill()
+}
+
+func (srq *ManagedSRQ) Stats() SRQStats {
+	srq.mu.Lock()
+	defer srq.mu.Unlock()
+	return srq.statsLocked()
+}
+
+func (srq *ManagedSRQ) statsLocked() SRQStats {
+	stats := srq.stats
+	stats.Outstanding = srq.posted
+	stats.Free = len(srq.free)
+	return stats
+}
+
+// Close deregisters and frees the pool. The SRQ and its QPs are destroyed first, so no
+// receive can land in a deregistered buffer; deallocating the PD closes the pool too.
+func (srq *ManagedSRQ) Close() error {
+	return srq.res.Close()
+}
+
+func (srq *ManagedSRQ) release() error {
+	managedSRQs.CompareAndDelete(srq.handle, srq)
+
+	srq.mu.Lock()
+	defer srq.mu.Unlock()
+	if srq.batch != nil {
+		srq.batch.Free()
+		srq.batch = nil
+	}
+	if srq.mr != nil {
+		res := C.ibv_dereg_mr(srq.mr)
+		if res != 0 {
+			return fmt.Errorf("[ManagedSRQ] %w", newVerbsError("ibv_dereg_mr", "receive pool", nil, int(res), nil))
+		}
+		srq.mr = nil
+	}
+	if srq.mem != nil {
+		C.free(unsafe.Pointer(srq.mem))
+		srq.mem = nil
+	}
+	return nil
+}
@@ -1,13 +1,19 @@
 package RDMAGO
 
 import "C"
-import "os"
+import (
+	"bytes"
+	"os"
+)
 
 func GetQPInfo(ibRes *IBRes) (*QPInfo, error) {
 	return &QPInfo{
-		QpNum: ibRes.Qp.qp_num,
-		Lid:   ibRes.PortAttr.lid,
-		Gid:   ibRes.Gid,
+		QpNum:    ibRes.Qp.qp_num,
+		Lid:      ibRes.PortAttr.lid,
+		Gid:      ibRes.Gid,
+		Port:     ibRes.Port,
+		GidIndex: ibRes.GidIndex,
+		GidType:  ibRes.gidType,
 	}, nil
 }
 
@@ -33,3 +39,11 @@ func GetFileMeta(fileName string, chunkSize int64) (int, int64, *os.File, error)
 	}
 	return chunkCount, fileSize, file, nil
 }
+
+// BufString returns data up to the first NUL byte, for payloads written with strcpy.
+func BufString(data []byte) string {
+	if i := bytes.IndexByte(data, 0); i >= 0 {
+		data = data[:i]
+	}
+	return string(data)
+}
@@ -0,0 +1,157 @@
+package RDMAGO
+
+import (
+	"context"
+	"math"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	TRACER_NAME = "github.com/trinet2005/RDMA-GO"
+
+	// frame flag: the header is followed by the sender's trace context
+	ENDPOINT_FLAG_TRACE = 1
+	// trace id, span id and trace flags of the sending span
+	ENDPOINT_TRACE_SIZE = 16 + 8 + 1
+)
+
+// endpointTracer creates the spans of an Endpoint. Messages are traced when the context
+// passed to Send carries a sampled span, or else one in every `every` messages; the
+// rest cost a context lookup and an atomic add.
+type endpointTracer struct {
+	tracer trace.Tracer
+	every  uint64 // 0 traces only messages with a sampled parent
+	count  uint64
+}
+
+func newEndpointTracer(cfg *Config) *endpointTracer {
+	provider := cfg.TracerProvider
+	if provider == nil {
+		provider = otel.GetTracerProvider()
+	}
+	t := &endpointTracer{tracer: provider.Tracer(TRACER_NAME)}
+	if cfg.TraceSampleRate > 0 {
+		t.every = uint64(math.Max(1, math.Round(1/cfg.TraceSampleRate)))
+	}
+	return t
+}
+
+func (t *endpointTracer) sampled(ctx context.Context) bool {
+	if trace.SpanContextFromContext(ctx).IsSampled() {
+		return true
+	}
+	return t.every != 0 && atomic.AddUint64(&t.count, 1)%t.every == 0
+}
+
+// traceAttributes describe the endpoint in every span.
+func (ep *Endpoint) traceAttributes(extra ...attribute.KeyValue) []attribute.KeyValue {
+	attrs := []attribute.KeyValue{
+		attribute.String("rdma.device", ep.res.deviceName),
+		attribute.String("rdma.mode", ep.cfg.Mode),
+	}
+	if ep.res.Qp != nil {
+		attrs = append(attrs, attribute.Int64("rdma.qp_num", int64(ep.res.Qp.qp_num)))
+	}
+	return append(attrs, extra...)
+}
+
+// startSend starts the span of a sampled send, nil otherwise.
+func (ep *Endpoint) startSend(ctx context.Context, size int, immData uint32) trace.Span {
+	if !ep.tracer.sampled(ctx) {
+		return nil
+	}
+	_, span := ep.tracer.tracer.Start(ctx, "rdma.send", trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(ep.traceAttributes(
+			attribute.Int("rdma.bytes", size),
+			attribute.Int64("rdma.imm_data", int64(immData)))...))
+	return span
+}
+
+// endSpan ends span, which may be nil, recording err.
+func endSpan(span trace.Span, err error) {
+	if span == nil {
+		return
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// spanContextOf returns the context to put on the wire for span, which may be nil.
+func spanContextOf(span trace.Span) trace.SpanContext {
+	if span == nil {
+		return trace.SpanContext{}
+	}
+	return span.SpanContext()
+}
+
+// startChild starts a span named name under parent, nil when parent is nil.
+func (ep *Endpoint) startChild(parent trace.Span, name string, attrs ...attribute.KeyValue) trace.Span {
+	if parent == nil {
+		return nil
+	}
+	_, span := ep.tracer.tracer.Start(trace.ContextWithSpan(context.Background(), parent), name,
+		trace.WithAttributes(attrs...))
+	return span
+}
+
+// startRecv starts the span of a message whose sender traced it, a child of the sender's
+// span. It starts at the receive completion and ends when Recv hands the message out.
+func (ep *Endpoint) startRecv(remote trace.SpanContext, completed time.Time, size int, immData uint32, wrID uint64) trace.Span {
+	ctx := trace.ContextWithRemoteSpanContext(context.Background(), remote)
+	_, span := ep.tracer.tracer.Start(ctx, "rdma.recv", trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithTimestamp(completed),
+		trace.WithAttributes(ep.traceAttributes(
+			attribute.Int("rdma.bytes", size),
+			attribute.Int64("rdma.imm_data", int64(immData)),
+			attribute.Int64("rdma.wr_id", int64(wrID)))...))
+	return span
+}
+
+// releaseRecv gives buf back to the SRQ, which may post receives again; under span, which
+// may be nil, that is recorded as rdma.post_recv.
+func (ep *Endpoint) releaseRecv(span trace.Span, buf *RecvBuffer) {
+	post := ep.startChild(span, "rdma.post_recv")
+	err := ep.srq.Release(buf)
+	if post != nil {
+		post.SetAttributes(attribute.Int("rdma.srq_outstanding", ep.srq.Stats().Outstanding))
+	}
+	endSpan(post, err)
+}
+
+func encodeTraceContext(b []byte, sc trace.SpanContext) {
+	traceID, spanID := sc.TraceID(), sc.SpanID()
+	copy(b, traceID[:])
+	copy(b[16:], spanID[:])
+	b[24] = byte(sc.TraceFlags())
+}
+
+func decodeTraceContext(b []byte) trace.SpanContext {
+	var traceID trace.TraceID
+	var spanID trace.SpanID
+	copy(traceID[:], b)
+	copy(spanID[:], b[16:])
+	return trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    traceID,
+		SpanID:     spanID,
+		TraceFlags: trace.TraceFlags(b[24]),
+		Remote:     true,
+	})
+}
+
+// Context returns ctx carrying the trace of the message, so work done for it joins the
+// sender's trace. ctx is returned unchanged for untraced messages.
+func (m Message) Context(ctx context.Context) context.Context {
+	if !m.Trace.IsValid() {
+		return ctx
+	}
+	return trace.ContextWithSpanContext(ctx, m.Trace)
+}
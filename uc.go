@@ -0,0 +1,393 @@
+package RDMAGO
+
+/*
+#cgo CFLAGS: -I/usr/include/infiniband
+#cgo LDFLAGS: -libverbs -L. -lwrapper
+
+#include "wrapper.h"
+
+#include <stdlib.h>
+#include <infiniband/verbs.h>
+*/
+import "C"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+const (
+	// slots of the ring RDMA writes land in, both sides must use the same number
+	DEFAULT_UC_SLOTS = 64
+	// messages received and not yet read by Recv, more are dropped
+	DEFAULT_UC_INBOX = 1024
+
+	UC_POLL_BATCH = 16
+)
+
+// UCMessage is a received message, copied out of the receive buffer or the write ring.
+type UCMessage struct {
+	Data []byte
+	Seq  uint32
+	// Write is set when the message arrived by RDMA write, see UCEndpoint.Write
+	Write bool
+	// Dropped is the number of messages lost between the previous message and this one
+	Dropped uint32
+}
+
+// UCStats counts the messages of a UCEndpoint.
+type UCStats struct {
+	Sent     uint64 `json:"sent"`
+	Received uint64 `json:"received"`
+	Dropped  uint64 `json:"dropped"` // lost on the fabric, from the sequence gaps
+	Gaps     uint64 `json:"gaps"`
+	Overflow uint64 `json:"overflow"` // received while the inbox was full
+}
+
+// UCEndpoint streams messages over one UC QP. Nothing is acknowledged or retransmitted:
+// a message of which any packet is lost is dropped whole, and the receiver learns of it
+// from the gap in the sequence numbers carried as immediate data, see OnDrop. A failed
+// QP is not recovered, create a new UCEndpoint.
+type UCEndpoint struct {
+	unreliableQP
+	cfg *Config
+
+	// ring of slots the peer RDMA writes into, slot seq % slots holds write seq
+	ring     unsafe.Pointer
+	ringMR   *C.struct_ibv_mr
+	slots    int
+	slotSize int
+	// where our writes go, the peer's ring
+	peer         *QPInfo
+	peerSlotSize int
+
+	// next sequence number sent, guarded by sendMu
+	nextSeq uint32
+
+	// next sequence number expected, owned by the poller
+	expected uint32
+	mu       sync.Mutex
+	onDrop   func(first, count uint32)
+	inbox    chan UCMessage
+	stats    UCStats
+}
+
+// NewUCEndpoint creates a UC QP on the device selected by cfg and connects it like
+// NewEndpoint: a "server" waits for the client on cfg.Port, a "client" dials cfg.Address.
+func NewUCEndpoint(cfg *Config) (*UCEndpoint, error) {
+	return NewUCEndpointContext(context.Background(), cfg)
+}
+
+// NewUCEndpointContext is NewUCEndpoint with ctx bounding the connection.
+func NewUCEndpointContext(ctx context.Context, cfg *Config) (*UCEndpoint, error) {
+	if cfg.Mode != "server" && cfg.Mode != "client" {
+		return nil, errors.New("[NewUCEndpoint] invalid mode " + cfg.Mode)
+	}
+	sel, err := SelectDevice(ctx, cfg.selector())
+	if err != nil {
+		return nil, fmt.Errorf("[NewUCEndpoint] %w", err)
+	}
+	res, err := InitIBRes()
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Logger != nil {
+		res.SetLogger(cfg.Logger)
+	}
+	res.SetQPType(QP_TYPE_UC)
+	res.SetAddress(sel.Port, sel.GidIndex)
+	if err = res.SetAddressOptions(cfg.addressOptions()); err != nil {
+		return nil, fmt.Errorf("[NewUCEndpoint] %w", err)
+	}
+	res.SetSendOptions(cfg.MaxInlineData, cfg.SignalInterval)
+	res.SetSRQOptions(SRQOptions{
+		MaxWR:   cfg.SRQMaxWR,
+		Depth:   cfg.SRQDepth,
+		Buffers: cfg.SRQBuffers,
+		Limit:   cfg.SRQLimit,
+	})
+	if _, err = res.InitRCQP(sel.Device, cfg.MrSize); err != nil {
+		res.FreeIBRes()
+		return nil, fmt.Errorf("[NewUCEndpoint] %w", err)
+	}
+
+	u := &UCEndpoint{
+		unreliableQP: unreliableQP{
+			name:     "UCEndpoint",
+			res:      res,
+			log:      res.logger(),
+			batch:    UC_POLL_BATCH,
+			sendDone: make(chan error, 1),
+			stop:     make(chan struct{}),
+			done:     make(chan struct{}),
+		},
+		cfg:      cfg,
+		slots:    cfg.UCSlots,
+		slotSize: cfg.MrSize,
+		nextSeq:  1,
+		expected: 1,
+		inbox:    make(chan UCMessage, DEFAULT_UC_INBOX),
+	}
+	if u.slots <= 0 {
+		u.slots = DEFAULT_UC_SLOTS
+	}
+	if err = u.open(); err != nil {
+		u.release()
+		return nil, err
+	}
+	if err = u.connect(ctx); err != nil {
+		u.release()
+		return nil, err
+	}
+	go u.pollLoop(u.onRecv)
+	return u, nil
+}
+
+func (u *UCEndpoint) open() error {
+	var err error
+	if err = u.unreliableQP.open(u.slotSize); err != nil {
+		return fmt.Errorf("[NewUCEndpoint] %w", err)
+	}
+
+	size := u.slots * u.slotSize
+	ring := C.calloc(C.size_t(u.slots), C.size_t(u.slotSize))
+	if ring == nil {
+		return errors.New("[NewUCEndpoint] failed to allocate memory")
+	}
+	mr, cerr := C.ibv_reg_mr(u.res.Pd, ring, C.size_t(size), C.IBV_ACCESS_LOCAL_WRITE|C.IBV_ACCESS_REMOTE_WRITE)
+	if mr == nil {
+		C.free(ring)
+		return newVerbsError("ibv_reg_mr", deviceResource(u.res.Ctx), nil, 0, cerr)
+	}
+	u.ring, u.ringMR = ring, mr
+	newResource("write ring", fmt.Sprintf("%v x %v bytes", u.slots, u.slotSize), func() error {
+		ret, err := C.ibv_dereg_mr(mr)
+		if ret != 0 {
+			return newVerbsError("ibv_dereg_mr", "write ring", nil, int(ret), err)
+		}
+		C.free(ring)
+		u.ring, u.ringMR = nil, nil
+		return nil
+	}, u.res.resources.pd)
+	return nil
+}
+
+// connect exchanges QP info and write rings over the bootstrap connection and brings the
+// QP to RTS; the sequence numbers start after both sides are ready.
+func (u *UCEndpoint) connect(ctx context.Context) error {
+	var conn net.Conn
+	var err error
+	if u.cfg.Mode == "server" {
+		listener, err := net.Listen("tcp", ":"+u.cfg.Port)
+		if err != nil {
+			return fmt.Errorf("[NewUCEndpoint] Error starting server: %w", err)
+		}
+		stopWatch := watchContext(ctx, listener)
+		conn, err = listener.Accept()
+		stopWatch()
+		listener.Close()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return fmt.Errorf("[NewUCEndpoint] accept failed: %w", err)
+		}
+	} else {
+		dialer := net.Dialer{Timeout: HANDSHAKE_TIMEOUT}
+		if conn, err = dialer.DialContext(ctx, "tcp", u.cfg.Address); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return fmt.Errorf("[NewUCEndpoint] Error connecting to server: %w", err)
+		}
+	}
+
+	h := newHandshake(ctx, conn)
+	h.capture, h.qpNum = u.res.capture, uint32(u.res.Qp.qp_num)
+	defer h.close()
+
+	info, err := GetQPInfo(u.res)
+	if err != nil {
+		return err
+	}
+	info.Addr = uint64(uintptr(u.ring))
+	info.Rkey = uint32(u.ringMR.rkey)
+	info.Len = uint32(u.slots * u.slotSize)
+	peer, _, err := h.exchange(*info, handshakeState{})
+	if err != nil {
+		return fmt.Errorf("[NewUCEndpoint] %w", err)
+	}
+	if peer.Len == 0 || peer.Len%uint32(u.slots) != 0 {
+		return errors.New(fmt.Sprintf("[NewUCEndpoint] peer write ring of %v bytes does not hold %v slots",
+			peer.Len, u.slots))
+	}
+	if err = u.res.ModifyQPRTS(peer); err != nil {
+		return fmt.Errorf("[NewUCEndpoint] %w", err)
+	}
+	if err = h.syncReady(); err != nil {
+		return fmt.Errorf("[NewUCEndpoint] %w", err)
+	}
+	u.peer = peer
+	u.peerSlotSize = int(peer.Len) / u.slots
+	u.log.Debug("[UCEndpoint] connected", "peer", conn.RemoteAddr().String(), "peer_qp_num", uint32(peer.QpNum),
+		"slots", u.slots, "peer_slot_size", u.peerSlotSize)
+	return nil
+}
+
+// OnDrop registers fn to be called from the poller when a sequence gap shows that count
+// messages starting with first were lost.
+func (u *UCEndpoint) OnDrop(fn func(first, count uint32)) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.onDrop = fn
+}
+
+// MaxMessageSize is the largest message Send and Write accept: a receive buffer or ring
+// slot on both sides, which are mr_size bytes.
+func (u *UCEndpoint) MaxMessageSize() int {
+	if u.peerSlotSize < u.slotSize {
+		return u.peerSlotSize
+	}
+	return u.slotSize
+}
+
+// Send sends data into a receive buffer of the peer and returns once it left the QP.
+func (u *UCEndpoint) Send(data []byte) error {
+	return u.SendContext(context.Background(), data)
+}
+
+// SendContext is Send that stops waiting for the completion when ctx is done.
+func (u *UCEndpoint) SendContext(ctx context.Context, data []byte) error {
+	if len(data) > u.MaxMessageSize() {
+		return errors.New(fmt.Sprintf("[UCEndpoint] message of %v bytes exceeds %v", len(data), u.MaxMessageSize()))
+	}
+	return u.post(ctx, data, false)
+}
+
+// Write RDMA writes data into the next slot of the peer's ring and returns once it left
+// the QP. The peer copies it out when the write completes; a peer falling behind by more
+// than the ring size sees its slots overwritten.
+func (u *UCEndpoint) Write(data []byte) error {
+	return u.WriteContext(context.Background(), data)
+}
+
+// WriteContext is Write that stops waiting for the completion when ctx is done.
+func (u *UCEndpoint) WriteContext(ctx context.Context, data []byte) error {
+	if len(data) > u.MaxMessageSize() {
+		return errors.New(fmt.Sprintf("[UCEndpoint] write of %v bytes exceeds %v", len(data), u.MaxMessageSize()))
+	}
+	return u.post(ctx, data, true)
+}
+
+func (u *UCEndpoint) post(ctx context.Context, data []byte, write bool) error {
+	// a send abandoned by its context still owns IbBuf
+	if err := u.lockSend(ctx); err != nil {
+		return err
+	}
+	defer u.sendMu.Unlock()
+
+	seq := u.nextSeq
+	opcode := C.uint(C.IBV_WR_SEND_WITH_IMM)
+	if write {
+		opcode = C.IBV_WR_RDMA_WRITE_WITH_IMM
+	}
+	err := u.postSend(uint64(seq), opcode, uint32(seq), data, func(buf unsafe.Pointer, flags C.uint) error {
+		if write {
+			remote := u.peer.Addr + uint64(int(seq)%u.slots*u.peerSlotSize)
+			return IbvPostWriteImm(u.res.Qp, buf, C.uint(len(data)), u.res.Mr.lkey, C.ulong(seq), C.uint(seq),
+				remote, u.peer.Rkey, flags)
+		}
+		return IbvPostSendFlags(u.res.Qp, buf, C.uint(len(data)), u.res.Mr.lkey, C.ulong(seq), C.uint(seq), flags)
+	})
+	if err != nil {
+		return fmt.Errorf("[UCEndpoint] %w", err)
+	}
+	u.nextSeq++
+	return u.waitSend(ctx)
+}
+
+// Recv returns the next message, check Dropped for messages lost before it.
+func (u *UCEndpoint) Recv() (UCMessage, error) {
+	return u.RecvContext(context.Background())
+}
+
+// RecvContext is Recv that gives up when ctx is done.
+func (u *UCEndpoint) RecvContext(ctx context.Context) (UCMessage, error) {
+	select {
+	case msg := <-u.inbox:
+		return msg, nil
+	case <-u.stop:
+		return UCMessage{}, fmt.Errorf("[UCEndpoint] %w", ErrClosed)
+	case <-ctx.Done():
+		return UCMessage{}, ctx.Err()
+	}
+}
+
+// Stats returns the counters of the endpoint.
+func (u *UCEndpoint) Stats() UCStats {
+	return UCStats{
+		Sent:     atomic.LoadUint64(&u.sent),
+		Received: atomic.LoadUint64(&u.stats.Received),
+		Dropped:  atomic.LoadUint64(&u.stats.Dropped),
+		Gaps:     atomic.LoadUint64(&u.stats.Gaps),
+		Overflow: atomic.LoadUint64(&u.stats.Overflow),
+	}
+}
+
+// onRecv copies the message of buf, or of the ring slot a write landed in, to the inbox.
+func (u *UCEndpoint) onRecv(wc *C.struct_ibv_wc, buf *RecvBuffer) {
+	seq := uint32(C.ibv_get_imm_data(wc))
+	msg := UCMessage{Seq: seq, Write: wc.opcode == C.IBV_WC_RECV_RDMA_WITH_IMM}
+	if msg.Write {
+		length := int(wc.byte_len)
+		if length > u.slotSize {
+			length = u.slotSize
+		}
+		slot := unsafe.Add(u.ring, int(seq)%u.slots*u.slotSize)
+		msg.Data = C.GoBytes(slot, C.int(length))
+	} else {
+		msg.Data = append([]byte(nil), buf.Data...)
+	}
+	u.srq.Release(buf)
+	u.sequence(&msg)
+
+	select {
+	case u.inbox <- msg:
+		atomic.AddUint64(&u.stats.Received, 1)
+	default:
+		atomic.AddUint64(&u.stats.Overflow, 1)
+	}
+}
+
+// sequence checks msg against the expected sequence number and reports a gap.
+func (u *UCEndpoint) sequence(msg *UCMessage) {
+	gap := msg.Seq - u.expected
+	u.expected = msg.Seq + 1
+	if gap == 0 {
+		return
+	}
+	if gap >= 1<<31 {
+		// UC does not reorder, an older number means the peer started over
+		u.log.Info("[UCEndpoint] sequence restarted", "seq", msg.Seq)
+		return
+	}
+	msg.Dropped = gap
+	atomic.AddUint64(&u.stats.Dropped, uint64(gap))
+	atomic.AddUint64(&u.stats.Gaps, 1)
+	u.log.Debug("[UCEndpoint] messages dropped", "first", msg.Seq-gap, "count", gap)
+	u.mu.Lock()
+	onDrop := u.onDrop
+	u.mu.Unlock()
+	if onDrop != nil {
+		onDrop(msg.Seq-gap, gap)
+	}
+}
+
+// Close stops the poller and releases the QP, the write ring and the device.
+func (u *UCEndpoint) Close() error {
+	return u.close()
+}
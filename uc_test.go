@@ -0,0 +1,44 @@
+package RDMAGO
+
+import "testing"
+
+func TestUCSequence(t *testing.T) {
+	type drop struct{ first, count uint32 }
+	tests := []struct {
+		name         string
+		expected     uint32
+		seq          uint32
+		wantDropped  uint32
+		wantExpected uint32
+		wantDrop     *drop
+	}{
+		{"in order", 1, 1, 0, 2, nil},
+		{"gap", 1, 4, 3, 5, &drop{1, 3}},
+		{"in order at the wrap", 1<<32 - 1, 1<<32 - 1, 0, 0, nil},
+		{"in order after the wrap", 0, 0, 0, 1, nil},
+		{"gap across the wrap", 1<<32 - 1, 2, 3, 3, &drop{1<<32 - 1, 3}},
+		{"peer restarted", 100, 1, 0, 2, nil},
+	}
+	for _, tt := range tests {
+		var got *drop
+		u := &UCEndpoint{unreliableQP: unreliableQP{log: NopLogger()}, expected: tt.expected}
+		u.OnDrop(func(first, count uint32) {
+			got = &drop{first, count}
+		})
+		msg := UCMessage{Seq: tt.seq}
+		u.sequence(&msg)
+		if msg.Dropped != tt.wantDropped {
+			t.Errorf("%v: Dropped = %v, want %v", tt.name, msg.Dropped, tt.wantDropped)
+		}
+		if u.expected != tt.wantExpected {
+			t.Errorf("%v: expected = %v, want %v", tt.name, u.expected, tt.wantExpected)
+		}
+		if (got == nil) != (tt.wantDrop == nil) || (got != nil && *got != *tt.wantDrop) {
+			t.Errorf("%v: OnDrop got %v, want %v", tt.name, got, tt.wantDrop)
+		}
+		stats := u.Stats()
+		if stats.Dropped != uint64(tt.wantDropped) {
+			t.Errorf("%v: stats.Dropped = %v, want %v", tt.name, stats.Dropped, tt.wantDropped)
+		}
+	}
+}
@@ -0,0 +1,379 @@
+package RDMAGO
+
+/*
+#cgo CFLAGS: -I/usr/include/infiniband
+#cgo LDFLAGS: -libverbs -L. -lwrapper
+
+#include "wrapper.h"
+
+#include <stdlib.h>
+#include <infiniband/verbs.h>
+*/
+import "C"
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"unsafe"
+)
+
+const (
+	// every UD receive starts with room for the GRH, filled when the packet carried one
+	UD_GRH_SIZE = 40
+	// qkey of UD QPs when the Config sets none
+	DEFAULT_QKEY = 0x11111111
+	// address handles kept per UDEndpoint
+	DEFAULT_AH_CACHE_SIZE = 1024
+	// datagrams received and not yet read by RecvFrom, more are dropped
+	DEFAULT_UD_INBOX = 1024
+
+	UD_POLL_BATCH = 16
+)
+
+// UDAddr identifies a UD QP: the QP number with the LID on InfiniBand or the GID, which
+// RoCE and routed InfiniBand need.
+type UDAddr struct {
+	QpNum uint32 `json:"qp_num"`
+	Lid   uint16 `json:"lid,omitempty"`
+	Gid   net.IP `json:"gid,omitempty"`
+	// qkey of the peer's QP, 0 when it uses the qkey of ours
+	Qkey uint32 `json:"qkey,omitempty"`
+}
+
+func (a UDAddr) String() string {
+	if a.Gid != nil && !a.Gid.IsUnspecified() {
+		return fmt.Sprintf("%v/%v", a.Gid, a.QpNum)
+	}
+	return fmt.Sprintf("lid %v/%v", a.Lid, a.QpNum)
+}
+
+// Datagram is a received datagram, copied out of the receive buffer.
+type Datagram struct {
+	Data []byte
+	From UDAddr
+}
+
+// UDStats counts the datagrams of a UDEndpoint and the use of its address handle cache.
+type UDStats struct {
+	Sent        uint64 `json:"sent"`
+	Received    uint64 `json:"received"`
+	Dropped     uint64 `json:"dropped"` // received while the inbox was full
+	AHHits      uint64 `json:"ah_hits"`
+	AHMisses    uint64 `json:"ah_misses"`
+	AHEvictions uint64 `json:"ah_evictions"`
+	AHCached    int    `json:"ah_cached"`
+}
+
+// ahKey is what an address handle depends on, peers behind the same port share one.
+type ahKey struct {
+	gid [16]byte
+	lid uint16
+}
+
+type ahEntry struct {
+	key ahKey
+	ah  *C.struct_ibv_ah
+	res *Resource
+}
+
+// ahCache keeps the most recently used address handles.
+type ahCache struct {
+	capacity int
+	entries  map[ahKey]*list.Element
+	lru      *list.List
+
+	hits, misses, evictions uint64
+}
+
+func newAHCache(capacity int) *ahCache {
+	if capacity <= 0 {
+		capacity = DEFAULT_AH_CACHE_SIZE
+	}
+	return &ahCache{capacity: capacity, entries: make(map[ahKey]*list.Element), lru: list.New()}
+}
+
+// get returns the address handle of key, create makes it on a miss. The least recently used
+// handle is destroyed when the cache is full, no send may still be using it.
+func (c *ahCache) get(key ahKey, create func() (*ahEntry, error)) (*ahEntry, error) {
+	if elem, ok := c.entries[key]; ok {
+		c.hits++
+		c.lru.MoveToFront(elem)
+		return elem.Value.(*ahEntry), nil
+	}
+	c.misses++
+	entry, err := create()
+	if err != nil {
+		return nil, err
+	}
+	entry.key = key
+	c.entries[key] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.capacity {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		evicted := oldest.Value.(*ahEntry)
+		delete(c.entries, evicted.key)
+		c.evictions++
+		evicted.res.Close()
+	}
+	return entry, nil
+}
+
+// UDEndpoint sends and receives datagrams of up to the port MTU on one UD QP, to and from
+// any number of peers. Delivery is not guaranteed: datagrams are lost on the fabric, when
+// no receive is posted and when the application reads slower than they arrive.
+type UDEndpoint struct {
+	unreliableQP
+	cfg  *Config
+	qkey uint32
+	mtu  int
+
+	// guarded by sendMu, the address handles are in use until the send completes
+	ahs      *ahCache
+	nextWrID uint64
+
+	inbox chan Datagram
+	stats UDStats
+}
+
+// NewUDEndpoint creates a UD QP on the device selected by cfg, see DeviceSelector.
+func NewUDEndpoint(cfg *Config) (*UDEndpoint, error) {
+	return NewUDEndpointContext(context.Background(), cfg)
+}
+
+// NewUDEndpointContext is NewUDEndpoint with ctx bounding the wait for the port.
+func NewUDEndpointContext(ctx context.Context, cfg *Config) (*UDEndpoint, error) {
+	sel, err := SelectDevice(ctx, cfg.selector())
+	if err != nil {
+		return nil, fmt.Errorf("[NewUDEndpoint] %w", err)
+	}
+	res, err := InitIBRes()
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Logger != nil {
+		res.SetLogger(cfg.Logger)
+	}
+	res.SetQPType(QP_TYPE_UD)
+	res.SetAddress(sel.Port, sel.GidIndex)
+	if err = res.SetAddressOptions(cfg.addressOptions()); err != nil {
+		return nil, fmt.Errorf("[NewUDEndpoint] %w", err)
+	}
+	res.SetSendOptions(cfg.MaxInlineData, cfg.SignalInterval)
+	res.SetSRQOptions(SRQOptions{
+		MaxWR:   cfg.SRQMaxWR,
+		Depth:   cfg.SRQDepth,
+		Buffers: cfg.SRQBuffers,
+		Limit:   cfg.SRQLimit,
+	})
+	if _, err = res.InitRCQP(sel.Device, cfg.MrSize); err != nil {
+		res.FreeIBRes()
+		return nil, fmt.Errorf("[NewUDEndpoint] %w", err)
+	}
+
+	u := &UDEndpoint{
+		unreliableQP: unreliableQP{
+			name:     "UDEndpoint",
+			res:      res,
+			log:      res.logger(),
+			batch:    UD_POLL_BATCH,
+			sendDone: make(chan error, 1),
+			stop:     make(chan struct{}),
+			done:     make(chan struct{}),
+		},
+		cfg:   cfg,
+		qkey:  cfg.Qkey,
+		mtu:   mtuBytes(res.PortAttr.active_mtu),
+		ahs:   newAHCache(cfg.AHCacheSize),
+		inbox: make(chan Datagram, DEFAULT_UD_INBOX),
+	}
+	if u.qkey == 0 {
+		u.qkey = DEFAULT_QKEY
+	}
+	if err = u.open(); err != nil {
+		u.release()
+		return nil, err
+	}
+	go u.pollLoop(u.onRecv)
+	u.log.Debug("[UDEndpoint] open", "mtu", u.mtu, "qkey", u.qkey)
+	return u, nil
+}
+
+func (u *UDEndpoint) open() error {
+	var err error
+	if err = IbvModifyQPUD(u.res.Qp, u.res.Port, u.qkey); err != nil {
+		return fmt.Errorf("[NewUDEndpoint] %w", err)
+	}
+	if err = u.unreliableQP.open(UD_GRH_SIZE + u.mtu); err != nil {
+		return fmt.Errorf("[NewUDEndpoint] %w", err)
+	}
+	return nil
+}
+
+// Addr returns the address peers send to, publish it through the discovery mechanism.
+func (u *UDEndpoint) Addr() UDAddr {
+	return UDAddr{
+		QpNum: uint32(u.res.Qp.qp_num),
+		Lid:   uint16(u.res.PortAttr.lid),
+		Gid:   net.IP(gidBytes(&u.res.Gid)),
+		Qkey:  u.qkey,
+	}
+}
+
+// MaxMessageSize is the largest datagram SendTo accepts.
+func (u *UDEndpoint) MaxMessageSize() int {
+	if int(u.res.IbBufSize) < u.mtu {
+		return int(u.res.IbBufSize)
+	}
+	return u.mtu
+}
+
+// SendTo sends data to peer and returns once it left the QP.
+func (u *UDEndpoint) SendTo(peer UDAddr, data []byte) error {
+	return u.SendToContext(context.Background(), peer, data)
+}
+
+// SendToContext is SendTo that stops waiting for the completion when ctx is done. The
+// datagram may still be sent; the next SendTo waits for it.
+func (u *UDEndpoint) SendToContext(ctx context.Context, peer UDAddr, data []byte) error {
+	if len(data) > u.MaxMessageSize() {
+		return errors.New(fmt.Sprintf("[UDEndpoint] datagram of %v bytes exceeds %v", len(data), u.MaxMessageSize()))
+	}
+	// a send abandoned by its context still owns IbBuf and its address handle
+	if err := u.lockSend(ctx); err != nil {
+		return err
+	}
+	defer u.sendMu.Unlock()
+
+	ah, err := u.addressHandle(peer)
+	if err != nil {
+		return err
+	}
+	qkey := peer.Qkey
+	if qkey == 0 {
+		qkey = u.qkey
+	}
+
+	u.nextWrID++
+	wrID := u.nextWrID
+	err = u.postSend(wrID, C.IBV_WR_SEND, 0, data, func(buf unsafe.Pointer, flags C.uint) error {
+		ret := C.ibv_post_send_ud_wrapper(u.res.Qp, ah.ah, C.uint(peer.QpNum), C.uint(qkey), C.uint64_t(wrID),
+			buf, C.uint(len(data)), u.res.Mr.lkey, flags)
+		if ret != 0 {
+			return postSendError(u.res.Qp, wrID, int(ret), nil)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("[UDEndpoint] send to %v failed: %w", peer, err)
+	}
+	return u.waitSend(ctx)
+}
+
+// addressHandle returns the cached address handle of peer, sendMu must be held.
+func (u *UDEndpoint) addressHandle(peer UDAddr) (*ahEntry, error) {
+	var key ahKey
+	if peer.Gid != nil {
+		copy(key.gid[:], peer.Gid.To16())
+	}
+	key.lid = peer.Lid
+	return u.ahs.get(key, func() (*ahEntry, error) {
+		info := QPInfo{QpNum: C.uint(peer.QpNum), Lid: C.ushort(peer.Lid)}
+		copy((*[16]byte)(unsafe.Pointer(&info.Gid))[:], key.gid[:])
+		av, err := u.res.addressVector(&info)
+		if err != nil {
+			return nil, fmt.Errorf("[UDEndpoint] no address for %v: %w", peer, err)
+		}
+		var attr C.struct_ibv_ah_attr
+		av.fill(&attr)
+		ah, cerr := C.ibv_create_ah(u.res.Pd, &attr)
+		if ah == nil {
+			return nil, newVerbsError("ibv_create_ah", "peer "+peer.String(), nil, 0, cerr)
+		}
+		res := newResource("AH", peer.String(), func() error {
+			ret, err := C.ibv_destroy_ah(ah)
+			if ret != 0 {
+				return newVerbsError("ibv_destroy_ah", "", nil, int(ret), err)
+			}
+			return nil
+		}, u.res.resources.pd)
+		return &ahEntry{ah: ah, res: res}, nil
+	})
+}
+
+// RecvFrom returns the next datagram and its sender.
+func (u *UDEndpoint) RecvFrom() ([]byte, UDAddr, error) {
+	return u.RecvFromContext(context.Background())
+}
+
+// RecvFromContext is RecvFrom that gives up when ctx is done.
+func (u *UDEndpoint) RecvFromContext(ctx context.Context) ([]byte, UDAddr, error) {
+	select {
+	case d := <-u.inbox:
+		return d.Data, d.From, nil
+	case <-u.stop:
+		return nil, UDAddr{}, fmt.Errorf("[UDEndpoint] %w", ErrClosed)
+	case <-ctx.Done():
+		return nil, UDAddr{}, ctx.Err()
+	}
+}
+
+// Stats returns the counters of the endpoint.
+func (u *UDEndpoint) Stats() UDStats {
+	stats := UDStats{
+		Sent:     atomic.LoadUint64(&u.sent),
+		Received: atomic.LoadUint64(&u.stats.Received),
+		Dropped:  atomic.LoadUint64(&u.stats.Dropped),
+	}
+	u.sendMu.Lock()
+	stats.AHHits, stats.AHMisses, stats.AHEvictions = u.ahs.hits, u.ahs.misses, u.ahs.evictions
+	stats.AHCached = u.ahs.lru.Len()
+	u.sendMu.Unlock()
+	return stats
+}
+
+// onRecv queues the datagram in buf for RecvFrom.
+func (u *UDEndpoint) onRecv(wc *C.struct_ibv_wc, buf *RecvBuffer) {
+	if len(buf.Data) < UD_GRH_SIZE {
+		u.srq.Release(buf)
+		return
+	}
+	from := UDAddr{QpNum: uint32(wc.src_qp), Lid: uint16(wc.slid)}
+	if wc.wc_flags&C.IBV_WC_GRH != 0 {
+		from.Gid = grhSourceGID(buf.Data[:UD_GRH_SIZE])
+	}
+	d := Datagram{Data: append([]byte(nil), buf.Data[UD_GRH_SIZE:]...), From: from}
+	u.srq.Release(buf)
+	select {
+	case u.inbox <- d:
+		atomic.AddUint64(&u.stats.Received, 1)
+	default:
+		atomic.AddUint64(&u.stats.Dropped, 1)
+	}
+}
+
+// grhSourceGID returns the source GID of a received GRH. On RoCE v2 over IPv4 the last 20
+// bytes hold the IPv4 header instead, the GID is the IPv4-mapped source address.
+func grhSourceGID(grh []byte) net.IP {
+	ip := grh[20:]
+	if ip[0]>>4 == 4 {
+		zero := true
+		for _, b := range grh[:20] {
+			if b != 0 {
+				zero = false
+				break
+			}
+		}
+		if zero {
+			return net.IPv4(ip[12], ip[13], ip[14], ip[15])
+		}
+	}
+	return append(net.IP(nil), grh[8:24]...)
+}
+
+// Close stops the poller and releases the QP, the address handles and the device.
+func (u *UDEndpoint) Close() error {
+	return u.close()
+}
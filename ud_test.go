@@ -0,0 +1,88 @@
+package RDMAGO
+
+import (
+	"net"
+	"testing"
+)
+
+func TestAHCacheEviction(t *testing.T) {
+	tests := []struct {
+		lid         uint16
+		wantHit     bool
+		wantEvicted []uint16
+	}{
+		{1, false, nil},
+		{2, false, nil},
+		{1, true, nil},
+		{3, false, []uint16{2}}, // 1 was used more recently than 2
+		{2, false, []uint16{1}},
+		{2, true, nil},
+		{3, true, nil},
+	}
+	cache := newAHCache(2)
+	var evicted []uint16
+	for i, tt := range tests {
+		evicted = nil
+		misses := cache.misses
+		lid := tt.lid
+		entry, err := cache.get(ahKey{lid: lid}, func() (*ahEntry, error) {
+			res := newResource("AH", "test", func() error {
+				evicted = append(evicted, lid)
+				return nil
+			})
+			return &ahEntry{res: res}, nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entry.key.lid != tt.lid {
+			t.Errorf("%v: get(lid %v) returned the handle of lid %v", i, tt.lid, entry.key.lid)
+		}
+		if hit := cache.misses == misses; hit != tt.wantHit {
+			t.Errorf("%v: get(lid %v) hit = %v, want %v", i, tt.lid, hit, tt.wantHit)
+		}
+		if len(evicted) != len(tt.wantEvicted) || (len(evicted) > 0 && evicted[0] != tt.wantEvicted[0]) {
+			t.Errorf("%v: get(lid %v) evicted %v, want %v", i, tt.lid, evicted, tt.wantEvicted)
+		}
+		if cache.lru.Len() > 2 {
+			t.Errorf("%v: cache holds %v handles, capacity is 2", i, cache.lru.Len())
+		}
+	}
+	if cache.hits != 3 || cache.misses != 4 || cache.evictions != 2 {
+		t.Errorf("hits %v, misses %v, evictions %v, want 3, 4, 2", cache.hits, cache.misses, cache.evictions)
+	}
+	for _, elem := range cache.entries {
+		elem.Value.(*ahEntry).res.Close()
+	}
+}
+
+func TestGRHSourceGID(t *testing.T) {
+	ipv4 := make([]byte, UD_GRH_SIZE)
+	ipv4[20] = 0x45
+	copy(ipv4[32:], []byte{192, 0, 2, 1})
+
+	ib := make([]byte, UD_GRH_SIZE)
+	ib[0] = 0x60
+	copy(ib[8:], net.ParseIP("fe80::1:2"))
+
+	// the SGID may look like an IPv4 header where RoCE v2 puts one
+	ibLookalike := make([]byte, UD_GRH_SIZE)
+	ibLookalike[0] = 0x60
+	sgid := net.ParseIP("2001:db8::4500:1")
+	copy(ibLookalike[8:], sgid)
+
+	tests := []struct {
+		name string
+		grh  []byte
+		want net.IP
+	}{
+		{"RoCE v2 over IPv4", ipv4, net.IPv4(192, 0, 2, 1)},
+		{"GRH", ib, net.ParseIP("fe80::1:2")},
+		{"GRH with IPv4 lookalike", ibLookalike, sgid},
+	}
+	for _, tt := range tests {
+		if got := grhSourceGID(tt.grh); !got.Equal(tt.want) {
+			t.Errorf("%v: grhSourceGID = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
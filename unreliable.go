@@ -0,0 +1,230 @@
+package RDMAGO
+
+/*
+#cgo CFLAGS: -I/usr/include/infiniband
+#cgo LDFLAGS: -libverbs -L. -lwrapper
+
+#include "wrapper.h"
+
+#include <stdlib.h>
+#include <infiniband/verbs.h>
+*/
+import "C"
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+// unreliableQP is what UDEndpoint and UCEndpoint share: one QP polled by one goroutine,
+// receives from a ManagedSRQ and one send at a time out of IbBuf.
+type unreliableQP struct {
+	name  string
+	res   *IBRes
+	log   Logger
+	srq   *ManagedSRQ
+	wc    *C.struct_ibv_wc
+	batch int
+
+	// sendMu serializes sends, IbBuf is in use until the send completes
+	sendMu   sync.Mutex
+	sendWrID uint64
+	sendDone chan error
+	// a send abandoned by its context, its completion is still to come
+	pending bool
+	// postMu guards the send queue accounting of res
+	postMu sync.Mutex
+	sent   uint64
+
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// open creates the WC array and the receive pool of bufSize byte buffers.
+func (q *unreliableQP) open(bufSize int) error {
+	var err error
+	if q.wc, err = CreateWC(q.batch); err != nil {
+		return err
+	}
+	q.srq, err = NewManagedSRQ(q.res, bufSize)
+	return err
+}
+
+// lockSend takes sendMu once the send abandoned by its context, if any, completed.
+// The caller unlocks sendMu.
+func (q *unreliableQP) lockSend(ctx context.Context) error {
+	q.sendMu.Lock()
+	if q.pending {
+		select {
+		case <-q.sendDone:
+			q.pending = false
+		case <-q.stop:
+			q.sendMu.Unlock()
+			return fmt.Errorf("[%v] %w", q.name, ErrClosed)
+		case <-ctx.Done():
+			q.sendMu.Unlock()
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// postSend posts data as a signaled send with wrID, sendMu must be held. post gets data
+// inline or copied into IbBuf and posts the WR, opcode and immData are what it posts.
+func (q *unreliableQP) postSend(wrID uint64, opcode C.uint, immData uint32, data []byte,
+	post func(buf unsafe.Pointer, flags C.uint) error) error {
+	q.postMu.Lock()
+	defer q.postMu.Unlock()
+	flags, err := q.res.nextSendFlags(len(data), true)
+	if err != nil {
+		return err
+	}
+	var buf unsafe.Pointer
+	if len(data) > 0 {
+		buf = unsafe.Pointer(&data[0])
+		if flags&C.IBV_SEND_INLINE == 0 {
+			C.memcpy(unsafe.Pointer(q.res.IbBuf), buf, C.size_t(len(data)))
+			buf = unsafe.Pointer(q.res.IbBuf)
+		}
+	}
+	atomic.StoreUint64(&q.sendWrID, wrID)
+	if err = post(buf, flags); err != nil {
+		atomic.StoreUint64(&q.sendWrID, 0)
+		return err
+	}
+	q.res.commitSend(flags)
+	q.res.captureSend(opcode, data, immData, wrID, flags)
+	return nil
+}
+
+// waitSend waits for the completion of the send posted last, sendMu must be held.
+func (q *unreliableQP) waitSend(ctx context.Context) error {
+	select {
+	case err := <-q.sendDone:
+		if err == nil {
+			atomic.AddUint64(&q.sent, 1)
+		}
+		return err
+	case <-q.stop:
+		return fmt.Errorf("[%v] %w", q.name, ErrClosed)
+	case <-ctx.Done():
+		q.pending = true
+		return ctx.Err()
+	}
+}
+
+// pollLoop polls the CQ until Close, onRecv gets every received buffer and releases it.
+func (q *unreliableQP) pollLoop(onRecv func(wc *C.struct_ibv_wc, buf *RecvBuffer)) {
+	defer close(q.done)
+	var idle int
+	for {
+		select {
+		case <-q.stop:
+			return
+		default:
+		}
+		num, err := IbvPollCQ(q.res.Cq, C.int(q.batch), q.wc)
+		if err != nil {
+			q.log.Error("["+q.name+"] poll CQ failed", err)
+			q.completeSend(err)
+			<-q.stop
+			return
+		}
+		if num == 0 {
+			idle++
+			if idle >= ENDPOINT_IDLE_SPINS {
+				time.Sleep(ENDPOINT_IDLE_SLEEP)
+			}
+			continue
+		}
+		idle = 0
+		for i := 0; i < num; i++ {
+			q.handleCompletion(wcAt(q.wc, i), onRecv)
+		}
+	}
+}
+
+func (q *unreliableQP) handleCompletion(wc *C.struct_ibv_wc, onRecv func(wc *C.struct_ibv_wc, buf *RecvBuffer)) {
+	wrID := uint64(wc.wr_id)
+	// the opcode is undefined on failed completions, receives are told apart by their buffer
+	recv := q.srq.owns(wrID)
+	if wc.status != C.IBV_WC_SUCCESS || !recv {
+		q.res.CaptureCompletion(wc, nil)
+	}
+	if wc.status != C.IBV_WC_SUCCESS {
+		err := fmt.Errorf("[%v] %w", q.name, newWCError(wc))
+		if recv {
+			q.srq.OnFlush(wrID)
+			q.log.Error("["+q.name+"] receive failed", err)
+			return
+		}
+		// the QP is in the error state and flushes every send still queued, signaled or
+		// not, so none of them holds a slot any more
+		q.postMu.Lock()
+		q.res.ResetSendSlots()
+		q.postMu.Unlock()
+		if wrID == atomic.LoadUint64(&q.sendWrID) {
+			q.completeSend(err)
+		}
+		return
+	}
+
+	if !recv {
+		q.postMu.Lock()
+		q.res.OnSendCompletion()
+		q.postMu.Unlock()
+		if wrID == atomic.LoadUint64(&q.sendWrID) {
+			q.completeSend(nil)
+		}
+		return
+	}
+	buf, err := q.srq.OnRecv(wrID, int(wc.byte_len))
+	if err != nil {
+		q.log.Error("["+q.name+"] refill SRQ failed", err, "wr_id", wrID)
+	}
+	if buf == nil {
+		q.res.CaptureCompletion(wc, nil)
+		return
+	}
+	q.res.CaptureCompletion(wc, buf.Data)
+	onRecv(wc, buf)
+}
+
+func (q *unreliableQP) completeSend(err error) {
+	atomic.StoreUint64(&q.sendWrID, 0)
+	select {
+	case q.sendDone <- err:
+	default:
+	}
+}
+
+// close stops the poller and releases the IB resources once the send being posted is out.
+func (q *unreliableQP) close() error {
+	var err error
+	q.closeOnce.Do(func() {
+		close(q.stop)
+		<-q.done
+		q.sendMu.Lock()
+		defer q.sendMu.Unlock()
+		err = q.release()
+	})
+	return err
+}
+
+// release frees the WC array and the IB resources, whatever depends on the PD, such as the
+// receive pool, goes with the device in dependency order.
+func (q *unreliableQP) release() error {
+	if q.wc != nil {
+		DestroyWC(q.wc)
+		q.wc = nil
+	}
+	if err := q.res.FreeRCQP(); err != nil {
+		return fmt.Errorf("[%v] %w", q.name, err)
+	}
+	q.srq = nil
+	return nil
+}
@@ -2,6 +2,8 @@
 
 #include <infiniband/verbs.h>
 #include <stdio.h>
+#include <poll.h>
+#include "wrapper.h"
 #define uint unsigned int
 // package the ibv_query_port function
 int ibv_query_port_wrapper(struct ibv_context *context,
@@ -27,7 +29,210 @@ int ibv_post_send_wrapper(struct ibv_qp *qp,
     return ibv_post_send(qp,wr,bad_wr);
 }
 
+// post a single SEND_WITH_IMM built on the stack. with IBV_SEND_INLINE the
+// payload is copied during the call, so buf does not need to be registered
+int ibv_post_send_flags_wrapper(struct ibv_qp *qp, uint64_t wr_id, void *buf,
+       uint length, uint lkey, uint immData, uint sendFlags){
+    struct ibv_sge sge = {
+        .addr = (uint64_t)(uintptr_t)buf,
+        .length = length,
+        .lkey = lkey,
+    };
+    struct ibv_send_wr wr = {0};
+    struct ibv_send_wr *bad_wr = NULL;
+
+    wr.wr_id = wr_id;
+    wr.sg_list = &sge;
+    wr.num_sge = length > 0 ? 1 : 0;
+    wr.opcode = IBV_WR_SEND_WITH_IMM;
+    wr.send_flags = sendFlags;
+    wr.imm_data = immData;
+    return ibv_post_send(qp,&wr,&bad_wr);
+}
+
+// RDMA write with immediate, the immediate consumes a receive of the peer
+int ibv_post_write_imm_wrapper(struct ibv_qp *qp, uint64_t wr_id, void *buf, uint length, uint lkey,
+       uint immData, uint64_t remoteAddr, uint rkey, uint sendFlags){
+    struct ibv_sge sge = {
+        .addr = (uint64_t)(uintptr_t)buf,
+        .length = length,
+        .lkey = lkey,
+    };
+    struct ibv_send_wr wr = {0};
+    struct ibv_send_wr *bad_wr = NULL;
+
+    wr.wr_id = wr_id;
+    wr.sg_list = &sge;
+    wr.num_sge = length > 0 ? 1 : 0;
+    wr.opcode = IBV_WR_RDMA_WRITE_WITH_IMM;
+    wr.send_flags = sendFlags;
+    wr.imm_data = immData;
+    wr.wr.rdma.remote_addr = remoteAddr;
+    wr.wr.rdma.rkey = rkey;
+    return ibv_post_send(qp,&wr,&bad_wr);
+}
+
+// post a datagram on a UD QP, wr.ud sits in a union that cgo cannot reach
+int ibv_post_send_ud_wrapper(struct ibv_qp *qp, struct ibv_ah *ah, uint remoteQpn, uint remoteQkey,
+       uint64_t wr_id, void *buf, uint length, uint lkey, uint sendFlags){
+    struct ibv_sge sge = {
+        .addr = (uint64_t)(uintptr_t)buf,
+        .length = length,
+        .lkey = lkey,
+    };
+    struct ibv_send_wr wr = {0};
+    struct ibv_send_wr *bad_wr = NULL;
+
+    wr.wr_id = wr_id;
+    wr.sg_list = &sge;
+    wr.num_sge = length > 0 ? 1 : 0;
+    wr.opcode = IBV_WR_SEND;
+    wr.send_flags = sendFlags;
+    wr.wr.ud.ah = ah;
+    wr.wr.ud.remote_qpn = remoteQpn;
+    wr.wr.ud.remote_qkey = remoteQkey;
+    return ibv_post_send(qp,&wr,&bad_wr);
+}
+
+// imm_data sits in an anonymous union that cgo cannot reach
+void ibv_set_imm_data(struct ibv_send_wr *wr, uint immData){
+    wr->imm_data = immData;
+}
+
+// post a chained send list, *bad_index is the position of bad_wr in the chain
+// or -1 when everything was posted
+int ibv_post_send_list_wrapper(struct ibv_qp *qp,
+       struct ibv_send_wr *wr, int *bad_index){
+    struct ibv_send_wr *bad_wr = NULL;
+    int ret = ibv_post_send(qp,wr,&bad_wr);
+    *bad_index = -1;
+    if (ret != 0 && bad_wr != NULL) {
+        int i = 0;
+        for (struct ibv_send_wr *cur = wr; cur != NULL; cur = cur->next, i++) {
+            if (cur == bad_wr) {
+                *bad_index = i;
+                break;
+            }
+        }
+    }
+    return ret;
+}
+
+int ibv_post_srq_recv_list_wrapper(struct ibv_srq *srq,
+       struct ibv_recv_wr *wr, int *bad_index){
+    struct ibv_recv_wr *bad_wr = NULL;
+    int ret = ibv_post_srq_recv(srq,wr,&bad_wr);
+    *bad_index = -1;
+    if (ret != 0 && bad_wr != NULL) {
+        int i = 0;
+        for (struct ibv_recv_wr *cur = wr; cur != NULL; cur = cur->next, i++) {
+            if (cur == bad_wr) {
+                *bad_index = i;
+                break;
+            }
+        }
+    }
+    return ret;
+}
+
 int ibv_get_imm_data(struct ibv_wc *wc){
     return wc->imm_data;
 }
 
+// poll up to max completions and store them as compact records in
+// ring[(tail+i) % ring_size]. while nothing has been found yet the CQ is polled
+// up to spin more times. returns the number of records written, or the
+// negative ibv_poll_cq result on error
+int ibv_poll_cq_records(struct ibv_cq *cq, struct ibv_wc *scratch, int scratch_len,
+       struct wc_record *ring, uint32_t ring_size, uint32_t tail, int max, int spin){
+    int got = 0;
+    while (got < max) {
+        int want = max - got;
+        if (want > scratch_len) {
+            want = scratch_len;
+        }
+        int n = ibv_poll_cq(cq,want,scratch);
+        if (n < 0) {
+            return n;
+        }
+        for (int i = 0; i < n; i++) {
+            struct wc_record *rec = &ring[(tail + got + i) % ring_size];
+            rec->wr_id = scratch[i].wr_id;
+            rec->status = scratch[i].status;
+            rec->opcode = scratch[i].opcode;
+            rec->byte_len = scratch[i].byte_len;
+            rec->imm_data = scratch[i].imm_data;
+            rec->qp_num = scratch[i].qp_num;
+            rec->src_qp = scratch[i].src_qp;
+            rec->wc_flags = scratch[i].wc_flags;
+            rec->vendor_err = scratch[i].vendor_err;
+        }
+        got += n;
+        if (n < want) {
+            if (got > 0 || spin-- <= 0) {
+                break;
+            }
+        }
+    }
+    return got;
+}
+
+// wait up to timeout_ms for an async event of context. the event is copied into
+// *out and acknowledged right away, so destroying the resource never waits on
+// it. returns 1 when an event was read, 0 on timeout and -1 on error
+int ibv_get_async_event_timeout(struct ibv_context *context, int timeout_ms,
+       struct async_event_info *out){
+    struct pollfd pfd = {
+        .fd = context->async_fd,
+        .events = POLLIN,
+    };
+    int ret = poll(&pfd,1,timeout_ms);
+    if (ret <= 0) {
+        return ret;
+    }
+
+    struct ibv_async_event event;
+    if (ibv_get_async_event(context,&event) != 0) {
+        return -1;
+    }
+
+    out->event_type = event.event_type;
+    out->qp_num = 0;
+    out->port_num = 0;
+    out->qp = NULL;
+    out->cq = NULL;
+    out->srq = NULL;
+    switch (event.event_type) {
+    case IBV_EVENT_CQ_ERR:
+        out->cq = event.element.cq;
+        break;
+    case IBV_EVENT_QP_FATAL:
+    case IBV_EVENT_QP_REQ_ERR:
+    case IBV_EVENT_QP_ACCESS_ERR:
+    case IBV_EVENT_COMM_EST:
+    case IBV_EVENT_SQ_DRAINED:
+    case IBV_EVENT_PATH_MIG:
+    case IBV_EVENT_PATH_MIG_ERR:
+    case IBV_EVENT_QP_LAST_WQE_REACHED:
+        out->qp = event.element.qp;
+        out->qp_num = event.element.qp->qp_num;
+        break;
+    case IBV_EVENT_SRQ_ERR:
+    case IBV_EVENT_SRQ_LIMIT_REACHED:
+        out->srq = event.element.srq;
+        break;
+    case IBV_EVENT_PORT_ACTIVE:
+    case IBV_EVENT_PORT_ERR:
+    case IBV_EVENT_LID_CHANGE:
+    case IBV_EVENT_PKEY_CHANGE:
+    case IBV_EVENT_SM_CHANGE:
+    case IBV_EVENT_CLIENT_REREGISTER:
+    case IBV_EVENT_GID_CHANGE:
+        out->port_num = event.element.port_num;
+        break;
+    default:
+        break;
+    }
+    ibv_ack_async_event(&event);
+    return 1;
+}
@@ -18,5 +18,51 @@ int ibv_modify_qp_wrapper(struct ibv_qp *qp,
 int ibv_post_send_wrapper(struct ibv_qp *qp,
        struct ibv_send_wr *wr, struct ibv_send_wr **bad_wr, uint immData);
 
+int ibv_post_send_flags_wrapper(struct ibv_qp *qp, uint64_t wr_id, void *buf,
+       uint length, uint lkey, uint immData, uint sendFlags);
+
+void ibv_set_imm_data(struct ibv_send_wr *wr, uint immData);
+
+int ibv_post_write_imm_wrapper(struct ibv_qp *qp, uint64_t wr_id, void *buf, uint length, uint lkey,
+       uint immData, uint64_t remoteAddr, uint rkey, uint sendFlags);
+
+int ibv_post_send_ud_wrapper(struct ibv_qp *qp, struct ibv_ah *ah, uint remoteQpn, uint remoteQkey,
+       uint64_t wr_id, void *buf, uint length, uint lkey, uint sendFlags);
+
+int ibv_post_send_list_wrapper(struct ibv_qp *qp,
+       struct ibv_send_wr *wr, int *bad_index);
+
+int ibv_post_srq_recv_list_wrapper(struct ibv_srq *srq,
+       struct ibv_recv_wr *wr, int *bad_index);
+
 int ibv_get_imm_data(struct ibv_wc *wc);
+
+// compact completion record, the layout is mirrored by WCRecord in poll.go
+struct wc_record {
+    uint64_t wr_id;
+    uint32_t status;
+    uint32_t opcode;
+    uint32_t byte_len;
+    uint32_t imm_data;
+    uint32_t qp_num;
+    uint32_t src_qp;
+    uint32_t wc_flags;
+    uint32_t vendor_err;
+};
+
+int ibv_poll_cq_records(struct ibv_cq *cq, struct ibv_wc *scratch, int scratch_len,
+       struct wc_record *ring, uint32_t ring_size, uint32_t tail, int max, int spin);
+
+// async event with the union element resolved, see ibv_get_async_event_timeout
+struct async_event_info {
+    uint32_t event_type;
+    uint32_t qp_num;
+    uint32_t port_num;
+    struct ibv_qp *qp;
+    struct ibv_cq *cq;
+    struct ibv_srq *srq;
+};
+
+int ibv_get_async_event_timeout(struct ibv_context *context, int timeout_ms,
+       struct async_event_info *out);
 #endif // WRAPPER_H
@@ -1,16 +1,108 @@
 package RDMAGO
 
 import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 )
 
-var sugarLogger *zap.SugaredLogger
+// Logger receives the log output of the package. fields alternate keys and values, e.g.
+// "qp_num", 17, "wr_id", 3. Callers check DebugEnabled before building debug entries, so
+// disabled debug logging costs a single call.
+type Logger interface {
+	Debug(msg string, fields ...interface{})
+	Info(msg string, fields ...interface{})
+	Error(msg string, err error, fields ...interface{})
+	DebugEnabled() bool
+	// With returns a Logger adding fields to every entry.
+	With(fields ...interface{}) Logger
+}
+
+type zapLogger struct {
+	s    *zap.SugaredLogger
+	core zapcore.Core
+}
+
+// NewZapLogger logs to l. Debug output follows the level of its core, so an atomic level
+// can switch it at runtime.
+func NewZapLogger(l *zap.Logger) Logger {
+	return &zapLogger{s: l.Sugar(), core: l.Core()}
+}
 
-func init() {
-	InitLog(false)
+func (l *zapLogger) Debug(msg string, fields ...interface{}) {
+	if l.DebugEnabled() {
+		l.s.Debugw(msg, fields...)
+	}
 }
 
+func (l *zapLogger) Info(msg string, fields ...interface{}) {
+	l.s.Infow(msg, fields...)
+}
+
+func (l *zapLogger) Error(msg string, err error, fields ...interface{}) {
+	if err != nil {
+		fields = append(fields, "error", err)
+	}
+	l.s.Errorw(msg, fields...)
+}
+
+func (l *zapLogger) DebugEnabled() bool {
+	return l.core.Enabled(zapcore.DebugLevel)
+}
+
+func (l *zapLogger) With(fields ...interface{}) Logger {
+	return &zapLogger{s: l.s.With(fields...), core: l.core}
+}
+
+type nopLogger struct{}
+
+// NopLogger discards everything.
+func NopLogger() Logger {
+	return nopLogger{}
+}
+
+func (nopLogger) Debug(string, ...interface{})        {}
+func (nopLogger) Info(string, ...interface{})         {}
+func (nopLogger) Error(string, error, ...interface{}) {}
+func (nopLogger) DebugEnabled() bool                  { return false }
+func (l nopLogger) With(...interface{}) Logger        { return l }
+
+type loggerBox struct {
+	Logger
+}
+
+var defaultLogger atomic.Value
+var defaultLoggerOnce sync.Once
+
+// level of the logger InitLog built, nil while the package logger came from SetLogger
+var logLevel atomic.Pointer[zap.AtomicLevel]
+
+// SetLogger replaces the package logger. Devices and Endpoints without a logger of their
+// own pick it up when they are created.
+func SetLogger(l Logger) {
+	if l == nil {
+		l = NopLogger()
+	}
+	logLevel.Store(nil)
+	defaultLogger.Store(loggerBox{l})
+}
+
+// DefaultLogger returns the package logger, an info level zap production logger unless
+// SetLogger or InitLog replaced it.
+func DefaultLogger() Logger {
+	defaultLoggerOnce.Do(func() {
+		if defaultLogger.Load() == nil {
+			InitLog(false)
+		}
+	})
+	return defaultLogger.Load().(loggerBox).Logger
+}
+
+// InitLog makes a zap logger the package logger, development output when debugMode is set.
 func InitLog(debugMode bool) {
 	var cfg zap.Config
 	if debugMode {
@@ -26,17 +118,39 @@ func InitLog(debugMode bool) {
 	}
 	defer logger.Sync()
 
-	sugarLogger = logger.Sugar()
+	SetLogger(NewZapLogger(logger))
+	logLevel.Store(&cfg.Level)
+}
+
+// LogLevel returns the level of the package logger, "" when SetLogger installed it.
+func LogLevel() string {
+	if level := logLevel.Load(); level != nil {
+		return level.String()
+	}
+	return ""
+}
+
+// SetLogLevel changes the level of the package logger built by InitLog, e.g. to "debug".
+// Loggers installed with SetLogger are configured by their owner.
+func SetLogLevel(level string) error {
+	current := logLevel.Load()
+	if current == nil {
+		return errors.New("[SetLogLevel] the package logger was set by SetLogger")
+	}
+	if err := current.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("[SetLogLevel] %w", err)
+	}
+	return nil
 }
 
 func LogInfo(message string) {
-	sugarLogger.Infof("zap Info: %s", message)
+	DefaultLogger().Info(message)
 }
 
 func LogDebug(message string) {
-	sugarLogger.Debugf("zap Debug: %s", message)
+	DefaultLogger().Debug(message)
 }
 
 func LogError(message string, err error) {
-	sugarLogger.Errorf("zap Error: %s, %v", message, err)
+	DefaultLogger().Error(message, err)
 }